@@ -11,6 +11,7 @@ require (
 	github.com/gofiber/fiber/v3 v3.2.0
 	github.com/refraction-networking/utls v1.8.3-0.20260301010127-aa6edf4b11af
 	github.com/valyala/fasthttp v1.70.0
+	golang.org/x/image v0.25.0
 	golang.org/x/net v0.53.0
 )
 
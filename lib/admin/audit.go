@@ -0,0 +1,95 @@
+package admin
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/requestid"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+)
+
+// Every admin action ends up in the log, in memory (shown in the panel) and in AdminAuditLog file, if it's set
+
+const keepRecent = 100
+
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	RequestID string    `json:"request_id"`
+}
+
+func (e Entry) String() string {
+	s := e.Time.Format(time.DateTime) + " " + e.Action
+	if e.Target != "" {
+		s += " " + e.Target
+	}
+	if e.Error != "" {
+		s += " (failed: " + e.Error + ")"
+	}
+
+	return s
+}
+
+var auditLock sync.Mutex
+var recent []Entry
+
+func audit(c fiber.Ctx, action string, target string, err error) {
+	e := Entry{Time: time.Now(), Action: action, Target: target, RequestID: requestid.FromContext(c)}
+	if err != nil {
+		e.Error = err.Error()
+		logger.Request(c).Warn("admin action failed", "action", action, "target", target, logging.Err(err))
+	} else {
+		logger.Request(c).Info("admin action", "action", action, "target", target)
+	}
+
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	recent = append(recent, e)
+	if len(recent) > keepRecent {
+		recent = recent[len(recent)-keepRecent:]
+	}
+
+	if cfg.AdminAuditLog != "" {
+		err := appendToFile(e)
+		if err != nil {
+			logger.Error("failed to write audit log", logging.Err(err))
+		}
+	}
+}
+
+func appendToFile(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(cfg.AdminAuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// newest first
+func recentEntries() []string {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+
+	l := make([]string, len(recent))
+	for i, e := range recent {
+		l[len(recent)-1-i] = e.String()
+	}
+
+	return l
+}
@@ -0,0 +1,258 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+
+	"git.maid.zone/stuff/soundcloak/lib/blocklist"
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/health"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"git.maid.zone/stuff/soundcloak/lib/misc"
+	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/templates"
+)
+
+// Admin panel at /_/admin. Only loaded if AdminToken is set. Log in with the token in the browser, or send it as "Authorization: Bearer <token>" for scripts
+
+var logger = logging.Module("admin")
+
+// how many cache entries to show at once
+const maxEntries = 500
+
+const maxMessage = 500
+
+var errWrongToken = errors.New("wrong token")
+
+func authed(c fiber.Ctx) bool {
+	if token, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer "); ok {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+	}
+
+	return validSession(c.Cookies("admin"))
+}
+
+func setCookie(c fiber.Ctx, value string, expires time.Time) {
+	cookie := fasthttp.AcquireCookie()
+	cookie.SetKey("admin")
+	cookie.SetValue(value)
+	cookie.SetExpire(expires)
+	cookie.SetHTTPOnly(true)
+	cookie.SetSameSite(fasthttp.CookieSameSiteStrictMode) // no csrf for the forms
+	cookie.SetPath("/_/admin")
+	c.Response().Header.SetCookie(cookie)
+	fasthttp.ReleaseCookie(cookie)
+}
+
+// still reachable during maintenance
+var exempt = []string{"/_/admin", "/_/static", "/_/health", "/_/ready", "/_/metrics"}
+
+func back(c fiber.Ctx) error {
+	// only local redirects
+	if b := c.FormValue("back"); strings.HasPrefix(b, "/_/admin") {
+		return c.Redirect().To(b)
+	}
+
+	return c.Redirect().To("/_/admin")
+}
+
+func Load(r *fiber.App) {
+	if cfg.Prefork && cfg.AdminStateDir == "" {
+		logger.Warn("AdminToken is set, but Prefork is enabled and AdminStateDir is not set. Admin panel will not be available")
+		return
+	}
+
+	r.Use(func(c fiber.Ctx) error {
+		on, msg := Maintenance()
+		if !on {
+			return c.Next()
+		}
+
+		p := c.Path()
+		for _, e := range exempt {
+			if strings.HasPrefix(p, e) {
+				return c.Next()
+			}
+		}
+
+		c.Set("Retry-After", "300")
+		c.Status(fiber.StatusServiceUnavailable)
+		return misc.Render(c, templates.Base("maintenance", templates.Maintenance(msg), nil))
+	})
+
+	r.Post("/_/admin/login", func(c fiber.Ctx) error {
+		if subtle.ConstantTimeCompare([]byte(c.FormValue("token")), []byte(cfg.AdminToken)) != 1 {
+			audit(c, "login", "", errWrongToken)
+			c.Status(fiber.StatusUnauthorized)
+			return misc.Render(c, templates.Base("admin", templates.AdminLogin(true), nil))
+		}
+
+		id, expires, err := newSession()
+		audit(c, "login", "", err)
+		if err != nil {
+			return err
+		}
+
+		setCookie(c, id, expires)
+		return c.Redirect().To("/_/admin")
+	})
+
+	r.Get("/_/admin", func(c fiber.Ctx) error {
+		c.Set("Cache-Control", "no-store")
+		if !authed(c) {
+			return misc.Render(c, templates.Base("admin", templates.AdminLogin(false), nil))
+		}
+
+		on, msg := Maintenance()
+		return misc.Render(c, templates.Base("admin", templates.Admin(sc.Caches(), health.Get(), sc.Circuits(), cfg.ClientID != "", on, msg, blocklist.Entries(), recentEntries()), nil))
+	})
+
+	// everything below needs auth
+	r.Use("/_/admin", func(c fiber.Ctx) error {
+		if !authed(c) {
+			return fiber.ErrUnauthorized
+		}
+
+		c.Set("Cache-Control", "no-store")
+		return c.Next()
+	})
+
+	r.Post("/_/admin/logout", func(c fiber.Ctx) error {
+		err := endSession(c.Cookies("admin"))
+		audit(c, "logout", "", err)
+		if err != nil {
+			return err
+		}
+
+		setCookie(c, "", time.Unix(0, 0))
+		return c.Redirect().To("/_/admin")
+	})
+
+	r.Get("/_/admin/cache/:name", func(c fiber.Ctx) error {
+		entries, ok := sc.CacheEntries(c.Params("name"))
+		if !ok {
+			return fiber.ErrNotFound
+		}
+
+		total := len(entries)
+		q := c.Query("q")
+		if q != "" {
+			filtered := entries[:0]
+			for _, e := range entries {
+				if strings.HasPrefix(e.Key, q) {
+					filtered = append(filtered, e)
+				}
+			}
+			entries = filtered
+		}
+
+		if len(entries) > maxEntries {
+			entries = entries[:maxEntries]
+		}
+
+		return misc.Render(c, templates.Base("admin", templates.AdminCache(c.Params("name"), entries, total, q), nil))
+	})
+
+	r.Post("/_/admin/purge", func(c fiber.Ctx) error {
+		name := c.FormValue("cache")
+		key := strings.Trim(c.FormValue("key"), "/ ")
+		if key == "" {
+			return fiber.ErrBadRequest
+		}
+
+		var err error
+		if !sc.Purge(name, key) {
+			err = fiber.ErrNotFound
+		}
+
+		audit(c, "purge", name+":"+key, err)
+		if err != nil {
+			return err
+		}
+
+		return back(c)
+	})
+
+	r.Post("/_/admin/clear", func(c fiber.Ctx) error {
+		name := c.FormValue("cache")
+		_, ok := sc.ClearCache(name)
+		if !ok {
+			return fiber.ErrNotFound
+		}
+
+		audit(c, "clear cache", name, nil)
+		return c.Redirect().To("/_/admin")
+	})
+
+	r.Post("/_/admin/clientid", func(c fiber.Ctx) error {
+		if cfg.ClientID != "" {
+			return fiber.NewError(fiber.StatusBadRequest, "ClientID is set in the config")
+		}
+
+		err := sc.RefreshClientID()
+		audit(c, "refresh clientid", "", err)
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/_/admin")
+	})
+
+	r.Post("/_/admin/maintenance", func(c fiber.Ctx) error {
+		on := c.FormValue("enabled") == "true"
+		msg := strings.TrimSpace(c.FormValue("message"))
+		if len(msg) > maxMessage {
+			msg = msg[:maxMessage]
+		}
+
+		err := setMaintenance(on, msg)
+		if on {
+			audit(c, "maintenance on", msg, err)
+		} else {
+			audit(c, "maintenance off", "", err)
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/_/admin")
+	})
+
+	// takedowns
+
+	r.Post("/_/admin/blocklist/add", func(c fiber.Ctx) error {
+		e, err := blocklist.Add(c.FormValue("kind"), c.FormValue("value"))
+		audit(c, "block", e.String(), err)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.Redirect().To("/_/admin")
+	})
+
+	r.Post("/_/admin/blocklist/remove", func(c fiber.Ctx) error {
+		e := blocklist.Entry{Kind: c.FormValue("kind"), Value: c.FormValue("value")}
+		err := blocklist.Remove(e.Kind, e.Value)
+		audit(c, "unblock", e.String(), err)
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return c.Redirect().To("/_/admin")
+	})
+
+	r.Post("/_/admin/blocklist/reload", func(c fiber.Ctx) error {
+		err := blocklist.Reload()
+		audit(c, "reload blocklist", "", err)
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/_/admin")
+	})
+}
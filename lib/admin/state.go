@@ -0,0 +1,216 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+)
+
+// Sessions and maintenance mode. Kept in memory, or in AdminStateDir if it's set, so every process (with Prefork) sees the same thing:
+//
+//	sessions/<sha256 of the session id>  (expiry as unix time)
+//	maintenance                          (the message, maintenance is on while the file is there)
+
+const sessionTTL = 12 * time.Hour
+
+// how long a process can go on with the maintenance state it last read from AdminStateDir
+const maintenanceRecheck = 2 * time.Second
+
+var sessionsLock sync.Mutex
+var sessions = map[string]time.Time{} // if there's no AdminStateDir
+
+// the id itself only lives in the cookie
+func sessionKey(id string) string {
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:])
+}
+
+func sessionsDir() string {
+	return filepath.Join(cfg.AdminStateDir, "sessions")
+}
+
+func newSession() (string, time.Time, error) {
+	b := make([]byte, 32)
+	rand.Read(b)
+	id := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(sessionTTL)
+
+	if cfg.AdminStateDir == "" {
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+
+		for k, e := range sessions {
+			if time.Now().After(e) {
+				delete(sessions, k)
+			}
+		}
+
+		sessions[sessionKey(id)] = expires
+		return id, expires, nil
+	}
+
+	pruneSessions()
+
+	err := os.MkdirAll(sessionsDir(), 0700)
+	if err != nil {
+		return "", expires, err
+	}
+
+	err = os.WriteFile(filepath.Join(sessionsDir(), sessionKey(id)), []byte(strconv.FormatInt(expires.Unix(), 10)), 0600)
+	return id, expires, err
+}
+
+// removes expired session files
+func pruneSessions() {
+	files, err := os.ReadDir(sessionsDir())
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		p := filepath.Join(sessionsDir(), f.Name())
+		if e, ok := readExpiry(p); !ok || time.Now().After(e) {
+			os.Remove(p)
+		}
+	}
+}
+
+func readExpiry(p string) (time.Time, bool) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(n, 0), true
+}
+
+func validSession(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	key := sessionKey(id)
+	if cfg.AdminStateDir == "" {
+		sessionsLock.Lock()
+		defer sessionsLock.Unlock()
+
+		e, ok := sessions[key]
+		return ok && time.Now().Before(e)
+	}
+
+	e, ok := readExpiry(filepath.Join(sessionsDir(), key))
+	return ok && time.Now().Before(e)
+}
+
+func endSession(id string) error {
+	if id == "" {
+		return nil
+	}
+
+	key := sessionKey(id)
+	if cfg.AdminStateDir == "" {
+		sessionsLock.Lock()
+		delete(sessions, key)
+		sessionsLock.Unlock()
+		return nil
+	}
+
+	err := os.Remove(filepath.Join(sessionsDir(), key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// Maintenance mode
+
+var maintenanceLock sync.RWMutex
+var maintenance bool
+var maintenanceMessage string
+var maintenanceChecked time.Time
+
+func maintenanceFile() string {
+	return filepath.Join(cfg.AdminStateDir, "maintenance")
+}
+
+func Maintenance() (bool, string) {
+	maintenanceLock.RLock()
+	on, msg, checked := maintenance, maintenanceMessage, maintenanceChecked
+	maintenanceLock.RUnlock()
+
+	if cfg.AdminStateDir == "" || time.Since(checked) < maintenanceRecheck {
+		return on, msg
+	}
+
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	if time.Since(maintenanceChecked) >= maintenanceRecheck {
+		data, err := os.ReadFile(maintenanceFile())
+		if err == nil {
+			maintenance, maintenanceMessage = true, string(data)
+		} else if errors.Is(err, os.ErrNotExist) {
+			maintenance = false
+		} else {
+			// keep what we had
+			logger.Error("failed to read maintenance state", logging.Err(err))
+		}
+
+		maintenanceChecked = time.Now()
+	}
+
+	return maintenance, maintenanceMessage
+}
+
+func setMaintenance(on bool, msg string) error {
+	if cfg.AdminStateDir != "" {
+		var err error
+		if on {
+			err = os.MkdirAll(cfg.AdminStateDir, 0700)
+			if err == nil {
+				// write to a temp file first, so other processes don't read a half-written message
+				tmp := maintenanceFile() + ".tmp"
+				err = os.WriteFile(tmp, []byte(msg), 0600)
+				if err == nil {
+					err = os.Rename(tmp, maintenanceFile())
+				}
+			}
+		} else {
+			err = os.Remove(maintenanceFile())
+			if errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	maintenanceLock.Lock()
+	maintenance = on
+	if on {
+		maintenanceMessage = msg
+	}
+	maintenanceChecked = time.Now()
+	maintenanceLock.Unlock()
+
+	return nil
+}
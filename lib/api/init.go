@@ -1,11 +1,19 @@
 package api
 
 import (
+	"net/url"
+	"strings"
+
+	"git.maid.zone/stuff/soundcloak/lib/blocklist"
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
 	"git.maid.zone/stuff/soundcloak/lib/sc"
 	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
 )
 
+var logger = logging.Module("api")
+
 func Load(a *fiber.App) {
 	r := a.Group("/_/api")
 	r.Use("/v2", func(c fiber.Ctx) error {
@@ -28,6 +36,10 @@ func Load(a *fiber.App) {
 		}
 		return c.SendStatus(404)
 	great:
+		if blockedPath(string(p), req.URI().QueryArgs()) {
+			return sc.ErrBlocked
+		}
+
 		// api-v2 only has gzip, so we use only gzip
 		gzip := req.Header.HasAcceptEncoding("gzip")
 		req.Header.Reset()
@@ -58,6 +70,59 @@ func Load(a *fiber.App) {
 		return err
 	})
 
+	v1(r)
+
 	// DEPRECATED
 	legacy(r)
 }
+
+// The passthrough only checks the entity in the path (or the resolved url), collections in responses are not filtered
+func blockedPath(p string, args *fasthttp.Args) bool {
+	if blocklist.Empty() {
+		return false
+	}
+
+	id := func(prefix string) (string, bool) {
+		rest, ok := strings.CutPrefix(p, prefix)
+		if !ok {
+			return "", false
+		}
+
+		rest, _, _ = strings.Cut(rest, "/")
+		// urns like soundcloud:tracks:123
+		if i := strings.LastIndexByte(rest, ':'); i != -1 {
+			rest = rest[i+1:]
+		}
+
+		return rest, true
+	}
+
+	if i, ok := id("/tracks/"); ok {
+		return blocklist.Track(i)
+	}
+	if i, ok := id("/media/"); ok {
+		return blocklist.Track(i)
+	}
+	if i, ok := id("/users/"); ok {
+		return blocklist.User(i)
+	}
+	if i, ok := id("/playlists/"); ok {
+		return blocklist.Playlist(i)
+	}
+
+	switch p {
+	case "/tracks":
+		for i := range strings.SplitSeq(string(args.Peek("ids")), ",") {
+			if blocklist.Track(i) {
+				return true
+			}
+		}
+	case "/resolve":
+		u, err := url.Parse(string(args.Peek("url")))
+		if err == nil {
+			return blocklist.Permalink(u.Path)
+		}
+	}
+
+	return false
+}
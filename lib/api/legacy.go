@@ -1,13 +1,11 @@
 package api
 
 import (
-	"log"
-
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
 	"git.maid.zone/stuff/soundcloak/lib/sc"
 	json "github.com/goccy/go-json"
 	"github.com/gofiber/fiber/v3"
-	"github.com/valyala/fasthttp"
 )
 
 // do not use
@@ -16,36 +14,34 @@ func legacy(_r fiber.Router) {
 	prefs := cfg.Preferences{ProxyImages: &cfg.False}
 	r.Get("/search", func(c fiber.Ctx) error {
 		c.Set("deprecated", "do not use, will be removed at an unknown point in time")
-		q := c.RequestCtx().QueryArgs().Peek("q")
+		opts := sc.SearchOptions{Query: string(c.RequestCtx().QueryArgs().Peek("q"))}
 		t := cfg.B2s(c.RequestCtx().QueryArgs().Peek("type"))
 		args := c.RequestCtx().QueryArgs().Peek("pagination")
-		if len(args) == 0 {
-			args = fasthttp.AppendQuotedArg([]byte("q="), q)
-		}
+		opts.FromPagination(args)
 
 		switch t {
 		case "tracks":
-			p, err := sc.SearchTracks(prefs, args)
+			p, err := sc.SearchTracks(prefs, opts, args)
 			if err != nil {
-				log.Printf("[API] error getting tracks for %s: %s\n", cfg.B2s(q), err)
+				logger.Request(c).Warn("error searching tracks", logging.Private("query", opts.Query), logging.Err(err))
 				return err
 			}
 
 			return c.JSON(p)
 
 		case "users":
-			p, err := sc.SearchUsers(prefs, args)
+			p, err := sc.SearchUsers(prefs, opts, args)
 			if err != nil {
-				log.Printf("[API] error getting users for %s: %s\n", cfg.B2s(q), err)
+				logger.Request(c).Warn("error searching users", logging.Private("query", opts.Query), logging.Err(err))
 				return err
 			}
 
 			return c.JSON(p)
 
 		case "playlists":
-			p, err := sc.SearchPlaylists(prefs, args)
+			p, err := sc.SearchPlaylists(prefs, opts, args)
 			if err != nil {
-				log.Printf("[API] error getting playlists for %s: %s\n", cfg.B2s(q), err)
+				logger.Request(c).Warn("error searching playlists", logging.Private("query", opts.Query), logging.Err(err))
 				return err
 			}
 
@@ -64,7 +60,7 @@ func legacy(_r fiber.Router) {
 
 		p, err := (sc.Track{ID: json.Number(c.Params("id"))}).GetRelated(prefs, args)
 		if err != nil {
-			log.Printf("[API] error getting related tracks for %s: %s\n", c.Params("id"), err)
+			logger.Request(c).Warn("error getting related tracks", "id", c.Params("id"), logging.Err(err))
 			return err
 		}
 
@@ -75,7 +71,7 @@ func legacy(_r fiber.Router) {
 		c.Set("deprecated", "do not use, will be removed at an unknown point in time")
 		p, err := sc.GetPlaylist(c.Params("author") + "/sets/" + c.Params("playlist"))
 		if err != nil {
-			log.Printf("[API] error getting %s playlist from %s: %s\n", c.Params("playlist"), c.Params("author"), err)
+			logger.Request(c).Warn("error getting playlist from author", "playlist", c.Params("playlist"), "author", c.Params("author"), logging.Err(err))
 			return err
 		}
 
@@ -86,7 +82,7 @@ func legacy(_r fiber.Router) {
 		c.Set("deprecated", "do not use, will be removed at an unknown point in time")
 		p, err := sc.GetPlaylist(c.Params("author") + "/sets/" + c.Params("playlist"))
 		if err != nil {
-			log.Printf("[API] error getting %s playlist tracks from %s: %s\n", c.Params("playlist"), c.Params("author"), err)
+			logger.Request(c).Warn("error getting playlist tracks from author", "playlist", c.Params("playlist"), "author", c.Params("author"), logging.Err(err))
 			return err
 		}
 
@@ -102,7 +98,7 @@ func legacy(_r fiber.Router) {
 		c.Set("deprecated", "do not use, will be removed at an unknown point in time")
 		t, err := sc.GetTrackByID(c.Params("id"))
 		if err != nil {
-			log.Printf("[API] error getting track %s: %s\n", c.Params("id"), err)
+			logger.Request(c).Warn("error getting track", "id", c.Params("id"), logging.Err(err))
 			return err
 		}
 
@@ -114,7 +110,7 @@ func legacy(_r fiber.Router) {
 		ids := cfg.B2s(c.RequestCtx().QueryArgs().Peek("ids"))
 		t, err := sc.GetTracks(ids)
 		if err != nil {
-			log.Printf("[API] error getting %s tracks: %s\n", ids, err)
+			logger.Request(c).Warn("error getting tracks", logging.Private("ids", ids), logging.Err(err))
 			return err
 		}
 
@@ -125,7 +121,7 @@ func legacy(_r fiber.Router) {
 		c.Set("deprecated", "do not use, will be removed at an unknown point in time")
 		t, err := sc.GetTrack(c.Params("user") + "/" + c.Params("track"))
 		if err != nil {
-			log.Printf("[API] error getting track %s from %s: %s\n", c.Params("track"), c.Params("user"), err)
+			logger.Request(c).Warn("error getting track from user", "track", c.Params("track"), "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
@@ -136,7 +132,7 @@ func legacy(_r fiber.Router) {
 		c.Set("deprecated", "do not use, will be removed at an unknown point in time")
 		t, err := (sc.User{ID: json.Number(c.Params("id"))}).GetTracks(prefs, c.Query("pagination"))
 		if err != nil {
-			log.Printf("[API] error getting user %s tracks: %s\n", c.Params("id"), err)
+			logger.Request(c).Warn("error getting user tracks", "id", c.Params("id"), logging.Err(err))
 			return err
 		}
 
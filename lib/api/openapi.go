@@ -0,0 +1,150 @@
+package api
+
+import (
+	"os"
+	"reflect"
+	"strings"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v3"
+)
+
+// OpenAPI document, generated from the route table so it can't drift away from the handlers
+
+type param struct {
+	name        string
+	in          string // "path" or "query"
+	description string
+	required    bool
+}
+
+type route struct {
+	path      string
+	summary   string
+	params    []param
+	paginated bool // accepts cursor & limit
+	resp      any  // zero value of the response type
+	handler   func(c fiber.Ctx) (any, error)
+}
+
+var paginationParams = []param{
+	{"cursor", "query", "value of next from the previous page", false},
+	{"limit", "query", "items per page (1-100, default 20), ignored when cursor is set", false},
+}
+
+func schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]any{}
+		required := []string{}
+		for i := range t.NumField() {
+			f := t.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+
+			props[name] = schema(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+
+		s := map[string]any{"type": "object", "properties": props}
+		if len(required) != 0 {
+			s["required"] = required
+		}
+		return s
+	}
+
+	// interfaces and whatever else
+	return map[string]any{}
+}
+
+func openapi(routes []route) []byte {
+	errResp := map[string]any{
+		"description": "error",
+		"content":     map[string]any{"application/json": map[string]any{"schema": schema(reflect.TypeOf(Error{}))}},
+	}
+
+	paths := map[string]any{}
+	for _, rt := range routes {
+		// fiber :param => openapi {param}
+		segs := strings.Split(rt.path, "/")
+		for i, s := range segs {
+			if len(s) > 1 && s[0] == ':' {
+				segs[i] = "{" + s[1:] + "}"
+			}
+		}
+
+		params := rt.params
+		if rt.paginated {
+			params = append(params[:len(params):len(params)], paginationParams...)
+		}
+
+		ps := make([]map[string]any, len(params))
+		for i, p := range params {
+			ps[i] = map[string]any{
+				"name":        p.name,
+				"in":          p.in,
+				"description": p.description,
+				"required":    p.required,
+				"schema":      map[string]any{"type": "string"},
+			}
+		}
+
+		paths[strings.Join(segs, "/")] = map[string]any{
+			"get": map[string]any{
+				"summary":    rt.summary,
+				"parameters": ps,
+				"responses": map[string]any{
+					"200": map[string]any{
+						"description": "ok",
+						"content":     map[string]any{"application/json": map[string]any{"schema": schema(reflect.TypeOf(rt.resp))}},
+					},
+					"default": errResp,
+				},
+			},
+		}
+	}
+
+	doc, err := json.Marshal(map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "soundcloak API",
+			"version": "1",
+			"x-build": cfg.Commit,
+		},
+		"servers": []map[string]any{{"url": "/_/api/v1"}},
+		"paths":   paths,
+	})
+	if err != nil {
+		logger.Error("failed to marshal openapi document", logging.Err(err))
+		os.Exit(1)
+	}
+
+	return doc
+}
@@ -0,0 +1,593 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+)
+
+// Stable API. Response types here are versioned and decoupled from lib/sc, so upstream changes don't leak through.
+// If you need to break something, make a v2 (not to be confused with /_/api/v2, which is the raw passthrough)
+
+type Link struct {
+	URL   string `json:"url"`
+	Title string `json:"title"`
+}
+
+type User struct {
+	ID           string `json:"id"`
+	Permalink    string `json:"permalink"`
+	URL          string `json:"url"` // page on this instance
+	Username     string `json:"username"`
+	FullName     string `json:"full_name,omitempty"`
+	Description  string `json:"description,omitempty"`
+	Avatar       string `json:"avatar,omitempty"`
+	Verified     bool   `json:"verified"`
+	Followers    int64  `json:"followers"`
+	Following    int64  `json:"following"`
+	Tracks       int64  `json:"tracks"`
+	Playlists    int64  `json:"playlists"`
+	Likes        int64  `json:"likes"`
+	CreatedAt    string `json:"created_at,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Links        []Link `json:"links,omitempty"`
+}
+
+// Stream endpoints on this instance. Only the ones available for the track (and this instance) are set
+type Streams struct {
+	HLS         string `json:"hls,omitempty"`          // HLS playlist, MP3 segments
+	HLSAAC      string `json:"hls_aac,omitempty"`      // HLS playlist, AAC segments
+	Progressive string `json:"progressive,omitempty"`  // MP3 file
+	Restream    string `json:"restream,omitempty"`     // MP3 file (needs Restream enabled)
+	RestreamAAC string `json:"restream_aac,omitempty"` // M4A file (needs Restream enabled)
+}
+
+type Track struct {
+	ID           string   `json:"id"`
+	Permalink    string   `json:"permalink"`
+	URL          string   `json:"url"` // page on this instance
+	Title        string   `json:"title"`
+	Description  string   `json:"description,omitempty"`
+	Genre        string   `json:"genre,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	License      string   `json:"license,omitempty"`
+	ISRC         string   `json:"isrc,omitempty"`
+	Artwork      string   `json:"artwork,omitempty"`
+	DurationMs   uint32   `json:"duration_ms"`
+	Policy       string   `json:"policy"`
+	Likes        int64    `json:"likes"`
+	Plays        int64    `json:"plays"`
+	Reposts      int64    `json:"reposts"`
+	Comments     int64    `json:"comments"`
+	CreatedAt    string   `json:"created_at,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+	Author       User     `json:"author"`
+	Streams      Streams  `json:"streams"`
+}
+
+type Playlist struct {
+	ID           string   `json:"id"`
+	Permalink    string   `json:"permalink"`
+	URL          string   `json:"url"` // page on this instance
+	Title        string   `json:"title"`
+	Description  string   `json:"description,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Artwork      string   `json:"artwork,omitempty"`
+	Album        bool     `json:"album"`
+	TrackCount   int64    `json:"track_count"`
+	Likes        int64    `json:"likes"`
+	CreatedAt    string   `json:"created_at,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+	Author       User     `json:"author"`
+	Tracks       []Track  `json:"tracks,omitempty"` // only when getting a single playlist
+}
+
+type Page[T any] struct {
+	Items []T    `json:"items"`
+	Next  string `json:"next,omitempty"`  // pass as ?cursor= to get the next page, missing on last page
+	Total int64  `json:"total,omitempty"` // only for search
+}
+
+type ErrorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+type Error struct {
+	Error ErrorBody `json:"error"`
+}
+
+// images are proxied in image() instead, since we need absolute urls here
+var prefsV1 = cfg.Preferences{ProxyImages: &cfg.False}
+
+func tags(taglist string) []string {
+	if taglist == "" {
+		return nil
+	}
+
+	return strings.Split(sc.TagListParser(taglist), ", ")
+}
+
+func image(base, u string) string {
+	if u != "" && cfg.ProxyImages {
+		return base + signing.Image(u)
+	}
+
+	return u
+}
+
+func toUser(base string, u *sc.User) User {
+	r := User{
+		ID:           string(u.ID),
+		Permalink:    u.Permalink,
+		URL:          base + "/" + u.Permalink,
+		Username:     u.Username,
+		FullName:     u.FullName,
+		Description:  u.Description,
+		Avatar:       image(base, u.Avatar),
+		Verified:     u.Verified,
+		Followers:    u.Followers,
+		Following:    u.Following,
+		Tracks:       u.Tracks,
+		Playlists:    u.Playlists,
+		Likes:        u.Liked,
+		CreatedAt:    u.CreatedAt,
+		LastModified: u.LastModified,
+	}
+
+	for _, l := range u.WebProfiles {
+		if len(l.URL) != 0 && l.URL[0] == '/' {
+			l.URL = base + l.URL
+		}
+		r.Links = append(r.Links, Link{URL: l.URL, Title: l.Title})
+	}
+
+	return r
+}
+
+func toStreams(base string, t *sc.Track) (s Streams) {
+	href := t.Href()
+	// quality isn't signed, only the track
+	stream := func(kind string, args string) string {
+		return base + signing.URL("/_/api/"+kind+href+args, "/_/api/"+kind+href)
+	}
+
+	if tr, audio := t.Media.SelectCompatibleHLS(cfg.AudioMP3); tr != nil && audio == cfg.AudioMP3 {
+		s.HLS = stream("hls", "?audio="+cfg.AudioMP3)
+	}
+	if tr, audio := t.Media.SelectCompatibleHLS(cfg.AudioAAC); tr != nil && audio == cfg.AudioAAC {
+		s.HLSAAC = stream("hls", "?audio="+cfg.AudioAAC)
+	}
+	if t.Media.SelectCompatibleProgressive() != nil {
+		s.Progressive = stream("progressive", "")
+	}
+
+	if cfg.Restream {
+		if _, audio := t.Media.SelectCompatibleRestream(cfg.AudioMP3); audio == cfg.AudioMP3 {
+			s.Restream = stream("restream", "?audio="+cfg.AudioMP3)
+		}
+		if _, audio := t.Media.SelectCompatibleRestream(cfg.AudioAAC); audio == cfg.AudioAAC {
+			s.RestreamAAC = stream("restream", "?audio="+cfg.AudioAAC)
+		}
+	}
+
+	return
+}
+
+func toTrack(base string, t *sc.Track) Track {
+	return Track{
+		ID:           string(t.ID),
+		Permalink:    t.Permalink,
+		URL:          base + t.Href(),
+		Title:        t.Title,
+		Description:  t.Description,
+		Genre:        t.Genre,
+		Tags:         tags(t.TagList),
+		License:      t.License,
+		ISRC:         t.PublisherMetadata.ISRC,
+		Artwork:      image(base, t.Artwork),
+		DurationMs:   t.Duration,
+		Policy:       string(t.Policy),
+		Likes:        t.Likes,
+		Plays:        t.Played,
+		Reposts:      t.Reposted,
+		Comments:     int64(t.Comments),
+		CreatedAt:    t.CreatedAt,
+		LastModified: t.LastModified,
+		Author:       toUser(base, &t.Author),
+		Streams:      toStreams(base, t),
+	}
+}
+
+func toPlaylist(base string, p *sc.Playlist, withTracks bool) Playlist {
+	r := Playlist{
+		ID:           string(p.ID),
+		Permalink:    p.Permalink,
+		URL:          base + p.Href(),
+		Title:        p.Title,
+		Description:  p.Description,
+		Tags:         tags(p.TagList),
+		Artwork:      image(base, p.Artwork),
+		Album:        p.Album,
+		TrackCount:   p.TracksCount(),
+		Likes:        p.Likes,
+		CreatedAt:    p.CreatedAt,
+		LastModified: p.LastModified,
+		Author:       toUser(base, &p.Author),
+	}
+
+	if withTracks {
+		r.Tracks = make([]Track, 0, len(p.Tracks))
+		for _, t := range p.Tracks {
+			if t.Title == "" { // couldn't get it
+				continue
+			}
+
+			r.Tracks = append(r.Tracks, toTrack(base, &t))
+		}
+	}
+
+	return r
+}
+
+func toPage[T, R any](p *sc.Paginated[T], conv func(T) R) Page[R] {
+	r := Page[R]{Items: make([]R, len(p.Collection)), Next: cursor(p.NextHref), Total: p.Total}
+	for i, v := range p.Collection {
+		r.Items[i] = conv(v)
+	}
+
+	return r
+}
+
+// cursor is just the query of next_href, so we can feed it back into the same functions html pages use
+func cursor(next string) string {
+	i := strings.IndexByte(next, '?')
+	if i == -1 {
+		return ""
+	}
+
+	return base64.RawURLEncoding.EncodeToString([]byte(next[i+1:]))
+}
+
+var errBadCursor = fiber.NewError(fiber.StatusBadRequest, "invalid cursor")
+var errBadLimit = fiber.NewError(fiber.StatusBadRequest, "limit must be between 1 and 100")
+
+// what a cursor can carry over to soundcloud. Search filters are in there too, they get validated by sc.SearchOptions
+var cursorParams = []string{"offset", "cursor", "limit", "linked_partitioning", "query_urn", "q", "sort", "filter.duration", "filter.license", "filter.created_at", "filter.genre_or_tag"}
+
+func pagination(c fiber.Ctx) (string, error) {
+	if cur := c.Query("cursor"); cur != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cur)
+		if err != nil {
+			return "", errBadCursor
+		}
+
+		in := fasthttp.AcquireArgs()
+		defer fasthttp.ReleaseArgs(in)
+		in.ParseBytes(data)
+
+		out := fasthttp.AcquireArgs()
+		defer fasthttp.ReleaseArgs(out)
+		for _, k := range cursorParams {
+			if v := in.Peek(k); v != nil {
+				out.SetBytesV(k, v)
+			}
+		}
+
+		if limit := out.Peek("limit"); limit != nil {
+			n, err := strconv.Atoi(string(limit))
+			if err != nil || n < 1 || n > 100 {
+				return "", errBadCursor
+			}
+		}
+
+		return string(out.QueryString()), nil
+	}
+
+	limit := c.Query("limit", "20")
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 || n > 100 {
+		return "", errBadLimit
+	}
+
+	return "limit=" + limit, nil
+}
+
+func sendError(c fiber.Ctx, err error) error {
+	status := fiber.StatusInternalServerError
+	var fe *fiber.Error
+	var se *sc.StatusError
+	if errors.As(err, &fe) {
+		status = fe.Code
+	} else if errors.As(err, &se) {
+		status = fiber.StatusBadGateway
+		if se.Status == fiber.StatusNotFound {
+			status = fiber.StatusNotFound
+		}
+	} else if errors.Is(err, sc.ErrKindNotCorrect) {
+		status = fiber.StatusNotFound
+	} else if errors.Is(err, sc.ProxyErr) {
+		status = fiber.StatusBadGateway
+	} else if errors.Is(err, sc.ErrBlocked) {
+		status = fiber.StatusUnavailableForLegalReasons
+	}
+
+	msg := err.Error()
+	if status == fiber.StatusNotFound {
+		msg = "not found"
+	} else if status == fiber.StatusUnavailableForLegalReasons {
+		msg = cfg.BlockedMessage
+	}
+
+	return c.Status(status).JSON(Error{ErrorBody{Status: status, Message: msg}})
+}
+
+func v1(r fiber.Router) {
+	g := r.Group("/v1")
+	for _, rt := range routesV1 {
+		h := rt.handler
+		g.Get(rt.path, func(c fiber.Ctx) error {
+			res, err := h(c)
+			if err != nil {
+				return sendError(c, err)
+			}
+
+			return c.JSON(res)
+		})
+	}
+
+	doc := openapi(routesV1)
+	g.Get("/openapi.json", func(c fiber.Ctx) error {
+		c.Response().Header.SetContentType("application/json")
+		return c.Send(doc)
+	})
+
+	g.Use(func(c fiber.Ctx) error {
+		return sendError(c, fiber.ErrNotFound)
+	})
+}
+
+func getUser(c fiber.Ctx) (sc.User, error) {
+	return sc.GetUser(c.Params("user"))
+}
+
+var userParam = param{"user", "path", "user permalink", true}
+var trackParam = param{"track", "path", "track permalink", true}
+
+var searchParams = []param{
+	{"q", "query", "search query", true},
+	{"type", "query", "tracks (default), users or playlists", false},
+	{"sort", "query", "popular, or empty for relevance", false},
+	{"duration", "query", "short, medium, long or epic", false},
+	{"license", "query", "to_share, to_use_commercially or to_modify_commercially", false},
+	{"created_at", "query", "last_hour, last_day, last_week, last_month or last_year", false},
+	{"genre", "query", "genre or tag", false},
+}
+
+var routesV1 = []route{
+	{
+		path:    "/users/:user",
+		summary: "Get a user",
+		params:  []param{userParam},
+		resp:    User{},
+		handler: func(c fiber.Ctx) (any, error) {
+			u, err := getUser(c)
+			if err != nil {
+				return nil, err
+			}
+
+			return toUser(c.BaseURL(), &u), nil
+		},
+	},
+	{
+		path:      "/users/:user/tracks",
+		summary:   "Get tracks uploaded by a user",
+		params:    []param{userParam},
+		paginated: true,
+		resp:      Page[Track]{},
+		handler: func(c fiber.Ctx) (any, error) {
+			args, err := pagination(c)
+			if err != nil {
+				return nil, err
+			}
+
+			u, err := getUser(c)
+			if err != nil {
+				return nil, err
+			}
+
+			p, err := u.GetTracks(prefsV1, args)
+			if err != nil {
+				return nil, err
+			}
+
+			base := c.BaseURL()
+			return toPage(p, func(t *sc.Track) Track { return toTrack(base, t) }), nil
+		},
+	},
+	{
+		path:      "/users/:user/playlists",
+		summary:   "Get playlists made by a user",
+		params:    []param{userParam},
+		paginated: true,
+		resp:      Page[Playlist]{},
+		handler: func(c fiber.Ctx) (any, error) {
+			args, err := pagination(c)
+			if err != nil {
+				return nil, err
+			}
+
+			u, err := getUser(c)
+			if err != nil {
+				return nil, err
+			}
+
+			p, err := u.GetPlaylists(prefsV1, args)
+			if err != nil {
+				return nil, err
+			}
+
+			base := c.BaseURL()
+			return toPage(p, func(p *sc.Playlist) Playlist { return toPlaylist(base, p, false) }), nil
+		},
+	},
+	{
+		path:      "/users/:user/albums",
+		summary:   "Get albums made by a user",
+		params:    []param{userParam},
+		paginated: true,
+		resp:      Page[Playlist]{},
+		handler: func(c fiber.Ctx) (any, error) {
+			args, err := pagination(c)
+			if err != nil {
+				return nil, err
+			}
+
+			u, err := getUser(c)
+			if err != nil {
+				return nil, err
+			}
+
+			p, err := u.GetAlbums(prefsV1, args)
+			if err != nil {
+				return nil, err
+			}
+
+			base := c.BaseURL()
+			return toPage(p, func(p *sc.Playlist) Playlist { return toPlaylist(base, p, false) }), nil
+		},
+	},
+	{
+		path:    "/users/:user/tracks/:track",
+		summary: "Get a track",
+		params:  []param{userParam, trackParam},
+		resp:    Track{},
+		handler: func(c fiber.Ctx) (any, error) {
+			t, err := sc.GetTrack(c.Params("user") + "/" + c.Params("track"))
+			if err != nil {
+				return nil, err
+			}
+
+			return toTrack(c.BaseURL(), &t), nil
+		},
+	},
+	{
+		path:      "/users/:user/tracks/:track/related",
+		summary:   "Get tracks related to a track",
+		params:    []param{userParam, trackParam},
+		paginated: true,
+		resp:      Page[Track]{},
+		handler: func(c fiber.Ctx) (any, error) {
+			args, err := pagination(c)
+			if err != nil {
+				return nil, err
+			}
+
+			t, err := sc.GetTrack(c.Params("user") + "/" + c.Params("track"))
+			if err != nil {
+				return nil, err
+			}
+
+			p, err := t.GetRelated(prefsV1, args)
+			if err != nil {
+				return nil, err
+			}
+
+			base := c.BaseURL()
+			return toPage(p, func(t *sc.Track) Track { return toTrack(base, t) }), nil
+		},
+	},
+	{
+		path:    "/users/:user/sets/:playlist",
+		summary: "Get a playlist with all of its tracks",
+		params:  []param{userParam, {"playlist", "path", "playlist permalink", true}},
+		resp:    Playlist{},
+		handler: func(c fiber.Ctx) (any, error) {
+			p, err := sc.GetPlaylist(c.Params("user") + "/sets/" + c.Params("playlist"))
+			if err != nil {
+				return nil, err
+			}
+
+			err = p.GetAllMissingTracks()
+			if err != nil {
+				return nil, err
+			}
+
+			return toPlaylist(c.BaseURL(), &p, true), nil
+		},
+	},
+	{
+		path:    "/tracks/:id",
+		summary: "Get a track by its ID",
+		params:  []param{{"id", "path", "track id", true}},
+		resp:    Track{},
+		handler: func(c fiber.Ctx) (any, error) {
+			id := c.Params("id")
+			for _, n := range id {
+				if n < '0' || n > '9' {
+					return nil, fiber.NewError(fiber.StatusBadRequest, "id must be a number")
+				}
+			}
+
+			t, err := sc.GetTrackByID(id)
+			if err != nil {
+				return nil, err
+			}
+
+			return toTrack(c.BaseURL(), &t), nil
+		},
+	},
+	{
+		path:      "/search",
+		summary:   "Search for tracks, users or playlists. Items are of the type you searched for",
+		params:    searchParams,
+		paginated: true,
+		resp:      Page[any]{},
+		handler: func(c fiber.Ctx) (any, error) {
+			args, err := pagination(c)
+			if err != nil {
+				return nil, err
+			}
+
+			opts := sc.ParseSearchOptions(c.RequestCtx().QueryArgs())
+			opts.FromPagination(cfg.S2b(args))
+			if opts.Query == "" {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "q is required")
+			}
+
+			base := c.BaseURL()
+			switch c.Query("type", "tracks") {
+			case "tracks":
+				p, err := sc.SearchTracks(prefsV1, opts, cfg.S2b(args))
+				if err != nil {
+					return nil, err
+				}
+
+				return toPage(p, func(t *sc.Track) Track { return toTrack(base, t) }), nil
+			case "users":
+				p, err := sc.SearchUsers(prefsV1, opts, cfg.S2b(args))
+				if err != nil {
+					return nil, err
+				}
+
+				return toPage(p, func(u *sc.User) User { return toUser(base, u) }), nil
+			case "playlists":
+				p, err := sc.SearchPlaylists(prefsV1, opts, cfg.S2b(args))
+				if err != nil {
+					return nil, err
+				}
+
+				return toPage(p, func(p *sc.Playlist) Playlist { return toPlaylist(base, p, false) }), nil
+			}
+
+			return nil, fiber.NewError(fiber.StatusBadRequest, "type must be tracks, users or playlists")
+		},
+	},
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v3"
+
+	"git.maid.zone/stuff/soundcloak/lib/blocklist"
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/sc"
+)
+
+// nothing here should get as far as soundcloud
+func TestMain(m *testing.M) {
+	sc.ClientID = "test"
+
+	dir, err := os.MkdirTemp("", "soundcloak-api")
+	if err != nil {
+		panic(err)
+	}
+
+	cfg.BlocklistFile = filepath.Join(dir, "blocklist")
+	_, err = blocklist.Add(blocklist.KindPermalink, "someone/some-track")
+	if err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestBlocked(t *testing.T) {
+	app := fiber.New()
+	Load(app)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/_/api/v1/users/someone/tracks/some-track", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != fiber.StatusUnavailableForLegalReasons {
+		t.Errorf("got status %d, want 451", resp.StatusCode)
+	}
+
+	var e Error
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Error.Status != fiber.StatusUnavailableForLegalReasons || e.Error.Message != cfg.BlockedMessage {
+		t.Errorf("got %+v, want 451 with the blocked message", e.Error)
+	}
+}
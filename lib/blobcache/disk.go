@@ -0,0 +1,197 @@
+package blobcache
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+)
+
+// The order is kept in memory and rebuilt from modification times on startup, hits touch the file so it survives restarts.
+// Keys are used as file names, so they should be safe for that (like hex hashes)
+// With Prefork, every process has its own order and size, and only counts the files it wrote (and the ones that were there on startup), so the directory can grow up to limit times the number of processes
+
+type diskFile struct {
+	key  string
+	name string
+	size int64
+}
+
+type disk struct {
+	dir   string
+	limit int64
+
+	lock  sync.Mutex
+	size  int64
+	lru   *list.List // of *diskFile, most recently used first
+	files map[string]*list.Element
+}
+
+func newDisk(dir string, limit int64) (*disk, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type found struct {
+		f   *diskFile
+		mod time.Time
+	}
+
+	var l []found
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if ext == ".tmp" { // leftover from a crash
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		l = append(l, found{&diskFile{key: strings.TrimSuffix(name, ext), name: name, size: info.Size()}, info.ModTime()})
+	}
+
+	slices.SortFunc(l, func(a, b found) int {
+		return b.mod.Compare(a.mod)
+	})
+
+	d := &disk{dir: dir, limit: limit, lru: list.New(), files: make(map[string]*list.Element, len(l))}
+	for _, f := range l {
+		d.files[f.f.key] = d.lru.PushBack(f.f)
+		d.size += f.f.size
+	}
+
+	d.lock.Lock()
+	old := d.evict()
+	d.lock.Unlock()
+	d.removeFiles(old)
+
+	return d, nil
+}
+
+func (d *disk) Get(key string) ([]byte, string, bool) {
+	d.lock.Lock()
+	el, ok := d.files[key]
+	if !ok {
+		d.lock.Unlock()
+		return nil, "", false
+	}
+
+	d.lru.MoveToFront(el)
+	f := el.Value.(*diskFile)
+	d.lock.Unlock()
+
+	p := filepath.Join(d.dir, f.name)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		// removed by someone else (like another process with Prefork)
+		d.lock.Lock()
+		if el, ok := d.files[key]; ok && el.Value == f {
+			d.size -= f.size
+			d.lru.Remove(el)
+			delete(d.files, key)
+		}
+		d.lock.Unlock()
+		return nil, "", false
+	}
+
+	now := time.Now()
+	os.Chtimes(p, now, now)
+
+	return data, filepath.Ext(f.name), true
+}
+
+func (d *disk) Put(key string, ext string, data []byte) {
+	if int64(len(data)) > d.limit || ext == ".tmp" {
+		return
+	}
+
+	f := &diskFile{key: key, name: key + ext, size: int64(len(data))}
+
+	// write to a temp file first, so nobody reads a half-written file
+	tmp, err := os.CreateTemp(d.dir, f.name+".*.tmp")
+	if err != nil {
+		logger.Warn("failed to write to disk cache", "dir", d.dir, logging.Err(err))
+		return
+	}
+
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(d.dir, f.name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.Warn("failed to write to disk cache", "dir", d.dir, logging.Err(err))
+		return
+	}
+
+	d.lock.Lock()
+	var old []string
+	if el, ok := d.files[key]; ok {
+		prev := el.Value.(*diskFile)
+		if prev.name != f.name {
+			old = append(old, prev.name)
+		}
+		d.size -= prev.size
+		el.Value = f
+		d.lru.MoveToFront(el)
+	} else {
+		d.files[key] = d.lru.PushFront(f)
+	}
+	d.size += f.size
+	old = append(old, d.evict()...)
+	d.lock.Unlock()
+
+	d.removeFiles(old)
+}
+
+// takes the least recently used files out until the cache fits, call with the lock held. The files are removed after unlocking, see removeFiles
+func (d *disk) evict() []string {
+	var old []string
+	for d.size > d.limit {
+		el := d.lru.Back()
+		if el == nil {
+			break
+		}
+
+		f := el.Value.(*diskFile)
+		d.lru.Remove(el)
+		delete(d.files, f.key)
+		d.size -= f.size
+		old = append(old, f.name)
+	}
+
+	return old
+}
+
+func (d *disk) removeFiles(names []string) {
+	for _, name := range names {
+		os.Remove(filepath.Join(d.dir, name))
+	}
+}
+
+func (d *disk) Size() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.size
+}
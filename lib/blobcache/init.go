@@ -0,0 +1,73 @@
+package blobcache
+
+import (
+	"sync"
+
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
+)
+
+// Size-bounded LRU caches for blobs that never change (proxied images, hls segments), in memory or on disk.
+// Every blob has an extension (like ".jpg"), so the disk cache can tell what the files are after a restart
+
+var logger = logging.Module("blobcache")
+
+type Cache interface {
+	// Data, extension and if it was found. Don't modify the data
+	Get(key string) ([]byte, string, bool)
+	Put(key string, ext string, data []byte)
+	Size() int64
+}
+
+var lock sync.Mutex
+var caches = map[string]Cache{}
+
+func register(name string, c Cache) {
+	lock.Lock()
+	caches[name] = c
+	lock.Unlock()
+}
+
+func init() {
+	metrics.Gauge("soundcloak_cache_bytes", "Size of the image/segment caches, in bytes.", "cache", func() map[string]float64 {
+		lock.Lock()
+		defer lock.Unlock()
+
+		m := make(map[string]float64, len(caches))
+		for name, c := range caches {
+			m[name] = float64(c.Size())
+		}
+		return m
+	})
+}
+
+// Counts hits/misses, under name
+type counted struct {
+	Cache
+	name string
+}
+
+func (c counted) Get(key string) ([]byte, string, bool) {
+	data, ext, ok := c.Cache.Get(key)
+	metrics.Cache(c.name, ok)
+	return data, ext, ok
+}
+
+// In memory if dir is empty, on disk otherwise. limit is in bytes
+func New(name string, dir string, limit int64) (Cache, error) {
+	var c Cache
+	if dir == "" {
+		c = newMemory(limit)
+	} else {
+		d, err := newDisk(dir, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		logger.Info("loaded disk cache", "cache", name, "files", d.lru.Len(), "bytes", d.size)
+		c = d
+	}
+
+	register(name, c)
+	return counted{c, name}, nil
+}
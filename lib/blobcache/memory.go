@@ -0,0 +1,80 @@
+package blobcache
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+)
+
+type memoryBlob struct {
+	key  string
+	ext  string
+	data []byte
+}
+
+type memory struct {
+	limit int64
+
+	lock  sync.Mutex
+	size  int64
+	lru   *list.List // of *memoryBlob, most recently used first
+	blobs map[string]*list.Element
+}
+
+func newMemory(limit int64) *memory {
+	return &memory{limit: limit, lru: list.New(), blobs: map[string]*list.Element{}}
+}
+
+func (m *memory) Get(key string) ([]byte, string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	el, ok := m.blobs[key]
+	if !ok {
+		return nil, "", false
+	}
+
+	m.lru.MoveToFront(el)
+	b := el.Value.(*memoryBlob)
+	return b.data, b.ext, true
+}
+
+func (m *memory) Put(key string, ext string, data []byte) {
+	if int64(len(data)) > m.limit {
+		return
+	}
+
+	// clipped, so appending to it never writes into the cached data
+	b := &memoryBlob{key, ext, slices.Clip(data)}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if el, ok := m.blobs[key]; ok {
+		m.size -= int64(len(el.Value.(*memoryBlob).data))
+		el.Value = b
+		m.lru.MoveToFront(el)
+	} else {
+		m.blobs[key] = m.lru.PushFront(b)
+	}
+	m.size += int64(len(data))
+
+	for m.size > m.limit {
+		el := m.lru.Back()
+		if el == nil {
+			break
+		}
+
+		old := el.Value.(*memoryBlob)
+		m.lru.Remove(el)
+		delete(m.blobs, old.key)
+		m.size -= int64(len(old.data))
+	}
+}
+
+func (m *memory) Size() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.size
+}
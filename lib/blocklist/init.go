@@ -0,0 +1,409 @@
+package blocklist
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+)
+
+// Takedown blocklist, loaded from BlocklistFile. One entry per line, "<kind> <value>", lines starting with # are comments:
+//
+//	track 123456789
+//	user 123456
+//	playlist 123456789
+//	permalink someone                 (the user and everything they uploaded)
+//	permalink someone/some-track
+//	permalink someone/sets/some-playlist
+//	image artworks-000123456789-abcdef (artwork/avatar key, for the image proxy)
+//
+// Permalinks are case-insensitive. Checks are lock-free, and a no-op if the list is empty
+
+var logger = logging.Module("blocklist")
+
+const (
+	KindTrack     = "track"
+	KindUser      = "user"
+	KindPlaylist  = "playlist"
+	KindPermalink = "permalink"
+	KindImage     = "image"
+)
+
+var Kinds = []string{KindTrack, KindUser, KindPlaylist, KindPermalink, KindImage}
+
+var ErrBadKind = errors.New("unknown kind")
+var ErrBadValue = errors.New("bad value")
+var ErrNoFile = errors.New("BlocklistFile is not set")
+var ErrNotFound = errors.New("entry not found")
+
+type Entry struct {
+	Kind  string
+	Value string
+}
+
+func (e Entry) String() string {
+	return e.Kind + " " + e.Value
+}
+
+type list struct {
+	sets    map[string]map[string]struct{}
+	entries []Entry
+}
+
+var current atomic.Pointer[list]
+
+// for Add/Remove/Reload, so file writes don't race
+var fileLock sync.Mutex
+
+// size and mtime of the file we loaded last (under fileLock), to see if another process changed it
+var loadedStat struct {
+	size    int64
+	modTime time.Time
+}
+
+// how often the file is checked for changes. With Prefork, other processes only see Add/Remove from the panel this way
+const watchInterval = 5 * time.Second
+
+var onReload []func()
+
+// f is called after every reload, not on the first load. Should be set up from init
+func OnReload(f func()) {
+	onReload = append(onReload, f)
+}
+
+func get() *list {
+	return current.Load()
+}
+
+func normalize(kind string, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case KindTrack, KindUser, KindPlaylist:
+		if value == "" {
+			return "", ErrBadValue
+		}
+		for _, c := range value {
+			if c < '0' || c > '9' {
+				return "", ErrBadValue
+			}
+		}
+	case KindPermalink:
+		value = strings.ToLower(strings.Trim(value, "/"))
+		if value == "" || strings.ContainsAny(value, " ?#") {
+			return "", ErrBadValue
+		}
+	case KindImage:
+		if value == "" || strings.ContainsAny(value, " /?#") {
+			return "", ErrBadValue
+		}
+	default:
+		return "", ErrBadKind
+	}
+
+	return value, nil
+}
+
+func parseLine(line string) (Entry, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return Entry{}, false, nil
+	}
+
+	kind, value, _ := strings.Cut(line, " ")
+	kind = strings.ToLower(kind)
+	value, err := normalize(kind, value)
+	if err != nil {
+		return Entry{}, false, err
+	}
+
+	return Entry{kind, value}, true, nil
+}
+
+func build(entries []Entry) *list {
+	l := &list{sets: map[string]map[string]struct{}{}, entries: entries}
+	for _, k := range Kinds {
+		l.sets[k] = map[string]struct{}{}
+	}
+
+	for _, e := range entries {
+		l.sets[e.Kind][e.Value] = struct{}{}
+	}
+
+	return l
+}
+
+func parse() ([]Entry, error) {
+	f, err := os.Open(cfg.BlocklistFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	s := bufio.NewScanner(f)
+	n := 0
+	for s.Scan() {
+		n++
+		e, ok, err := parseLine(s.Text())
+		if err != nil {
+			logger.Warn("skipping bad blocklist line", "line", n, logging.Err(err))
+			continue
+		}
+
+		if ok && !slices.Contains(entries, e) {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, s.Err()
+}
+
+// (Re)loads the list from BlocklistFile. On error, the old list is kept
+func Reload() error {
+	if cfg.BlocklistFile == "" {
+		return ErrNoFile
+	}
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	return reload()
+}
+
+func reload() error {
+	// stat before reading, so a write in between gets picked up next time
+	st, statErr := os.Stat(cfg.BlocklistFile)
+
+	// also on errors, so a broken file isn't retried every watchInterval
+	loadedStat.size, loadedStat.modTime = 0, time.Time{}
+	if statErr == nil {
+		loadedStat.size, loadedStat.modTime = st.Size(), st.ModTime()
+	}
+
+	entries, err := parse()
+	if err != nil {
+		return err
+	}
+
+	first := current.Swap(build(entries)) == nil
+	logger.Info("loaded blocklist", "entries", len(entries))
+	if !first {
+		for _, f := range onReload {
+			f()
+		}
+	}
+
+	return nil
+}
+
+// reloads if the file changed since we last loaded it
+func reloadChanged() error {
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	var size int64
+	var modTime time.Time
+	st, err := os.Stat(cfg.BlocklistFile)
+	if err == nil {
+		size, modTime = st.Size(), st.ModTime()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if size == loadedStat.size && modTime.Equal(loadedStat.modTime) {
+		return nil
+	}
+
+	return reload()
+}
+
+func init() {
+	if cfg.BlocklistFile == "" {
+		current.Store(build(nil))
+		return
+	}
+
+	err := Reload()
+	if err != nil {
+		current.Store(build(nil))
+		logger.Error("failed to load blocklist", logging.Err(err))
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			err := Reload()
+			if err != nil {
+				logger.Error("failed to reload blocklist", logging.Err(err))
+			}
+		}
+	}()
+
+	go func() {
+		for range time.Tick(watchInterval) {
+			err := reloadChanged()
+			if err != nil {
+				logger.Error("failed to reload blocklist", logging.Err(err))
+			}
+		}
+	}()
+}
+
+func Entries() []Entry {
+	return slices.Clone(get().entries)
+}
+
+func Empty() bool {
+	return len(get().entries) == 0
+}
+
+func has(kind string, value string) bool {
+	l := get()
+	if len(l.entries) == 0 {
+		return false
+	}
+
+	_, ok := l.sets[kind][value]
+	return ok
+}
+
+func Track(id string) bool {
+	return has(KindTrack, id)
+}
+
+func User(id string) bool {
+	return has(KindUser, id)
+}
+
+func Playlist(id string) bool {
+	return has(KindPlaylist, id)
+}
+
+// Also true if any parent is blocked, so blocking "someone" blocks "someone/some-track" too
+func Permalink(permalink string) bool {
+	l := get()
+	if len(l.entries) == 0 || len(l.sets[KindPermalink]) == 0 {
+		return false
+	}
+
+	permalink = strings.ToLower(strings.Trim(permalink, "/"))
+	for i := 0; i <= len(permalink); i++ {
+		if i == len(permalink) || permalink[i] == '/' {
+			if _, ok := l.sets[KindPermalink][permalink[:i]]; ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Checks image urls (or paths), like https://i1.sndcdn.com/artworks-000123456789-abcdef-t500x500.jpg
+func Image(url string) bool {
+	l := get()
+	if len(l.entries) == 0 || len(l.sets[KindImage]) == 0 {
+		return false
+	}
+
+	if i := strings.LastIndexByte(url, '/'); i != -1 {
+		url = url[i+1:]
+	}
+
+	for key := range l.sets[KindImage] {
+		if strings.HasPrefix(url, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Appends the entry to BlocklistFile and reloads
+func Add(kind string, value string) (Entry, error) {
+	if cfg.BlocklistFile == "" {
+		return Entry{}, ErrNoFile
+	}
+
+	kind = strings.ToLower(kind)
+	value, err := normalize(kind, value)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e := Entry{kind, value}
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	f, err := os.OpenFile(cfg.BlocklistFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return e, err
+	}
+
+	_, err = f.WriteString(e.String() + "\n")
+	f.Close()
+	if err != nil {
+		return e, err
+	}
+
+	return e, reload()
+}
+
+// Removes matching lines from BlocklistFile (keeping everything else, like comments) and reloads
+func Remove(kind string, value string) error {
+	if cfg.BlocklistFile == "" {
+		return ErrNoFile
+	}
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	data, err := os.ReadFile(cfg.BlocklistFile)
+	if err != nil {
+		return err
+	}
+
+	target := Entry{kind, value}
+	lines := strings.SplitAfter(string(data), "\n")
+	kept := lines[:0]
+	found := false
+	for _, line := range lines {
+		if e, ok, _ := parseLine(line); ok && e == target {
+			found = true
+			continue
+		}
+
+		kept = append(kept, line)
+	}
+
+	if !found {
+		return ErrNotFound
+	}
+
+	// write to a temp file first, so a crash doesn't leave a half-written list
+	tmp := cfg.BlocklistFile + ".tmp"
+	err = os.WriteFile(tmp, []byte(strings.Join(kept, "")), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, cfg.BlocklistFile)
+	if err != nil {
+		return err
+	}
+
+	return reload()
+}
@@ -1,6 +1,8 @@
 package cfg
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
@@ -63,6 +65,12 @@ var PlaylistTTL = 20 * time.Minute
 // delay between cleanup of playlist cache
 var PlaylistCacheCleanDelay = PlaylistTTL / 4
 
+// time-to-live for generated feeds (rss/atom/json feed)
+var FeedTTL = 20 * time.Minute
+
+// delay between cleanup of feed cache
+var FeedCacheCleanDelay = FeedTTL / 4
+
 // recommended to keep it Firefox 148 to align with TLS fingerprint i guess
 var UserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:148.0) Gecko/20100101 Firefox/148.0"
 
@@ -72,6 +80,113 @@ var ClientID = ""
 // enab;e api
 var EnableAPI = false
 
+// secret for signing cookies (local follow list), random on every start if empty (shared between Prefork processes)
+// set it if you don't want those to break after restarts
+var CookieSecret = ""
+
+// set if CookieSecret wasn't configured, and a random one is used
+var RandomCookieSecret = false
+
+// enable Subsonic API (/rest/...), so you can use Subsonic clients with soundcloak
+// there are no accounts, so the credentials below are shared by everyone who uses it
+var EnableSubsonic = false
+var SubsonicUser = "soundcloak"
+
+// must be set if EnableSubsonic is enabled. Subsonic token auth needs the plain password on the server, so don't reuse it anywhere
+var SubsonicPassword = ""
+
+// enable /_/metrics endpoint (prometheus format)
+var EnableMetrics = false
+
+// if set, /_/metrics requires "Authorization: Bearer <token>"
+var MetricsToken = ""
+
+// debug, info, warn or error
+var LogLevel = "info"
+
+// text (logfmt) or json
+var LogFormat = "text"
+
+// log levels for specific modules, like "sc=debug,restream=warn"
+var LogModules = ""
+
+// log client ips, cookies and query strings (search queries, urls and such). Only for debugging, don't keep this on for a public instance
+var LogPrivateData = false
+
+// enables /_/admin panel if set. Use something long and random
+var AdminToken = ""
+
+// if set, admin actions are also appended to this file (one json object per line)
+var AdminAuditLog = ""
+
+// directory for admin sessions and maintenance mode, so they are shared between processes and survive restarts. Needed for the admin panel with Prefork
+var AdminStateDir = ""
+
+// takedown blocklist file, see the instance guide. Reloaded on SIGHUP, when it changes (checked every 5 seconds) or from the admin panel
+var BlocklistFile = ""
+
+// shown on the 451 page for blocked stuff
+var BlockedMessage = "This content is not available on this instance."
+
+// per-client (ip) rate limiting. Budgets are per minute, 0 turns that budget off
+// if you use Prefork, every process has its own counters
+var RateLimit = false
+
+// page requests
+var RateLimitPages = 120
+
+// api requests (/_/api, /rest)
+var RateLimitAPI = 300
+
+// proxied images
+var RateLimitImages = 600
+
+// audio, in MiB (proxied hls segments, restream, subsonic streams)
+var RateLimitAudio = 100
+
+// ipv6 clients are grouped by this prefix length (usually everyone gets at least a /64), 0 or 128 to use the full address
+var RateLimitIPv6Prefix = 64
+
+// ips or ip ranges that are never rate limited
+var RateLimitAllowlist = []string{}
+
+// sign proxy and stream urls (with a key derived from CookieSecret), so they expire and can't be used to proxy random stuff
+// without CookieSecret, the random key changes on restart and links handed out before that stop working
+var SignProxyURLs = true
+
+// how long signed urls work
+var SignedURLTTL = 24 * time.Hour
+
+// same, but for audio in feeds, since podcast apps might download it way later
+var SignedFeedURLTTL = 30 * 24 * time.Hour
+
+// directory for caching proxied images (and resized versions of them) on disk, empty to turn off
+var ImageCacheDir = ""
+
+// max size of the image cache, in MiB. Least recently used images are removed first
+var ImageCacheSize = 512
+
+// Cache-Control header value for proxied images. The images on soundcloud's cdn never change, so this can be long
+var ImageCacheControl = "public, max-age=2592000, immutable"
+
+// jpeg/webp quality for resized/converted images
+var ImageQuality = 80
+
+// shared cache for hls segments (used by the hls proxy and restream), in MiB. 0 turns it off
+var SegmentCacheSize = 0
+
+// keep the segment cache on disk in this directory instead of in memory
+var SegmentCacheDir = ""
+
+// how many segments restream downloads ahead, while the current one is being sent. 0 to only download them when needed
+var RestreamPrefetch = 3
+
+// stop sending requests to an upstream (api, hls cdn...) for CircuitBreakerCooldown after this many failures in a row (after retries). 0 turns it off
+var CircuitBreakerThreshold = 5
+
+// how long an upstream is left alone, then one request is let through to see if it works again
+var CircuitBreakerCooldown = 30 * time.Second
+
 // yeah i doubt they will be reading this lolol
 var SoundcloudApiProxy = ""
 
@@ -408,6 +523,26 @@ func fromEnv() error {
 		PlaylistCacheCleanDelay = time.Duration(num) * time.Second
 	}
 
+	env = os.Getenv("FEED_TTL")
+	if env != "" {
+		num, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		FeedTTL = time.Duration(num) * time.Second
+	}
+
+	env = os.Getenv("FEED_CACHE_CLEAN_DELAY")
+	if env != "" {
+		num, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		FeedCacheCleanDelay = time.Duration(num) * time.Second
+	}
+
 	env = os.Getenv("USER_AGENT")
 	if env != "" {
 		UserAgent = env
@@ -423,6 +558,247 @@ func fromEnv() error {
 		EnableAPI = boolean(env)
 	}
 
+	env = os.Getenv("COOKIE_SECRET")
+	if env != "" {
+		CookieSecret = env
+	}
+
+	env = os.Getenv("ENABLE_SUBSONIC")
+	if env != "" {
+		EnableSubsonic = boolean(env)
+	}
+
+	env = os.Getenv("SUBSONIC_USER")
+	if env != "" {
+		SubsonicUser = env
+	}
+
+	env = os.Getenv("SUBSONIC_PASSWORD")
+	if env != "" {
+		SubsonicPassword = env
+	}
+
+	env = os.Getenv("ENABLE_METRICS")
+	if env != "" {
+		EnableMetrics = boolean(env)
+	}
+
+	env = os.Getenv("METRICS_TOKEN")
+	if env != "" {
+		MetricsToken = env
+	}
+
+	env = os.Getenv("LOG_LEVEL")
+	if env != "" {
+		LogLevel = env
+	}
+
+	env = os.Getenv("LOG_FORMAT")
+	if env != "" {
+		LogFormat = env
+	}
+
+	env = os.Getenv("LOG_MODULES")
+	if env != "" {
+		LogModules = env
+	}
+
+	env = os.Getenv("LOG_PRIVATE_DATA")
+	if env != "" {
+		LogPrivateData = boolean(env)
+	}
+
+	env = os.Getenv("ADMIN_TOKEN")
+	if env != "" {
+		AdminToken = env
+	}
+
+	env = os.Getenv("ADMIN_AUDIT_LOG")
+	if env != "" {
+		AdminAuditLog = env
+	}
+
+	env = os.Getenv("ADMIN_STATE_DIR")
+	if env != "" {
+		AdminStateDir = env
+	}
+
+	env = os.Getenv("BLOCKLIST_FILE")
+	if env != "" {
+		BlocklistFile = env
+	}
+
+	env = os.Getenv("BLOCKED_MESSAGE")
+	if env != "" {
+		BlockedMessage = env
+	}
+
+	env = os.Getenv("RATE_LIMIT")
+	if env != "" {
+		RateLimit = boolean(env)
+	}
+
+	env = os.Getenv("RATE_LIMIT_PAGES")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		RateLimitPages = num
+	}
+
+	env = os.Getenv("RATE_LIMIT_API")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		RateLimitAPI = num
+	}
+
+	env = os.Getenv("RATE_LIMIT_IMAGES")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		RateLimitImages = num
+	}
+
+	env = os.Getenv("RATE_LIMIT_AUDIO")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		RateLimitAudio = num
+	}
+
+	env = os.Getenv("RATE_LIMIT_IPV6_PREFIX")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		RateLimitIPv6Prefix = num
+	}
+
+	env = os.Getenv("RATE_LIMIT_ALLOWLIST")
+	if env != "" {
+		var p []string
+		err := json.Unmarshal(S2b(env), &p)
+		if err != nil {
+			return err
+		}
+
+		RateLimitAllowlist = p
+	}
+
+	env = os.Getenv("SIGN_PROXY_URLS")
+	if env != "" {
+		SignProxyURLs = boolean(env)
+	}
+
+	env = os.Getenv("SIGNED_URL_TTL")
+	if env != "" {
+		num, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		SignedURLTTL = time.Duration(num) * time.Second
+	}
+
+	env = os.Getenv("SIGNED_FEED_URL_TTL")
+	if env != "" {
+		num, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		SignedFeedURLTTL = time.Duration(num) * time.Second
+	}
+
+	env = os.Getenv("IMAGE_CACHE_DIR")
+	if env != "" {
+		ImageCacheDir = env
+	}
+
+	env = os.Getenv("IMAGE_CACHE_SIZE")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		ImageCacheSize = num
+	}
+
+	env = os.Getenv("IMAGE_CACHE_CONTROL")
+	if env != "" {
+		ImageCacheControl = env
+	}
+
+	env = os.Getenv("IMAGE_QUALITY")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		ImageQuality = num
+	}
+
+	env = os.Getenv("SEGMENT_CACHE_SIZE")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		SegmentCacheSize = num
+	}
+
+	env = os.Getenv("SEGMENT_CACHE_DIR")
+	if env != "" {
+		SegmentCacheDir = env
+	}
+
+	env = os.Getenv("RESTREAM_PREFETCH")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		RestreamPrefetch = num
+	}
+
+	env = os.Getenv("CIRCUIT_BREAKER_THRESHOLD")
+	if env != "" {
+		num, err := strconv.Atoi(env)
+		if err != nil {
+			return err
+		}
+
+		CircuitBreakerThreshold = num
+	}
+
+	env = os.Getenv("CIRCUIT_BREAKER_COOLDOWN")
+	if env != "" {
+		num, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		CircuitBreakerCooldown = time.Duration(num) * time.Second
+	}
+
 	env = os.Getenv("SOUNDCLOUD_API_PROXY")
 	if env != "" {
 		SoundcloudApiProxy = env
@@ -493,6 +869,31 @@ func fromEnv() error {
 }
 
 func init() {
+	load()
+	randomSecret()
+}
+
+// the Prefork parent makes it, the children inherit it with the environment
+const secretEnv = "SOUNDCLOAK_RANDOM_SECRET"
+
+func randomSecret() {
+	if CookieSecret != "" {
+		return
+	}
+
+	RandomCookieSecret = true
+	CookieSecret = os.Getenv(secretEnv)
+	if CookieSecret != "" {
+		return
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+	CookieSecret = hex.EncodeToString(b)
+	os.Setenv(secretEnv, CookieSecret)
+}
+
+func load() {
 	filename := "soundcloak.json"
 	if env := os.Getenv("SOUNDCLOAK_CONFIG"); env == "FROM_ENV" {
 		err := fromEnv()
@@ -528,10 +929,46 @@ func init() {
 		TrackCacheCleanDelay    *time.Duration
 		PlaylistTTL             *time.Duration
 		PlaylistCacheCleanDelay *time.Duration
+		FeedTTL                 *time.Duration
+		FeedCacheCleanDelay     *time.Duration
 		UserAgent               *string
 		ClientID                *string
 		DNSCacheTTL             *time.Duration
 		EnableAPI               *bool
+		CookieSecret            *string
+		EnableSubsonic          *bool
+		SubsonicUser            *string
+		SubsonicPassword        *string
+		EnableMetrics           *bool
+		MetricsToken            *string
+		LogLevel                *string
+		LogFormat               *string
+		LogModules              *string
+		LogPrivateData          *bool
+		AdminToken              *string
+		AdminAuditLog           *string
+		AdminStateDir           *string
+		BlocklistFile           *string
+		BlockedMessage          *string
+		RateLimit               *bool
+		RateLimitPages          *int
+		RateLimitAPI            *int
+		RateLimitImages         *int
+		RateLimitAudio          *int
+		RateLimitIPv6Prefix     *int
+		RateLimitAllowlist      *[]string
+		SignProxyURLs           *bool
+		SignedURLTTL            *time.Duration
+		SignedFeedURLTTL        *time.Duration
+		ImageCacheDir           *string
+		ImageCacheSize          *int
+		ImageCacheControl       *string
+		ImageQuality            *int
+		SegmentCacheSize        *int
+		SegmentCacheDir         *string
+		RestreamPrefetch        *int
+		CircuitBreakerThreshold *int
+		CircuitBreakerCooldown  *time.Duration
 		SoundcloudApiProxy      *string
 		DialDualStack           *bool
 		SpoofTLS                *bool
@@ -593,6 +1030,12 @@ func init() {
 	if config.PlaylistCacheCleanDelay != nil {
 		PlaylistCacheCleanDelay = *config.PlaylistCacheCleanDelay * time.Second
 	}
+	if config.FeedTTL != nil {
+		FeedTTL = *config.FeedTTL * time.Second
+	}
+	if config.FeedCacheCleanDelay != nil {
+		FeedCacheCleanDelay = *config.FeedCacheCleanDelay * time.Second
+	}
 	if config.UserAgent != nil {
 		UserAgent = *config.UserAgent
 	}
@@ -602,6 +1045,108 @@ func init() {
 	if config.EnableAPI != nil {
 		EnableAPI = *config.EnableAPI
 	}
+	if config.CookieSecret != nil {
+		CookieSecret = *config.CookieSecret
+	}
+	if config.EnableSubsonic != nil {
+		EnableSubsonic = *config.EnableSubsonic
+	}
+	if config.SubsonicUser != nil {
+		SubsonicUser = *config.SubsonicUser
+	}
+	if config.SubsonicPassword != nil {
+		SubsonicPassword = *config.SubsonicPassword
+	}
+	if config.EnableMetrics != nil {
+		EnableMetrics = *config.EnableMetrics
+	}
+	if config.MetricsToken != nil {
+		MetricsToken = *config.MetricsToken
+	}
+	if config.LogLevel != nil {
+		LogLevel = *config.LogLevel
+	}
+	if config.LogFormat != nil {
+		LogFormat = *config.LogFormat
+	}
+	if config.LogModules != nil {
+		LogModules = *config.LogModules
+	}
+	if config.LogPrivateData != nil {
+		LogPrivateData = *config.LogPrivateData
+	}
+	if config.AdminToken != nil {
+		AdminToken = *config.AdminToken
+	}
+	if config.AdminAuditLog != nil {
+		AdminAuditLog = *config.AdminAuditLog
+	}
+	if config.AdminStateDir != nil {
+		AdminStateDir = *config.AdminStateDir
+	}
+	if config.BlocklistFile != nil {
+		BlocklistFile = *config.BlocklistFile
+	}
+	if config.BlockedMessage != nil {
+		BlockedMessage = *config.BlockedMessage
+	}
+	if config.RateLimit != nil {
+		RateLimit = *config.RateLimit
+	}
+	if config.RateLimitPages != nil {
+		RateLimitPages = *config.RateLimitPages
+	}
+	if config.RateLimitAPI != nil {
+		RateLimitAPI = *config.RateLimitAPI
+	}
+	if config.RateLimitImages != nil {
+		RateLimitImages = *config.RateLimitImages
+	}
+	if config.RateLimitAudio != nil {
+		RateLimitAudio = *config.RateLimitAudio
+	}
+	if config.RateLimitIPv6Prefix != nil {
+		RateLimitIPv6Prefix = *config.RateLimitIPv6Prefix
+	}
+	if config.RateLimitAllowlist != nil {
+		RateLimitAllowlist = *config.RateLimitAllowlist
+	}
+	if config.SignProxyURLs != nil {
+		SignProxyURLs = *config.SignProxyURLs
+	}
+	if config.SignedURLTTL != nil {
+		SignedURLTTL = *config.SignedURLTTL * time.Second
+	}
+	if config.SignedFeedURLTTL != nil {
+		SignedFeedURLTTL = *config.SignedFeedURLTTL * time.Second
+	}
+	if config.ImageCacheDir != nil {
+		ImageCacheDir = *config.ImageCacheDir
+	}
+	if config.ImageCacheSize != nil {
+		ImageCacheSize = *config.ImageCacheSize
+	}
+	if config.ImageCacheControl != nil {
+		ImageCacheControl = *config.ImageCacheControl
+	}
+	if config.ImageQuality != nil {
+		ImageQuality = *config.ImageQuality
+	}
+	if config.SegmentCacheSize != nil {
+		SegmentCacheSize = *config.SegmentCacheSize
+	}
+	if config.SegmentCacheDir != nil {
+		SegmentCacheDir = *config.SegmentCacheDir
+	}
+	if config.RestreamPrefetch != nil {
+		RestreamPrefetch = *config.RestreamPrefetch
+	}
+	if config.CircuitBreakerThreshold != nil {
+		CircuitBreakerThreshold = *config.CircuitBreakerThreshold
+	}
+	if config.CircuitBreakerCooldown != nil {
+		CircuitBreakerCooldown = *config.CircuitBreakerCooldown * time.Second
+	}
 	if config.SoundcloudApiProxy != nil {
 		SoundcloudApiProxy = *config.SoundcloudApiProxy
 	}
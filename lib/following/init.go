@@ -0,0 +1,268 @@
+package following
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"git.maid.zone/stuff/soundcloak/lib/misc"
+	"git.maid.zone/stuff/soundcloak/lib/preferences"
+	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/templates"
+)
+
+// Account-less following. The list of user permalinks is kept in a signed cookie
+
+var logger = logging.Module("following")
+
+// cookies have a size limit, this should fit comfortably
+const MaxFollowing = 100
+
+const perPage = 20
+
+// browsers drop bigger cookies (4096 bytes for the name and value together), and the whole list would be gone
+const maxCookieSize = 4000
+
+var ErrBadSignature = errors.New("bad signature")
+var errTooBig = fiber.NewError(fiber.StatusBadRequest, "following list doesn't fit in a cookie anymore, unfollow some users")
+
+var secret = []byte(cfg.CookieSecret)
+
+func sign(data []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// <base64 json>.<base64 hmac>. Also used in feed links, since feed readers don't have our cookies
+func Encode(list []string) (string, error) {
+	data, err := json.Marshal(list)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data) + "." + base64.RawURLEncoding.EncodeToString(sign(data)), nil
+}
+
+func Decode(token string) ([]string, error) {
+	rawdata, rawsig, ok := bytes.Cut([]byte(token), []byte{'.'})
+	if !ok {
+		return nil, ErrBadSignature
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(string(rawdata))
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(string(rawsig))
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(sig, sign(data)) {
+		return nil, ErrBadSignature
+	}
+
+	var list []string
+	err = json.Unmarshal(data, &list)
+	return list, err
+}
+
+// Broken or missing cookie is just an empty list
+func Get(c fiber.Ctx) []string {
+	raw := c.Cookies("following")
+	if raw == "" {
+		return nil
+	}
+
+	list, err := Decode(raw)
+	if err != nil {
+		return nil
+	}
+
+	return list
+}
+
+func set(c fiber.Ctx, list []string) error {
+	if misc.CrossSite(c) {
+		return misc.ErrCrossSite
+	}
+
+	token, err := Encode(list)
+	if err != nil {
+		return err
+	}
+
+	// permalinks can be long, MaxFollowing alone doesn't keep it small enough
+	if len(token) > maxCookieSize {
+		return errTooBig
+	}
+
+	cookie := fasthttp.AcquireCookie()
+	cookie.SetKey("following")
+	cookie.SetValue(token)
+	cookie.SetExpire(time.Now().Add(400 * 24 * time.Hour))
+	cookie.SetHTTPOnly(true)
+	cookie.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+	cookie.SetPath("/")
+	c.Response().Header.SetCookie(cookie)
+	fasthttp.ReleaseCookie(cookie)
+
+	return nil
+}
+
+func add(list []string, permalinks ...string) []string {
+	for _, p := range permalinks {
+		if len(list) >= MaxFollowing {
+			break
+		}
+
+		if p != "" && !slices.Contains(list, p) {
+			list = append(list, p)
+		}
+	}
+
+	return list
+}
+
+type opml struct {
+	XMLName  xml.Name  `xml:"opml"`
+	Version  string    `xml:"version,attr"`
+	Title    string    `xml:"head>title"`
+	Outlines []outline `xml:"body>outline"`
+}
+
+type outline struct {
+	Type    string `xml:"type,attr"`
+	Text    string `xml:"text,attr"`
+	XmlUrl  string `xml:"xmlUrl,attr"`
+	HtmlUrl string `xml:"htmlUrl,attr"`
+}
+
+func Load(r *fiber.App) {
+	r.Get("/feed", func(c fiber.Ctx) error {
+		prefs, err := preferences.Get(c)
+		if err != nil {
+			return err
+		}
+
+		list := Get(c)
+		page, _ := strconv.Atoi(c.Query("page"))
+
+		activity := sc.GetFollowingActivity(list)
+		// past the last page is just empty, and (page+1)*perPage can't overflow
+		page = max(min(page, len(activity)/perPage+1), 0)
+		more := len(activity) > (page+1)*perPage
+		activity = activity[min(len(activity), page*perPage):min(len(activity), (page+1)*perPage)]
+		for i := range activity {
+			activity[i].Postfix(prefs)
+		}
+
+		return misc.Render(c, templates.Base("feed", templates.Feed(activity, len(list), page, more), nil))
+	})
+
+	r.Get("/_/following", func(c fiber.Ctx) error {
+		list := Get(c)
+		token, err := Encode(list)
+		if err != nil {
+			return err
+		}
+
+		return misc.Render(c, templates.Base("following", templates.Following(list, token, MaxFollowing), nil))
+	})
+
+	r.Post("/_/following/add", func(c fiber.Ctx) error {
+		user := c.FormValue("user")
+		if len(Get(c)) >= MaxFollowing {
+			return fiber.NewError(fiber.StatusBadRequest, "following too many users (max "+strconv.Itoa(MaxFollowing)+")")
+		}
+
+		// make sure it exists
+		u, err := sc.GetUser(user)
+		if err != nil {
+			return err
+		}
+
+		err = set(c, add(Get(c), u.Permalink))
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/" + u.Permalink)
+	})
+
+	r.Post("/_/following/remove", func(c fiber.Ctx) error {
+		user := c.FormValue("user")
+		list := slices.DeleteFunc(Get(c), func(p string) bool {
+			return p == user
+		})
+
+		err := set(c, list)
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/_/following")
+	})
+
+	// copy whoever some public user follows
+	r.Post("/_/following/import", func(c fiber.Ctx) error {
+		prefs, err := preferences.Get(c)
+		if err != nil {
+			return err
+		}
+
+		u, err := sc.GetUser(c.FormValue("user"))
+		if err != nil {
+			return err
+		}
+
+		p, err := u.GetFollowing(prefs, "limit="+strconv.Itoa(MaxFollowing))
+		if err != nil {
+			logger.Request(c).Warn("error getting user following (import)", logging.Private("user", u.Permalink), logging.Err(err))
+			return err
+		}
+
+		list := Get(c)
+		for _, f := range p.Collection {
+			list = add(list, f.Permalink)
+		}
+
+		err = set(c, list)
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/_/following")
+	})
+
+	r.Get("/_/following/opml", func(c fiber.Ctx) error {
+		base := c.BaseURL()
+		o := opml{Version: "2.0", Title: "soundcloak following"}
+		for _, p := range Get(c) {
+			o.Outlines = append(o.Outlines, outline{Type: "rss", Text: p, XmlUrl: base + "/_/rss/" + p, HtmlUrl: base + "/" + p})
+		}
+
+		data, err := xml.Marshal(o)
+		if err != nil {
+			return err
+		}
+
+		c.Response().Header.SetContentType("text/x-opml")
+		c.Response().Header.Set("Content-Disposition", `attachment; filename="following.opml"`)
+		return c.Send(append([]byte(xml.Header), data...))
+	})
+}
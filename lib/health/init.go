@@ -0,0 +1,164 @@
+package health
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/misc"
+	"git.maid.zone/stuff/soundcloak/lib/sc"
+)
+
+// Endpoints for container orchestrators and uptime monitors. /_/health only says the process is alive, /_/ready actually checks if we can talk to soundcloud
+
+// probes can come every few seconds, don't bother soundcloud that often
+const cacheFor = 10 * time.Second
+const timeout = 5 * time.Second
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+type Check struct {
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status  string           `json:"status"`
+	Checked time.Time        `json:"checked"`
+	Checks  map[string]Check `json:"checks"`
+}
+
+var errTimeout = errors.New("timed out")
+var errNoClientID = errors.New("no ClientID")
+var errNotValidated = errors.New("ClientID wasn't accepted by soundcloud recently")
+
+var lock sync.Mutex
+var last *Report
+
+func run(f func() error) Check {
+	start := time.Now()
+	err := f()
+	c := Check{Status: statusOK, Latency: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		c.Status = statusFail
+		c.Error = err.Error()
+	}
+
+	return c
+}
+
+// api requests are retried a bunch of times, so the check could hang for a while. It keeps going in the background, the probe doesn't wait for it
+func ping() error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- sc.Ping()
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(timeout):
+		return errTimeout
+	}
+}
+
+// any response at all is fine here, we only care that the cdn is reachable
+func connect(hc *fasthttp.HostClient) func() error {
+	return func() error {
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+		resp := fasthttp.AcquireResponse()
+		defer fasthttp.ReleaseResponse(resp)
+
+		req.Header.SetMethod(fasthttp.MethodHead)
+		req.SetRequestURI("https://" + hc.Addr + "/")
+		req.Header.SetUserAgent(cfg.UserAgent)
+
+		return hc.DoTimeout(req, resp, timeout)
+	}
+}
+
+func check() *Report {
+	checks := map[string]Check{}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	add := func(name string, f func() error) {
+		wg.Go(func() {
+			c := run(f)
+			mu.Lock()
+			checks[name] = c
+			mu.Unlock()
+		})
+	}
+
+	add("api", ping)
+	// these are only set up if restream or stream proxying is enabled
+	if misc.HlsClient != nil {
+		add("hls", connect(misc.HlsClient))
+	}
+	if misc.HlsAacClient != nil {
+		add("hls_aac", connect(misc.HlsAacClient))
+	}
+	wg.Wait()
+
+	// after the api check, since that one also validates the ClientID
+	checks["clientid"] = run(func() error {
+		if sc.ClientID == "" {
+			return errNoClientID
+		}
+
+		if time.Since(sc.ClientIDValidated()) > cfg.ClientIDTTL {
+			return errNotValidated
+		}
+
+		return nil
+	})
+
+	r := Report{Status: statusOK, Checked: time.Now(), Checks: checks}
+	for _, c := range checks {
+		if c.Status != statusOK {
+			r.Status = statusFail
+			break
+		}
+	}
+
+	return &r
+}
+
+// concurrent probes wait for the one that's already checking instead of doing their own
+func Get() *Report {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if last == nil || time.Since(last.Checked) > cacheFor {
+		last = check()
+	}
+
+	return last
+}
+
+func Load(r *fiber.App) {
+	r.Get("/_/health", func(c fiber.Ctx) error {
+		c.Set("Cache-Control", "no-store")
+		return c.JSON(fiber.Map{"status": statusOK})
+	})
+
+	r.Get("/_/ready", func(c fiber.Ctx) error {
+		rep := Get()
+
+		c.Set("Cache-Control", "no-store")
+		if rep.Status != statusOK {
+			c.Status(fiber.StatusServiceUnavailable)
+		}
+
+		return c.JSON(rep)
+	})
+}
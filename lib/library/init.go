@@ -0,0 +1,354 @@
+package library
+
+import (
+	"encoding/base64"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+
+	"git.maid.zone/stuff/soundcloak/lib/misc"
+	"git.maid.zone/stuff/soundcloak/lib/preferences"
+	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/templates"
+)
+
+// Local library: favourite tracks and playlists made by the user. Everything is in a cookie, just like preferences
+
+// cookies can only be ~4kb, ids are ~10 chars each. Long names can fill it up before that, set checks the actual size
+const MaxTracks = 200
+const MaxPlaylists = 10
+const maxName = 64
+
+// browsers drop bigger cookies (4096 bytes for the name and value together), and the whole library would be gone
+const maxCookieSize = 4000
+
+var errTooBig = fiber.NewError(fiber.StatusBadRequest, "library doesn't fit in a cookie anymore, remove some tracks or playlists")
+
+const Favourites = "favourites"
+
+type LocalPlaylist struct {
+	Name   string   `json:"name"`
+	Tracks []string `json:"tracks"`
+}
+
+type Library struct {
+	Favourites []string        `json:"favourites"`
+	Playlists  []LocalPlaylist `json:"playlists"`
+}
+
+func (l Library) total() int {
+	n := len(l.Favourites)
+	for _, p := range l.Playlists {
+		n += len(p.Tracks)
+	}
+
+	return n
+}
+
+// list id is either "favourites" or index of the playlist
+func (l *Library) list(id string) (*[]string, string, bool) {
+	if id == Favourites {
+		return &l.Favourites, "Favourites", true
+	}
+
+	i, err := strconv.Atoi(id)
+	if err != nil || i < 0 || i >= len(l.Playlists) {
+		return nil, "", false
+	}
+
+	return &l.Playlists[i].Tracks, l.Playlists[i].Name, true
+}
+
+// Makes a playlist that the rest of the code understands. Tracks only have IDs, so they get loaded like missing tracks in normal playlists
+func (l Library) Playlist(id string) (sc.Playlist, bool) {
+	tracks, name, ok := l.list(id)
+	if !ok {
+		return sc.Playlist{}, false
+	}
+
+	p := sc.Playlist{Kind: "local-playlist", Permalink: id, Title: name, TrackCount: int64(len(*tracks)), Tracks: make([]sc.Track, len(*tracks)), MissingTracks: strings.Join(*tracks, ",")}
+	for i, t := range *tracks {
+		p.Tracks[i].ID = json.Number(t)
+	}
+
+	return p, true
+}
+
+// Favourites first, then the playlists
+func (l Library) All() []sc.Playlist {
+	all := make([]sc.Playlist, 0, len(l.Playlists)+1)
+	p, _ := l.Playlist(Favourites)
+	all = append(all, p)
+	for i := range l.Playlists {
+		p, _ := l.Playlist(strconv.Itoa(i))
+		all = append(all, p)
+	}
+
+	return all
+}
+
+// Broken or missing cookie is just an empty library
+func Get(c fiber.Ctx) Library {
+	var l Library
+	raw := c.Cookies("library")
+	if raw == "" {
+		return l
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return l
+	}
+
+	json.Unmarshal(data, &l)
+	return l
+}
+
+func set(c fiber.Ctx, l Library) error {
+	if misc.CrossSite(c) {
+		return misc.ErrCrossSite
+	}
+
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	// base64, since playlist names can have anything in them
+	value := base64.RawURLEncoding.EncodeToString(data)
+	if len(value) > maxCookieSize {
+		return errTooBig
+	}
+
+	cookie := fasthttp.AcquireCookie()
+	cookie.SetKey("library")
+	cookie.SetValue(value)
+	cookie.SetExpire(time.Now().Add(400 * 24 * time.Hour))
+	cookie.SetHTTPOnly(true)
+	cookie.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+	cookie.SetPath("/")
+	c.Response().Header.SetCookie(cookie)
+	fasthttp.ReleaseCookie(cookie)
+
+	return nil
+}
+
+func isID(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// drop garbage from imported libraries
+func (l *Library) clean() {
+	invalid := func(id string) bool {
+		return !isID(id)
+	}
+
+	l.Favourites = slices.DeleteFunc(l.Favourites, invalid)
+	if len(l.Playlists) > MaxPlaylists {
+		l.Playlists = l.Playlists[:MaxPlaylists]
+	}
+
+	for i, p := range l.Playlists {
+		if len(p.Name) > maxName {
+			p.Name = p.Name[:maxName]
+		}
+		p.Tracks = slices.DeleteFunc(p.Tracks, invalid)
+		l.Playlists[i] = p
+	}
+}
+
+func Load(r *fiber.App) {
+	r.Get("/_/library", func(c fiber.Ctx) error {
+		l := Get(c)
+
+		return misc.Render(c, templates.Base("library", templates.Library(l.All(), l.total(), MaxTracks, MaxPlaylists), nil))
+	})
+
+	r.Get("/_/library/export", func(c fiber.Ctx) error {
+		data, err := json.Marshal(Get(c))
+		if err != nil {
+			return err
+		}
+
+		c.Response().Header.SetContentType("application/json")
+		return c.Send(data)
+	})
+
+	r.Post("/_/library/import", func(c fiber.Ctx) error {
+		f, err := c.FormFile("library")
+		if err != nil {
+			return err
+		}
+
+		fd, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+
+		var l Library
+		err = json.NewDecoder(fd).Decode(&l)
+		if err != nil {
+			return err
+		}
+
+		l.clean()
+		if l.total() > MaxTracks {
+			return fiber.NewError(fiber.StatusBadRequest, "too many tracks (max "+strconv.Itoa(MaxTracks)+")")
+		}
+
+		err = set(c, l)
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/_/library")
+	})
+
+	r.Post("/_/library/reset", func(c fiber.Ctx) error {
+		err := set(c, Library{})
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/_/library")
+	})
+
+	r.Post("/_/library/new", func(c fiber.Ctx) error {
+		name := strings.TrimSpace(c.FormValue("name"))
+		if name == "" || len(name) > maxName {
+			return fiber.NewError(fiber.StatusBadRequest, "name must be 1-"+strconv.Itoa(maxName)+" characters")
+		}
+
+		l := Get(c)
+		if len(l.Playlists) >= MaxPlaylists {
+			return fiber.NewError(fiber.StatusBadRequest, "too many playlists (max "+strconv.Itoa(MaxPlaylists)+")")
+		}
+
+		l.Playlists = append(l.Playlists, LocalPlaylist{Name: name})
+		err := set(c, l)
+		if err != nil {
+			return err
+		}
+
+		// came from a track page
+		if t := c.FormValue("track"); t != "" && isID(t) {
+			return c.Redirect().To("/_/library/track/" + t)
+		}
+
+		return c.Redirect().To("/_/library")
+	})
+
+	r.Post("/_/library/delete", func(c fiber.Ctx) error {
+		l := Get(c)
+		i, err := strconv.Atoi(c.FormValue("list"))
+		if err != nil || i < 0 || i >= len(l.Playlists) {
+			return fiber.ErrBadRequest
+		}
+
+		l.Playlists = slices.Delete(l.Playlists, i, i+1)
+		err = set(c, l)
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/_/library")
+	})
+
+	// adds the track to the list, or removes it if it's already there
+	r.Post("/_/library/toggle", func(c fiber.Ctx) error {
+		id := c.FormValue("track")
+		if !isID(id) {
+			return fiber.ErrBadRequest
+		}
+
+		l := Get(c)
+		tracks, _, ok := l.list(c.FormValue("list"))
+		if !ok {
+			return fiber.ErrNotFound
+		}
+
+		if i := slices.Index(*tracks, id); i != -1 {
+			*tracks = slices.Delete(*tracks, i, i+1)
+		} else {
+			if l.total() >= MaxTracks {
+				return fiber.NewError(fiber.StatusBadRequest, "library is full (max "+strconv.Itoa(MaxTracks)+" tracks)")
+			}
+
+			*tracks = append(*tracks, id)
+		}
+
+		err := set(c, l)
+		if err != nil {
+			return err
+		}
+
+		return c.Redirect().To("/_/library/track/" + id)
+	})
+
+	r.Get("/_/library/track/:id", func(c fiber.Ctx) error {
+		prefs, err := preferences.Get(c)
+		if err != nil {
+			return err
+		}
+
+		t, err := sc.GetTrackByID(c.Params("id"))
+		if err != nil {
+			return err
+		}
+		t.Postfix(prefs, false)
+
+		lists := Get(c).All()
+		in := make([]bool, len(lists))
+		for i, p := range lists {
+			in[i] = slices.Contains(strings.Split(p.MissingTracks, ","), string(t.ID))
+		}
+
+		return misc.Render(c, templates.Base("library", templates.LibraryTrack(t, lists, in, len(lists)-1 < MaxPlaylists), nil))
+	})
+
+	r.Get("/_/library/:list", func(c fiber.Ctx) error {
+		prefs, err := preferences.Get(c)
+		if err != nil {
+			return err
+		}
+
+		p, ok := Get(c).Playlist(c.Params("list"))
+		if !ok {
+			return fiber.ErrNotFound
+		}
+
+		if q := c.Query("pagination"); q != "" {
+			p.MissingTracks = q
+		}
+
+		if p.MissingTracks != "" {
+			tracks, next, err := sc.GetNextMissingTracks(p.MissingTracks)
+			if err != nil {
+				return err
+			}
+
+			// keep the order of the list
+			ids := strings.Split(p.MissingTracks, ",")
+			p.Tracks = p.Tracks[:0]
+			for _, id := range ids[:len(ids)-len(next)] {
+				for _, t := range tracks {
+					if string(t.ID) == id {
+						t.Postfix(prefs, false)
+						p.Tracks = append(p.Tracks, t)
+						break
+					}
+				}
+			}
+			p.MissingTracks = strings.Join(next, ",")
+		}
+
+		return misc.Render(c, templates.Base(p.Title, templates.Playlist(prefs, p), nil))
+	})
+}
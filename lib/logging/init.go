@@ -0,0 +1,243 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/requestid"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+)
+
+// Structured logging on top of log/slog. Every part of soundcloak logs through its own module logger, so levels can be set per module (and changed while running)
+//
+// Privacy: client ips, cookies and query strings (search queries, urls people open...) must only be logged through Private.
+// Those get replaced with "[redacted]" unless LogPrivateData is enabled. Request loggers only add the route pattern (like /:user/:track), never the path itself
+
+const redacted = "[redacted]"
+
+var handler slog.Handler
+
+var levelsLock sync.RWMutex
+var defaultLevel = slog.LevelInfo
+var levels = map[string]slog.Level{}
+
+func parseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(s))
+	return l, err
+}
+
+func init() {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug} // filtering is done by moduleHandler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+
+	if cfg.Debug {
+		defaultLevel = slog.LevelDebug
+	}
+
+	if cfg.LogLevel != "" {
+		l, err := parseLevel(cfg.LogLevel)
+		if err != nil {
+			log.Println("Warning: invalid LogLevel:", err)
+		} else {
+			defaultLevel = l
+		}
+	}
+
+	for m := range strings.SplitSeq(cfg.LogModules, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+
+		module, lvl, _ := strings.Cut(m, "=")
+		err := SetLevel(module, lvl)
+		if err != nil {
+			log.Printf("Warning: invalid LogModules entry %q: %s\n", m, err)
+		}
+	}
+
+	// anything still using the log package ends up here too
+	log.SetFlags(0)
+	log.SetOutput(writer{Module("main").Logger})
+}
+
+func level(module string) slog.Level {
+	levelsLock.RLock()
+	defer levelsLock.RUnlock()
+
+	if l, ok := levels[module]; ok {
+		return l
+	}
+
+	return defaultLevel
+}
+
+// Changes level of module at runtime. Empty module changes the default level. Empty level resets the module to the default
+func SetLevel(module string, lvl string) error {
+	var l slog.Level
+	if lvl != "" {
+		var err error
+		l, err = parseLevel(lvl)
+		if err != nil {
+			return err
+		}
+	}
+
+	levelsLock.Lock()
+	defer levelsLock.Unlock()
+
+	switch {
+	case module == "":
+		if lvl == "" {
+			return errors.New("empty level")
+		}
+		defaultLevel = l
+	case lvl == "":
+		delete(levels, module)
+	default:
+		levels[module] = l
+	}
+
+	return nil
+}
+
+// Default level and levels of modules that have their own
+func Levels() (string, map[string]string) {
+	levelsLock.RLock()
+	defer levelsLock.RUnlock()
+
+	m := make(map[string]string, len(levels))
+	for k, v := range levels {
+		m[k] = v.String()
+	}
+
+	return defaultLevel.String(), m
+}
+
+type moduleHandler struct {
+	slog.Handler
+	module string
+}
+
+func (h moduleHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= level(h.module)
+}
+
+func (h moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return moduleHandler{h.Handler.WithAttrs(attrs), h.module}
+}
+
+func (h moduleHandler) WithGroup(name string) slog.Handler {
+	return moduleHandler{h.Handler.WithGroup(name), h.module}
+}
+
+type Logger struct {
+	*slog.Logger
+}
+
+func Module(name string) Logger {
+	return Logger{slog.New(moduleHandler{handler.WithAttrs([]slog.Attr{slog.String("module", name)}), name})}
+}
+
+// Logger with request id, method and route pattern
+func (l Logger) Request(c fiber.Ctx) *slog.Logger {
+	return l.With("request_id", requestid.FromContext(c), "method", c.Method(), "route", c.Route().Path)
+}
+
+type private string
+
+func (p private) LogValue() slog.Value {
+	if cfg.LogPrivateData {
+		return slog.StringValue(string(p))
+	}
+
+	return slog.StringValue(redacted)
+}
+
+// For anything that could identify the user or what they're doing: ips, cookies, query strings
+func Private(key string, value string) slog.Attr {
+	return slog.Any(key, private(value))
+}
+
+// sc errors which carry the upstream that failed (errors from api, hls cdn...)
+type upstreamError interface {
+	Upstream() string
+}
+
+// Error attribute, with the upstream if it's known. Errors from sc are already scrubbed (no proxy address in there)
+func Err(err error) slog.Attr {
+	if err == nil {
+		return slog.Attr{}
+	}
+
+	var u upstreamError
+	if errors.As(err, &u) {
+		return slog.Group("error", "message", err.Error(), "upstream", u.Upstream())
+	}
+
+	return slog.String("error", err.Error())
+}
+
+// Logs every request at debug level
+func Load(r *fiber.App) {
+	r.Use(requestid.New())
+
+	l := Module("http")
+	r.Use(func(c fiber.Ctx) error {
+		err := c.Next()
+		if !l.Enabled(context.Background(), slog.LevelDebug) {
+			return err
+		}
+
+		status := c.Response().StatusCode()
+		var e *fiber.Error
+		if errors.As(err, &e) {
+			status = e.Code
+		} else if err != nil {
+			status = fiber.StatusInternalServerError
+		}
+
+		l.Request(c).Debug("request", "status", status,
+			Private("ip", c.IP()),
+			Private("path", string(c.Request().URI().RequestURI())),
+			Private("cookies", string(c.Request().Header.Peek("Cookie"))),
+			Err(err),
+		)
+
+		return err
+	})
+
+	// fasthttp puts client addresses in its messages, so they're private as a whole
+	r.Server().Logger = serverLogger{l}
+}
+
+type serverLogger struct {
+	l Logger
+}
+
+func (s serverLogger) Printf(format string, args ...any) {
+	s.l.Warn("fasthttp error", Private("message", fmt.Sprintf(format, args...)))
+}
+
+// for log.Println and such. That could be anything (libraries too), so the message is private as a whole, just like with fasthttp
+type writer struct {
+	l *slog.Logger
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	w.l.Info("log output", Private("message", strings.TrimSpace(string(p))))
+	return len(p), nil
+}
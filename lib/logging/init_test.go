@@ -0,0 +1,119 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+)
+
+// private stuff the tests put in, none of it can show up unless LogPrivateData is on
+var secrets = []string{"1.2.3.4", "someartist", "secretquery", "secretcookie"}
+
+// captures everything at debug level, with LogPrivateData set to private
+func capture(t *testing.T, private bool) *bytes.Buffer {
+	var buf bytes.Buffer
+
+	oldHandler, oldPrivate := handler, cfg.LogPrivateData
+	handler = slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	cfg.LogPrivateData = private
+	if err := SetLevel("", "debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		handler, cfg.LogPrivateData = oldHandler, oldPrivate
+		SetLevel("", "info")
+	})
+
+	return &buf
+}
+
+func check(t *testing.T, out string, private bool) {
+	t.Helper()
+
+	if out == "" {
+		t.Fatal("nothing was logged")
+	}
+
+	for _, s := range secrets {
+		if strings.Contains(out, s) != private {
+			if private {
+				t.Errorf("%q missing with LogPrivateData on:\n%s", s, out)
+			} else {
+				t.Errorf("%q leaked with LogPrivateData off:\n%s", s, out)
+			}
+		}
+	}
+
+	if !private && !strings.Contains(out, redacted) {
+		t.Errorf("no %q in output:\n%s", redacted, out)
+	}
+}
+
+func TestRequestMiddleware(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		buf := capture(t, private)
+
+		app := fiber.New(fiber.Config{
+			TrustProxy:       true,
+			ProxyHeader:      fiber.HeaderXForwardedFor,
+			TrustProxyConfig: fiber.TrustProxyConfig{Loopback: true, Private: true, Proxies: []string{"0.0.0.0"}},
+		})
+		Load(app)
+		app.Get("/:user", func(c fiber.Ctx) error {
+			return c.SendString("ok")
+		})
+
+		req := httptest.NewRequest("GET", "/someartist?q=secretquery", nil)
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		req.Header.Set("Cookie", "prefs=secretcookie")
+		_, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := buf.String()
+		check(t, out, private)
+		if !strings.Contains(out, "route=/:user") {
+			t.Errorf("no route pattern in output:\n%s", out)
+		}
+	}
+}
+
+func TestServerLogger(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		buf := capture(t, private)
+
+		s := serverLogger{Module("http")}
+		s.Printf("error when serving connection %q<->%q: %s", "0.0.0.0:8080", "1.2.3.4:5555", "GET /someartist?q=secretquery Cookie: secretcookie")
+
+		check(t, buf.String(), private)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		buf := capture(t, private)
+
+		w := writer{Module("main").Logger}
+		w.Write([]byte("client 1.2.3.4 opened /someartist?q=secretquery with secretcookie\n"))
+
+		check(t, buf.String(), private)
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		buf := capture(t, private)
+
+		Module("test").Info("something", Private("ip", "1.2.3.4"), Private("path", "/someartist?q=secretquery"), Private("cookies", "secretcookie"))
+
+		check(t, buf.String(), private)
+	}
+}
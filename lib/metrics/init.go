@@ -0,0 +1,312 @@
+package metrics
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+)
+
+// Prometheus metrics in the text exposition format. Written by hand, it's not much and we don't need another dependency for it.
+// Everything here is a no-op unless EnableMetrics is set
+
+// seconds
+var buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type series struct {
+	labels  []string
+	value   float64 // counter value, or sum for histograms
+	count   uint64
+	buckets []uint64
+}
+
+type vec struct {
+	name      string
+	help      string
+	labels    []string
+	histogram bool
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+var registry []*vec
+
+func newVec(name string, help string, histogram bool, labels ...string) *vec {
+	v := &vec{name: name, help: help, labels: labels, histogram: histogram, series: map[string]*series{}}
+	registry = append(registry, v)
+	return v
+}
+
+func (v *vec) get(labels []string) *series {
+	key := strings.Join(labels, "\x00")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: slices.Clone(labels)}
+		if v.histogram {
+			s.buckets = make([]uint64, len(buckets))
+		}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+func (v *vec) Add(n float64, labels ...string) {
+	if !cfg.EnableMetrics {
+		return
+	}
+
+	v.lock.Lock()
+	v.get(labels).value += n
+	v.lock.Unlock()
+}
+
+func (v *vec) Inc(labels ...string) {
+	v.Add(1, labels...)
+}
+
+func (v *vec) Observe(seconds float64, labels ...string) {
+	if !cfg.EnableMetrics {
+		return
+	}
+
+	v.lock.Lock()
+	s := v.get(labels)
+	s.value += seconds
+	s.count++
+	for i, b := range buckets {
+		if seconds <= b {
+			s.buckets[i]++
+		}
+	}
+	v.lock.Unlock()
+}
+
+func (v *vec) Since(start time.Time, labels ...string) {
+	v.Observe(time.Since(start).Seconds(), labels...)
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func writeLabels(b *bytes.Buffer, names []string, values []string, extra ...string) {
+	if len(names) == 0 && len(extra) == 0 {
+		return
+	}
+
+	b.WriteByte('{')
+	for i, n := range names {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n + `="` + escaper.Replace(values[i]) + `"`)
+	}
+	for i := 0; i < len(extra); i += 2 {
+		if i != 0 || len(names) != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra[i] + `="` + extra[i+1] + `"`)
+	}
+	b.WriteByte('}')
+}
+
+func float(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (v *vec) write(b *bytes.Buffer) {
+	typ := "counter"
+	if v.histogram {
+		typ = "histogram"
+	}
+	b.WriteString("# HELP " + v.name + " " + v.help + "\n# TYPE " + v.name + " " + typ + "\n")
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		s := v.series[k]
+		if !v.histogram {
+			b.WriteString(v.name)
+			writeLabels(b, v.labels, s.labels)
+			b.WriteString(" " + float(s.value) + "\n")
+			continue
+		}
+
+		for i, le := range buckets {
+			b.WriteString(v.name + "_bucket")
+			writeLabels(b, v.labels, s.labels, "le", float(le))
+			b.WriteString(" " + strconv.FormatUint(s.buckets[i], 10) + "\n")
+		}
+		b.WriteString(v.name + "_bucket")
+		writeLabels(b, v.labels, s.labels, "le", "+Inf")
+		b.WriteString(" " + strconv.FormatUint(s.count, 10) + "\n")
+
+		b.WriteString(v.name + "_sum")
+		writeLabels(b, v.labels, s.labels)
+		b.WriteString(" " + float(s.value) + "\n")
+
+		b.WriteString(v.name + "_count")
+		writeLabels(b, v.labels, s.labels)
+		b.WriteString(" " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+// Gauges are read when scraped
+type gauge struct {
+	name  string
+	help  string
+	label string
+	f     func() map[string]float64 // label value => value. label is ignored if empty
+}
+
+var gauges []gauge
+
+func Gauge(name string, help string, label string, f func() map[string]float64) {
+	gauges = append(gauges, gauge{name, help, label, f})
+}
+
+func (g gauge) write(b *bytes.Buffer) {
+	b.WriteString("# HELP " + g.name + " " + g.help + "\n# TYPE " + g.name + " gauge\n")
+
+	values := g.f()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		b.WriteString(g.name)
+		if g.label != "" {
+			writeLabels(b, []string{g.label}, []string{k})
+		}
+		b.WriteString(" " + float(values[k]) + "\n")
+	}
+}
+
+// The metrics themselves
+
+var RequestsTotal = newVec("soundcloak_http_requests_total", "Handled requests.", false, "route", "method", "status")
+var RequestDuration = newVec("soundcloak_http_request_duration_seconds", "Time spent handling requests (for streams, until the response started).", true, "route", "method")
+
+var UpstreamRequests = newVec("soundcloak_upstream_requests_total", "Requests to soundcloud, per upstream.", false, "upstream")
+var UpstreamErrors = newVec("soundcloak_upstream_errors_total", "Requests to soundcloud that failed even after retrying.", false, "upstream")
+var UpstreamRetries = newVec("soundcloak_upstream_retries_total", "Retries of requests to soundcloud (closed idle connections, timeouts).", false, "upstream")
+var UpstreamDuration = newVec("soundcloak_upstream_request_duration_seconds", "Time spent on requests to soundcloud, including retries.", true, "upstream")
+
+var CacheHits = newVec("soundcloak_cache_hits_total", "Cache lookups that found a value.", false, "cache")
+var CacheMisses = newVec("soundcloak_cache_misses_total", "Cache lookups that didn't find a value.", false, "cache")
+
+var ClientIDRefreshes = newVec("soundcloak_clientid_refreshes_total", "ClientID extractions.", false, "result")
+
+var RateLimited = newVec("soundcloak_ratelimit_limited_total", "Requests rejected by the rate limiter, per budget.", false, "budget")
+var RateLimitCharged = newVec("soundcloak_ratelimit_charged_total", "Usage counted by the rate limiter, per budget (requests, or bytes for audio).", false, "budget")
+
+var SegmentErrors = newVec("soundcloak_segment_errors_total", "HLS segments from soundcloud that failed validation, per reason (status, content_type, size, format).", false, "reason")
+
+var RestreamReaders atomic.Int64
+
+func init() {
+	Gauge("soundcloak_restream_active_readers", "Restream responses currently being sent.", "", func() map[string]float64 {
+		return map[string]float64{"": float64(RestreamReaders.Load())}
+	})
+}
+
+// Upstream label for the host of an http client
+func Upstream(addr string) string {
+	host, _, _ := strings.Cut(addr, ":")
+	switch host {
+	case "api-v2.soundcloud.com":
+		return "api"
+	case cfg.HLSCDN:
+		return "hls"
+	case cfg.HLSAACCDN:
+		return "aac"
+	case cfg.ImageCDN, "al.sndcdn.com":
+		return "images"
+	case "":
+		return "other"
+	}
+
+	return host
+}
+
+func Cache(name string, hit bool) {
+	if hit {
+		CacheHits.Inc(name)
+	} else {
+		CacheMisses.Inc(name)
+	}
+}
+
+func ClientIDRefresh(err error) {
+	if err != nil {
+		ClientIDRefreshes.Inc("failure")
+	} else {
+		ClientIDRefreshes.Inc("success")
+	}
+}
+
+func Load(r *fiber.App) {
+	r.Use(func(c fiber.Ctx) error {
+		start := time.Now()
+		// the error handler writes the response here instead of at the end, so the status is what the client actually got (like 451 for blocked stuff)
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		status := c.Response().StatusCode()
+
+		// route pattern, not the path, so there's no explosion of series (and no user data in there)
+		route := c.Route().Path
+		if status == fiber.StatusNotFound && route == "/" && c.Path() != "/" {
+			route = "unmatched"
+		}
+
+		RequestsTotal.Inc(route, c.Method(), strconv.Itoa(status))
+		RequestDuration.Since(start, route, c.Method())
+		return nil
+	})
+
+	r.Get("/_/metrics", func(c fiber.Ctx) error {
+		if cfg.MetricsToken != "" {
+			token, _ := strings.CutPrefix(c.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.MetricsToken)) != 1 {
+				return fiber.ErrUnauthorized
+			}
+		}
+
+		var b bytes.Buffer
+		for _, v := range registry {
+			v.write(&b)
+		}
+		for _, g := range gauges {
+			g.write(&b)
+		}
+
+		c.Response().Header.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+		return c.Send(b.Bytes())
+	})
+}
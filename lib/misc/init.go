@@ -1,15 +1,51 @@
 package misc
 
 import (
-	"log"
+	"fmt"
+	"net/url"
+	"strings"
 
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"github.com/a-h/templ"
+	"github.com/gofiber/fiber/v3"
 	"github.com/valyala/fasthttp"
 )
 
+var debugLogger = logging.Module("debug")
+
+// Only in debug builds, compiled out otherwise. Goes to the "debug" log module
 func Log(what ...any) {
 	if cfg.Debug {
-		log.Println(what...)
+		debugLogger.Debug(strings.TrimSuffix(fmt.Sprintln(what...), "\n"))
+	}
+}
+
+// Render a page, with the request's context so it stops if the client goes away
+func Render(c fiber.Ctx, t templ.Component) error {
+	c.Response().Header.SetContentType("text/html")
+	return t.Render(c.RequestCtx(), c.Response().BodyWriter())
+}
+
+var ErrCrossSite = fiber.NewError(fiber.StatusForbidden, "refusing to change this from another site")
+
+// Requests that change cookies have to come from our own pages. SameSite=Lax cookies aren't sent with cross-site POSTs,
+// so a form on some other site would otherwise start from an empty library/list and overwrite everything
+func CrossSite(c fiber.Ctx) bool {
+	switch c.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return false
+	case "":
+		// older browsers, go by Origin. no Origin at all isn't a form on another site (curl, or the browser didn't send one for a same-origin request)
+		o := c.Get("Origin")
+		if o == "" {
+			return false
+		}
+
+		u, err := url.Parse(o)
+		return err != nil || u.Host != c.Host()
+	default:
+		return true
 	}
 }
 
@@ -1,7 +1,6 @@
 package preferences
 
 import (
-	"context"
 	"time"
 
 	encodingjson "encoding/json"
@@ -10,6 +9,7 @@ import (
 	"github.com/valyala/fasthttp"
 
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/misc"
 	"git.maid.zone/stuff/soundcloak/templates"
 	"github.com/gofiber/fiber/v3"
 )
@@ -169,8 +169,7 @@ func Load(r *fiber.App) {
 			return err
 		}
 
-		c.Response().Header.SetContentType("text/html")
-		return templates.Base("preferences", templates.Preferences(p), nil).Render(context.Background(), c)
+		return misc.Render(c, templates.Base("preferences", templates.Preferences(p), nil))
 	})
 
 	r.Post("/_/preferences", func(c fiber.Ctx) error {
@@ -1,15 +1,47 @@
 package proxyimages
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"git.maid.zone/stuff/soundcloak/lib/blobcache"
+	"git.maid.zone/stuff/soundcloak/lib/blocklist"
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
 	"git.maid.zone/stuff/soundcloak/lib/misc"
 	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
 	"github.com/gofiber/fiber/v3"
 	"github.com/valyala/fasthttp"
 )
 
+var logger = logging.Module("proxyimages")
+
 var al_httpc *fasthttp.HostClient
 
+var cache blobcache.Cache
+
+var exts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+}
+
+var types = map[string]string{
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+}
+
+// images we have to read fully (to resize or cache them) can't be bigger than this
+const maxImageSize = 16 * 1024 * 1024
+
 func Load(r *fiber.App) {
 
 	al_httpc = &fasthttp.HostClient{
@@ -20,39 +52,174 @@ func Load(r *fiber.App) {
 		MaxResponseBodySize: 1,
 	}
 
+	if cfg.ImageCacheDir != "" {
+		var err error
+		cache, err = blobcache.New("images", cfg.ImageCacheDir, int64(cfg.ImageCacheSize)*1024*1024)
+		if err != nil {
+			logger.Error("failed to load image cache, images won't be cached", logging.Err(err))
+		}
+	}
+
 	r.Get("/_/proxy/images", func(c fiber.Ctx) error {
-		url := c.RequestCtx().QueryArgs().Peek("url")
+		args := c.RequestCtx().QueryArgs()
+		url := args.Peek("url")
 		if len(url) == 0 {
 			return fiber.ErrBadRequest
 		}
 
-		parsed := fasthttp.AcquireURI()
-		defer fasthttp.ReleaseURI(parsed)
+		if err := signing.Check(c, cfg.B2s(url)); err != nil {
+			return err
+		}
 
-		err := parsed.Parse(nil, url)
+		opts, err := ParseOptions(args)
 		if err != nil {
 			return err
 		}
+		opts.PickFormat(c)
 
-		const x = ".sndcdn.com"
-		if h := parsed.Host(); len(h) > len(x) && string(h[len(h)-len(x):]) != x {
-			return fiber.ErrBadRequest
+		return Serve(c, url, opts)
+	})
+}
+
+// the images never change, so the url and options are enough for a strong etag
+func cacheKey(url []byte, o Options) string {
+	h := sha256.New()
+	h.Write(url)
+	h.Write([]byte{0})
+	h.Write([]byte(o.variant()))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func notModified(c fiber.Ctx, etag string) bool {
+	inm := c.Get(fiber.HeaderIfNoneMatch)
+	if inm == "" {
+		return false
+	}
+
+	for _, e := range strings.Split(inm, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" || strings.TrimPrefix(e, "W/") == etag {
+			return true
 		}
+	}
+
+	return false
+}
+
+// Proxies the image from soundcloud's cdn, resized/converted according to o. Also used by the subsonic api
+func Serve(c fiber.Ctx, url []byte, o Options) error {
+	parsed := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(parsed)
+
+	err := parsed.Parse(nil, url)
+	if err != nil {
+		return err
+	}
+
+	if string(parsed.Scheme()) != "https" {
+		return fiber.ErrBadRequest
+	}
+
+	if blocklist.Image(cfg.B2s(parsed.Path())) {
+		return sc.ErrBlocked
+	}
+
+	var cl *fasthttp.HostClient
+	switch string(parsed.Host()) {
+	case "i1.sndcdn.com", "i2.sndcdn.com", "i3.sndcdn.com", "i4.sndcdn.com":
+		parsed.SetHost(cfg.ImageCDN)
+		cl = misc.ImageStreamingOnlyClient
+	case "al.sndcdn.com":
+		cl = al_httpc
+	default:
+		return fiber.ErrBadRequest
+	}
 
-		var cl *fasthttp.HostClient
-		if parsed.Host()[0] == 'i' {
-			parsed.SetHost(cfg.ImageCDN)
-			cl = misc.ImageStreamingOnlyClient
-		} else if string(parsed.Host()[:2]) == "al" {
-			cl = al_httpc
+	key := cacheKey(url, o)
+	etag := `"` + key + `"`
+	if notModified(c, etag) {
+		c.Set(fiber.HeaderETag, etag)
+		c.Set(fiber.HeaderCacheControl, cfg.ImageCacheControl)
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.SetURI(parsed)
+	req.Header.SetUserAgent(cfg.UserAgent)
+
+	// nothing to do with it, just stream it through
+	if o == (Options{}) && cache == nil {
+		err := sc.DoWithRetry(cl, req, c.Response())
+		if err != nil {
+			return err
 		}
 
-		req := fasthttp.AcquireRequest()
-		defer fasthttp.ReleaseRequest(req)
+		if c.Response().StatusCode() == fiber.StatusOK {
+			c.Set(fiber.HeaderETag, etag)
+			c.Set(fiber.HeaderCacheControl, cfg.ImageCacheControl)
+		}
 
-		req.SetURI(parsed)
-		req.Header.SetUserAgent(cfg.UserAgent)
+		return nil
+	}
 
-		return sc.DoWithRetry(cl, req, c.Response())
-	})
+	var data []byte
+	var contentType string
+	var ok bool
+	if cache != nil {
+		var ext string
+		data, ext, ok = cache.Get(key)
+		contentType = types[ext]
+	}
+
+	if !ok {
+		data, contentType, err = fetch(cl, req)
+		if err != nil {
+			return err
+		}
+
+		if o != (Options{}) {
+			data, contentType = transform(data, contentType, o)
+		}
+
+		if ext, ok := exts[contentType]; ok && cache != nil {
+			cache.Put(key, ext, data)
+		}
+	}
+
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, cfg.ImageCacheControl)
+	c.Set(fiber.HeaderContentType, contentType)
+	return c.Send(data)
+}
+
+func fetch(cl *fasthttp.HostClient, req *fasthttp.Request) ([]byte, string, error) {
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	err := sc.DoWithRetry(cl, req, resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if resp.StatusCode() != fiber.StatusOK {
+		return nil, "", fiber.NewError(resp.StatusCode())
+	}
+
+	var data []byte
+	if resp.IsBodyStream() {
+		data, err = io.ReadAll(io.LimitReader(resp.BodyStream(), maxImageSize+1))
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		data = append(data, resp.Body()...)
+	}
+
+	if len(data) > maxImageSize {
+		return nil, "", fiber.NewError(fiber.StatusBadGateway, "image is too big")
+	}
+
+	return data, string(resp.Header.ContentType()), nil
 }
@@ -0,0 +1,167 @@
+package proxyimages
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"runtime"
+	"strconv"
+	"strings"
+
+	_ "image/gif"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+)
+
+// What to do with the image before sending it. The zero value sends it as is
+type Options struct {
+	Size   int    // max width/height in pixels, 0 to keep the original size
+	Format string // "jpeg", "png" or "webp", empty to keep the original format (or pick one if the image is resized)
+}
+
+// Sizes are rounded up to one of these, so there's only a few versions of every image. Bigger ones are sent in original size
+var sizes = []int{50, 100, 200, 300, 500}
+
+var formats = map[string]string{
+	"jpeg": "jpeg",
+	"jpg":  "jpeg",
+	"png":  "png",
+	"webp": "webp",
+	"avif": "avif", // no avif encoder, so this is webp or jpeg depending on what the client accepts, see PickFormat
+}
+
+// bigger images are sent as is, so decoding them doesn't eat all the memory
+const maxPixels = 25_000_000
+
+// resizing is cpu-heavy, don't do too much of it at once
+var workers = make(chan struct{}, runtime.NumCPU())
+
+func snapSize(size int) int {
+	for _, s := range sizes {
+		if size <= s {
+			return s
+		}
+	}
+
+	return 0
+}
+
+// Reads the size and format query args
+func ParseOptions(args *fasthttp.Args) (Options, error) {
+	var o Options
+	if s := args.Peek("size"); len(s) != 0 {
+		size, err := strconv.Atoi(cfg.B2s(s))
+		if err != nil || size <= 0 {
+			return o, fiber.NewError(fiber.StatusBadRequest, "bad size")
+		}
+
+		o.Size = snapSize(size)
+	}
+
+	if f := args.Peek("format"); len(f) != 0 {
+		var ok bool
+		o.Format, ok = formats[cfg.B2s(f)]
+		if !ok {
+			return o, fiber.NewError(fiber.StatusBadRequest, "unsupported format, use jpeg, png, webp or avif")
+		}
+	}
+
+	return o, nil
+}
+
+// Replaces avif with something we can actually encode: webp if the client takes it, jpeg if not
+func (o *Options) PickFormat(c fiber.Ctx) {
+	if o.Format != "avif" {
+		return
+	}
+
+	c.Vary(fiber.HeaderAccept)
+	if strings.Contains(c.Get(fiber.HeaderAccept), "image/webp") {
+		o.Format = "webp"
+	} else {
+		o.Format = "jpeg"
+	}
+}
+
+func (o Options) variant() string {
+	return strconv.Itoa(o.Size) + "/" + o.Format
+}
+
+// Resizes/converts the image. If it can't be decoded (or it's too big), it's returned unchanged
+func transform(data []byte, contentType string, o Options) ([]byte, string) {
+	conf, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || conf.Width*conf.Height > maxPixels {
+		logger.Debug("not transforming image", "width", conf.Width, "height", conf.Height)
+		return data, contentType
+	}
+
+	resize := o.Size != 0 && (conf.Width > o.Size || conf.Height > o.Size)
+	out := o.Format
+	if out == "" {
+		if !resize {
+			return data, contentType
+		}
+
+		out = "jpeg"
+		if format == "png" || format == "gif" { // might be transparent
+			out = "png"
+		}
+	}
+
+	if !resize && out == format {
+		return data, contentType
+	}
+
+	workers <- struct{}{}
+	defer func() { <-workers }()
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		logger.Debug("failed to decode image", "format", format)
+		return data, contentType
+	}
+
+	if resize {
+		w, h := o.Size, o.Size
+		if conf.Width > conf.Height {
+			h = max(conf.Height*o.Size/conf.Width, 1)
+		} else {
+			w = max(conf.Width*o.Size/conf.Height, 1)
+		}
+
+		dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+		img = dst
+	}
+
+	var b bytes.Buffer
+	switch out {
+	case "png":
+		err = png.Encode(&b, img)
+	case "webp":
+		err = encodeWebp(&b, img, cfg.ImageQuality)
+	default:
+		// jpeg has no transparency, put it on white instead of black
+		if op, ok := img.(interface{ Opaque() bool }); !ok || !op.Opaque() {
+			dst := image.NewRGBA(img.Bounds())
+			draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+			draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+			img = dst
+		}
+
+		err = jpeg.Encode(&b, img, &jpeg.Options{Quality: min(max(cfg.ImageQuality, 1), 100)})
+	}
+	if err != nil {
+		logger.Debug("failed to encode image", "format", out)
+		return data, contentType
+	}
+
+	return b.Bytes(), "image/" + out
+}
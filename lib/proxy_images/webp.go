@@ -0,0 +1,796 @@
+package proxyimages
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// Lossy webp encoder: a single VP8 key frame in a RIFF container, see RFC 6386 and https://developers.google.com/speed/webp/docs/riff_container
+//
+// Kept simple, since it's only for thumbnails: luma is always predicted in 4x4 blocks (DC, TM, VE or HE, whichever is closest),
+// chroma with whichever 8x8 mode is closest, default token probabilities, one partition. Transparency goes in an uncompressed ALPH chunk.
+// The prediction/reconstruction parts mirror what decoders do (same workspace layout as golang.org/x/image/vp8), so both sides agree on every pixel
+
+var errWebpTooBig = errors.New("image is too big for webp")
+
+// prediction modes, numbered like in vp8ModeProb. Chroma uses the same ones
+const (
+	modeDC = iota
+	modeTM
+	modeVE
+	modeHE
+)
+
+// token probability planes
+const (
+	planeUV   = 2
+	planeLuma = 3 // luma without a separate DC block, which is all we do
+)
+
+var (
+	// coefficient position -> band, for token probabilities
+	bands = [17]uint8{0, 1, 2, 3, 6, 4, 5, 6, 6, 6, 6, 6, 6, 6, 6, 7, 0}
+	// probabilities for the extra bits of the bigger coefficient categories (3 to 6)
+	catProbs = [4][]uint8{
+		{173, 148, 140},
+		{176, 155, 140, 135},
+		{180, 157, 141, 134, 130},
+		{254, 254, 243, 230, 196, 177, 153, 140, 133, 130, 129},
+	}
+	// scan position -> coefficient index (row*4 + column)
+	zigzag = [16]uint8{0, 1, 4, 8, 5, 2, 3, 6, 9, 12, 13, 10, 7, 11, 14, 15}
+)
+
+// Boolean entropy encoder (section 7)
+type boolEncoder struct {
+	out      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+func (e *boolEncoder) put(bit bool, prob uint8) {
+	split := 1 + (e.rng-1)*uint32(prob)>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			// carry
+			i := len(e.out) - 1
+			for i >= 0 && e.out[i] == 255 {
+				e.out[i] = 0
+				i--
+			}
+			if i >= 0 {
+				e.out[i]++
+			}
+		}
+
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.out = append(e.out, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// n bits, most significant first, at 50%
+func (e *boolEncoder) putUint(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		e.put(v>>i&1 == 1, 128)
+	}
+}
+
+func (e *boolEncoder) finish() []byte {
+	// pushes out what's still in bottom
+	for range 32 {
+		e.put(false, 128)
+	}
+
+	return e.out
+}
+
+// dc and ac quantizer steps
+type quant struct {
+	y  [2]int32
+	uv [2]int32
+}
+
+type mbInfo struct {
+	modes [16]uint8
+	cmode uint8
+	skip  bool
+}
+
+type webpEncoder struct {
+	mbw, mbh int
+	// source planes (padded to whole macroblocks by repeating the edges) and the reconstruction, which later blocks are predicted from
+	y, u, v    []uint8
+	ry, ru, rv []uint8
+	ystride    int
+	cstride    int
+
+	q   quant
+	mbs []mbInfo
+
+	// workspace for the current macroblock, laid out like in golang.org/x/image/vp8/reconstruct.go:
+	// luma at [1:17][8:24] with the row above in [0] (plus 4 pixels above-right) and the column left in [...][7],
+	// u at [18:26][8:16] and v at [18:26][24:32], with borders in [17] and [...][7]/[...][23]
+	ybr [26][32]uint8
+
+	// which blocks have coefficients, for token contexts. 4 luma, 2 u, 2 v for the row/column of blocks next to the current macroblock
+	upNz   [][8]uint8
+	leftNz [8]uint8
+
+	tokens *boolEncoder
+}
+
+// BT.601 limited range (16-235), the same math libwebp uses
+func rgbToY(r, g, b int32) uint8 {
+	return uint8((16839*r + 33059*g + 6420*b + 1<<15 + 16<<16) >> 16)
+}
+
+// r, g, b are sums of 2x2 pixels
+func rgbToUV(r, g, b int32, u bool) uint8 {
+	var uv int32
+	if u {
+		uv = -9719*r - 19081*g + 28800*b
+	} else {
+		uv = 28800*r - 24116*g - 4684*b
+	}
+
+	return uint8(min(max((uv+1<<17+128<<18)>>18, 0), 255))
+}
+
+func clip8(v int32) uint8 {
+	return uint8(min(max(v, 0), 255))
+}
+
+// Encodes img as a lossy webp. quality is 1-100, like jpeg
+func encodeWebp(w io.Writer, img image.Image, quality int) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 || width > 16383 || height > 16383 {
+		return errWebpTooBig
+	}
+
+	src, ok := img.(*image.NRGBA)
+	if !ok || src.Rect.Min != (image.Point{}) {
+		src = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(src, src.Rect, img, b.Min, draw.Src)
+	}
+
+	e := &webpEncoder{mbw: (width + 15) / 16, mbh: (height + 15) / 16}
+	e.ystride, e.cstride = e.mbw*16, e.mbw*8
+	e.y, e.ry = make([]uint8, e.ystride*e.mbh*16), make([]uint8, e.ystride*e.mbh*16)
+	e.u, e.ru = make([]uint8, e.cstride*e.mbh*8), make([]uint8, e.cstride*e.mbh*8)
+	e.v, e.rv = make([]uint8, e.cstride*e.mbh*8), make([]uint8, e.cstride*e.mbh*8)
+
+	// padding repeats the last row/column
+	px := func(x, y int) (int32, int32, int32) {
+		i := src.PixOffset(min(x, width-1), min(y, height-1))
+		return int32(src.Pix[i]), int32(src.Pix[i+1]), int32(src.Pix[i+2])
+	}
+
+	for y := range e.mbh * 16 {
+		for x := range e.ystride {
+			r, g, b := px(x, y)
+			e.y[y*e.ystride+x] = rgbToY(r, g, b)
+		}
+	}
+
+	for y := range e.mbh * 8 {
+		for x := range e.cstride {
+			var r, g, b int32
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				pr, pg, pb := px(2*x+d[0], 2*y+d[1])
+				r, g, b = r+pr, g+pg, b+pb
+			}
+
+			e.u[y*e.cstride+x] = rgbToUV(r, g, b, true)
+			e.v[y*e.cstride+x] = rgbToUV(r, g, b, false)
+		}
+	}
+
+	alpha := make([]byte, 0, width*height)
+	opaque := true
+	for y := range height {
+		for x := range width {
+			a := src.Pix[src.PixOffset(x, y)+3]
+			alpha = append(alpha, a)
+			opaque = opaque && a == 255
+		}
+	}
+	if opaque {
+		alpha = nil
+	}
+
+	// quality 100 is the smallest quantizer, 1 almost the biggest
+	qi := (100 - min(max(quality, 1), 100)) * 127 / 100
+	e.q = quant{
+		y:  [2]int32{int32(vp8DCTable[qi]), int32(vp8ACTable[qi])},
+		uv: [2]int32{int32(vp8DCTable[min(qi, 117)]), int32(vp8ACTable[qi])},
+	}
+
+	e.mbs = make([]mbInfo, e.mbw*e.mbh)
+	e.upNz = make([][8]uint8, e.mbw)
+	e.tokens = newBoolEncoder()
+	for mby := range e.mbh {
+		e.leftNz = [8]uint8{}
+		for mbx := range e.mbw {
+			e.macroblock(mbx, mby)
+		}
+	}
+
+	tokens := e.tokens.finish()
+	first := e.header(qi)
+	if len(first) >= 1<<19 || len(tokens) >= 1<<24 {
+		return errWebpTooBig
+	}
+
+	frame := make([]byte, 10, 10+len(first)+len(tokens))
+	tag := uint32(len(first))<<5 | 1<<4 // key frame, version 0, shown
+	frame[0], frame[1], frame[2] = byte(tag), byte(tag>>8), byte(tag>>16)
+	frame[3], frame[4], frame[5] = 0x9d, 0x01, 0x2a
+	binary.LittleEndian.PutUint16(frame[6:], uint16(width))
+	binary.LittleEndian.PutUint16(frame[8:], uint16(height))
+	frame = append(append(frame, first...), tokens...)
+
+	var chunks []byte
+	if alpha != nil {
+		x := make([]byte, 10)
+		x[0] = 0x10 // has alpha
+		x[4], x[5], x[6] = byte(width-1), byte((width-1)>>8), byte((width-1)>>16)
+		x[7], x[8], x[9] = byte(height-1), byte((height-1)>>8), byte((height-1)>>16)
+		chunks = chunk(chunks, "VP8X", x)
+		// no filtering, no compression
+		chunks = chunk(chunks, "ALPH", append([]byte{0}, alpha...))
+	}
+	chunks = chunk(chunks, "VP8 ", frame)
+
+	out := make([]byte, 0, 12+len(chunks))
+	out = append(out, "RIFF"...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(4+len(chunks)))
+	out = append(out, "WEBP"...)
+	_, err := w.Write(append(out, chunks...))
+	return err
+}
+
+func chunk(b []byte, fourcc string, data []byte) []byte {
+	b = append(b, fourcc...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+// The first partition: frame header, then the modes of every macroblock
+func (e *webpEncoder) header(qi int) []byte {
+	skipped := 0
+	for _, mb := range e.mbs {
+		if mb.skip {
+			skipped++
+		}
+	}
+	// chance that a macroblock isn't skipped
+	skipProb := uint8(min(max((len(e.mbs)-skipped)*256/len(e.mbs), 1), 255))
+
+	h := newBoolEncoder()
+	h.put(false, 128) // color space
+	h.put(false, 128) // clamping required
+	h.put(false, 128) // no segments
+	h.put(false, 128) // normal loop filter
+	h.putUint(uint32(min(qi*5/8, 63)), 6)
+	h.putUint(0, 3)   // sharpness
+	h.put(false, 128) // no filter deltas
+	h.putUint(0, 2)   // one token partition
+	h.putUint(uint32(qi), 7)
+	for range 5 {
+		h.put(false, 128) // no quantizer deltas
+	}
+	h.put(false, 128) // refresh entropy probs
+
+	for i := range vp8TokenUpdateProb {
+		for j := range vp8TokenUpdateProb[i] {
+			for k := range vp8TokenUpdateProb[i][j] {
+				for _, p := range vp8TokenUpdateProb[i][j][k] {
+					h.put(false, p)
+				}
+			}
+		}
+	}
+
+	h.put(true, 128) // skipping macroblocks without coefficients
+	h.putUint(uint32(skipProb), 8)
+
+	// the modes around a block are the context for its own, outside the frame counts as DC
+	up := make([][4]uint8, e.mbw)
+	for mby := range e.mbh {
+		var left [4]uint8
+		for mbx := range e.mbw {
+			mb := &e.mbs[mby*e.mbw+mbx]
+			h.put(mb.skip, skipProb)
+			h.put(false, 145) // 4x4 luma prediction
+
+			for j := range 4 {
+				l := left[j]
+				for i := range 4 {
+					m := mb.modes[j*4+i]
+					p := &vp8ModeProb[up[mbx][i]][l]
+					h.put(m != modeDC, p[0])
+					if m != modeDC {
+						h.put(m != modeTM, p[1])
+						if m != modeTM {
+							h.put(m != modeVE, p[2])
+							if m != modeVE {
+								// HE
+								h.put(false, p[3])
+								h.put(false, p[4])
+							}
+						}
+					}
+
+					up[mbx][i] = m
+					l = m
+				}
+
+				left[j] = l
+			}
+
+			h.put(mb.cmode != modeDC, 142)
+			if mb.cmode != modeDC {
+				h.put(mb.cmode != modeVE, 114)
+				if mb.cmode != modeVE {
+					h.put(mb.cmode != modeHE, 183)
+				}
+			}
+		}
+	}
+
+	return h.finish()
+}
+
+// Fills the borders of the workspace from the reconstruction, the same way decoders do
+func (e *webpEncoder) prepare(mbx, mby int) {
+	if mbx == 0 {
+		for y := range 17 {
+			e.ybr[y][7] = 0x81
+		}
+		for y := 17; y < 26; y++ {
+			e.ybr[y][7] = 0x81
+			e.ybr[y][23] = 0x81
+		}
+	} else {
+		for y := range 17 {
+			e.ybr[y][7] = e.ybr[y][23]
+		}
+		for y := 17; y < 26; y++ {
+			e.ybr[y][7] = e.ybr[y][15]
+			e.ybr[y][23] = e.ybr[y][31]
+		}
+	}
+
+	if mby == 0 {
+		for x := 7; x < 28; x++ {
+			e.ybr[0][x] = 0x7f
+		}
+		for x := 7; x < 16; x++ {
+			e.ybr[17][x] = 0x7f
+		}
+		for x := 23; x < 32; x++ {
+			e.ybr[17][x] = 0x7f
+		}
+	} else {
+		above := (16*mby - 1) * e.ystride
+		copy(e.ybr[0][8:24], e.ry[above+16*mbx:])
+		if mbx == e.mbw-1 {
+			for x := 24; x < 28; x++ {
+				e.ybr[0][x] = e.ry[above+16*mbx+15]
+			}
+		} else {
+			copy(e.ybr[0][24:28], e.ry[above+16*mbx+16:])
+		}
+
+		above = (8*mby - 1) * e.cstride
+		copy(e.ybr[17][8:16], e.ru[above+8*mbx:])
+		copy(e.ybr[17][24:32], e.rv[above+8*mbx:])
+	}
+
+	// blocks on the right only have the row above the macroblock to go by
+	for y := 4; y < 16; y += 4 {
+		copy(e.ybr[y][24:28], e.ybr[0][24:28])
+	}
+}
+
+func (e *webpEncoder) macroblock(mbx, mby int) {
+	mb := &e.mbs[mby*e.mbw+mbx]
+	var levels [24][16]int16
+	var nz [24]bool
+
+	e.prepare(mbx, mby)
+
+	for j := range 4 {
+		for i := range 4 {
+			y, x := 4*j+1, 4*i+8
+			src := e.y[(16*mby+4*j)*e.ystride+16*mbx+4*i:]
+
+			best, bestErr := uint8(modeDC), -1
+			for m := range uint8(4) {
+				predict4(&e.ybr, y, x, m)
+				if d := e.diff(src, e.ystride, y, x, 4); bestErr == -1 || d < bestErr {
+					best, bestErr = m, d
+				}
+			}
+
+			predict4(&e.ybr, y, x, best)
+			mb.modes[j*4+i] = best
+			nz[j*4+i] = e.residual(src, e.ystride, y, x, e.q.y, &levels[j*4+i])
+		}
+	}
+
+	best, bestErr := uint8(modeDC), -1
+	usrc := e.u[8*mby*e.cstride+8*mbx:]
+	vsrc := e.v[8*mby*e.cstride+8*mbx:]
+	for m := range uint8(4) {
+		predict8(&e.ybr, 18, 8, m, mbx, mby)
+		predict8(&e.ybr, 18, 24, m, mbx, mby)
+		if d := e.diff(usrc, e.cstride, 18, 8, 8) + e.diff(vsrc, e.cstride, 18, 24, 8); bestErr == -1 || d < bestErr {
+			best, bestErr = m, d
+		}
+	}
+
+	mb.cmode = best
+	predict8(&e.ybr, 18, 8, best, mbx, mby)
+	predict8(&e.ybr, 18, 24, best, mbx, mby)
+	for n := range 4 {
+		j, i := n/2, n%2
+		nz[16+n] = e.residual(usrc[4*j*e.cstride+4*i:], e.cstride, 18+4*j, 8+4*i, e.q.uv, &levels[16+n])
+		nz[20+n] = e.residual(vsrc[4*j*e.cstride+4*i:], e.cstride, 18+4*j, 24+4*i, e.q.uv, &levels[20+n])
+	}
+
+	for y := range 16 {
+		copy(e.ry[(16*mby+y)*e.ystride+16*mbx:], e.ybr[1+y][8:24])
+	}
+	for y := range 8 {
+		copy(e.ru[(8*mby+y)*e.cstride+8*mbx:], e.ybr[18+y][8:16])
+		copy(e.rv[(8*mby+y)*e.cstride+8*mbx:], e.ybr[18+y][24:32])
+	}
+
+	mb.skip = true
+	for _, b := range nz {
+		if b {
+			mb.skip = false
+		}
+	}
+
+	if mb.skip {
+		e.leftNz = [8]uint8{}
+		e.upNz[mbx] = [8]uint8{}
+		return
+	}
+
+	// same order decoders read them in
+	up := &e.upNz[mbx]
+	for j := range 4 {
+		for i := range 4 {
+			n := j*4 + i
+			putCoeffs(e.tokens, &vp8TokenProb[planeLuma], e.leftNz[j]+up[i], &levels[n])
+			e.leftNz[j], up[i] = btou(nz[n]), btou(nz[n])
+		}
+	}
+
+	for c := 0; c < 4; c += 2 {
+		for j := range 2 {
+			for i := range 2 {
+				n := 16 + c*2 + j*2 + i
+				putCoeffs(e.tokens, &vp8TokenProb[planeUV], e.leftNz[4+c+j]+up[4+c+i], &levels[n])
+				e.leftNz[4+c+j], up[4+c+i] = btou(nz[n]), btou(nz[n])
+			}
+		}
+	}
+}
+
+func btou(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// squared difference between the source and the prediction in the workspace
+func (e *webpEncoder) diff(src []uint8, stride int, y, x, size int) int {
+	d := 0
+	for j := range size {
+		for i := range size {
+			v := int(src[j*stride+i]) - int(e.ybr[y+j][x+i])
+			d += v * v
+		}
+	}
+
+	return d
+}
+
+// cos((2n+1)kπ/8), scaled for an orthonormal dct
+var dctBasis = func() (b [4][4]float64) {
+	for k := range 4 {
+		s := math.Sqrt(0.5)
+		if k == 0 {
+			s = 0.5
+		}
+		for n := range 4 {
+			b[k][n] = s * math.Cos(float64(2*n+1)*float64(k)*math.Pi/8)
+		}
+	}
+
+	return b
+}()
+
+// Transforms and quantizes the difference between the source and the prediction of a 4x4 block,
+// then adds the dequantized result to the prediction, like decoders will. Levels are in zigzag order
+func (e *webpEncoder) residual(src []uint8, stride int, y, x int, q [2]int32, levels *[16]int16) bool {
+	var r [4][4]float64
+	for j := range 4 {
+		for i := range 4 {
+			r[j][i] = float64(int32(src[j*stride+i]) - int32(e.ybr[y+j][x+i]))
+		}
+	}
+
+	// vp8's coefficients are twice the orthonormal dct
+	var coeffs [16]int32
+	nonzero := false
+	for n, z := range zigzag {
+		v, u := int(z/4), int(z%4)
+		c := 0.0
+		for j := range 4 {
+			for i := range 4 {
+				c += r[j][i] * dctBasis[u][i] * dctBasis[v][j]
+			}
+		}
+		c *= 2
+
+		step := q[1]
+		bias := 3.0 / 8 // rounds down a bit more than usual, zeros are cheap
+		if z == 0 {
+			step, bias = q[0], 0.5
+		}
+
+		l := int32(min(math.Abs(c)/float64(step)+bias, 2048))
+		if c < 0 {
+			l = -l
+		}
+
+		levels[n] = int16(l)
+		coeffs[z] = l * step
+		if l != 0 {
+			nonzero = true
+		}
+	}
+
+	if nonzero {
+		inverseDCT(&e.ybr, y, x, &coeffs)
+	}
+
+	return nonzero
+}
+
+// section 14.3, has to match decoders exactly
+func inverseDCT(ybr *[26][32]uint8, y, x int, c *[16]int32) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+
+	var m [4][4]int32
+	for i := range 4 {
+		a := c[i] + c[8+i]
+		b := c[i] - c[8+i]
+		cc := (c[4+i]*c2)>>16 - (c[12+i]*c1)>>16
+		d := (c[4+i]*c1)>>16 + (c[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + cc
+		m[i][2] = b - cc
+		m[i][3] = a - d
+	}
+
+	for j := range 4 {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		ybr[y+j][x+0] = clip8(int32(ybr[y+j][x+0]) + (a+d)>>3)
+		ybr[y+j][x+1] = clip8(int32(ybr[y+j][x+1]) + (b+cc)>>3)
+		ybr[y+j][x+2] = clip8(int32(ybr[y+j][x+2]) + (b-cc)>>3)
+		ybr[y+j][x+3] = clip8(int32(ybr[y+j][x+3]) + (a-d)>>3)
+	}
+}
+
+// 4x4 luma prediction (section 12.3)
+func predict4(ybr *[26][32]uint8, y, x int, mode uint8) {
+	switch mode {
+	case modeDC:
+		sum := uint32(4)
+		for i := range 4 {
+			sum += uint32(ybr[y-1][x+i]) + uint32(ybr[y+i][x-1])
+		}
+		fill(ybr, y, x, 4, uint8(sum/8))
+	case modeTM:
+		tm(ybr, y, x, 4)
+	case modeVE:
+		for i := range 4 {
+			v := uint8((int32(ybr[y-1][x+i-1]) + 2*int32(ybr[y-1][x+i]) + int32(ybr[y-1][x+i+1]) + 2) / 4)
+			for j := range 4 {
+				ybr[y+j][x+i] = v
+			}
+		}
+	case modeHE:
+		a := int32(ybr[y-1][x-1])
+		p, q, r, s := int32(ybr[y][x-1]), int32(ybr[y+1][x-1]), int32(ybr[y+2][x-1]), int32(ybr[y+3][x-1])
+		for j, v := range [4]int32{(a + 2*p + q + 2) / 4, (p + 2*q + r + 2) / 4, (q + 2*r + s + 2) / 4, (r + 3*s + 2) / 4} {
+			for i := range 4 {
+				ybr[y+j][x+i] = uint8(v)
+			}
+		}
+	}
+}
+
+// 8x8 chroma prediction (section 12.2). DC only uses the edges that are inside the frame
+func predict8(ybr *[26][32]uint8, y, x int, mode uint8, mbx, mby int) {
+	switch mode {
+	case modeDC:
+		sum, n := uint32(0), uint32(0)
+		if mby > 0 {
+			for i := range 8 {
+				sum += uint32(ybr[y-1][x+i])
+			}
+			n += 8
+		}
+		if mbx > 0 {
+			for j := range 8 {
+				sum += uint32(ybr[y+j][x-1])
+			}
+			n += 8
+		}
+
+		v := uint8(0x80)
+		if n != 0 {
+			v = uint8((sum + n/2) / n)
+		}
+		fill(ybr, y, x, 8, v)
+	case modeTM:
+		tm(ybr, y, x, 8)
+	case modeVE:
+		for j := range 8 {
+			copy(ybr[y+j][x:x+8], ybr[y-1][x:x+8])
+		}
+	case modeHE:
+		for j := range 8 {
+			for i := range 8 {
+				ybr[y+j][x+i] = ybr[y+j][x-1]
+			}
+		}
+	}
+}
+
+func fill(ybr *[26][32]uint8, y, x, size int, v uint8) {
+	for j := range size {
+		for i := range size {
+			ybr[y+j][x+i] = v
+		}
+	}
+}
+
+func tm(ybr *[26][32]uint8, y, x, size int) {
+	corner := int32(ybr[y-1][x-1])
+	for j := range size {
+		for i := range size {
+			ybr[y+j][x+i] = clip8(int32(ybr[y+j][x-1]) + int32(ybr[y-1][x+i]) - corner)
+		}
+	}
+}
+
+// Writes the tokens for a 4x4 block (section 13). ctx is how many of the blocks above and left have coefficients
+func putCoeffs(e *boolEncoder, probs *[8][3][11]uint8, ctx uint8, levels *[16]int16) {
+	last := -1
+	for n := 15; n >= 0; n-- {
+		if levels[n] != 0 {
+			last = n
+			break
+		}
+	}
+
+	p := &probs[0][ctx]
+	e.put(last >= 0, p[0])
+	if last < 0 {
+		return
+	}
+
+	for n := 0; n < 16; {
+		v := int32(levels[n])
+		n++
+		if v == 0 {
+			e.put(false, p[1])
+			p = &probs[bands[n]][0]
+			continue
+		}
+
+		e.put(true, p[1])
+		a := max(v, -v)
+		if a == 1 {
+			e.put(false, p[2])
+			p = &probs[bands[n]][1]
+		} else {
+			e.put(true, p[2])
+			switch {
+			case a <= 4:
+				e.put(false, p[3])
+				e.put(a != 2, p[4])
+				if a != 2 {
+					e.put(a == 4, p[5])
+				}
+			case a <= 10:
+				e.put(true, p[3])
+				e.put(false, p[6])
+				e.put(a > 6, p[7])
+				if a <= 6 {
+					e.put(a == 6, 159)
+				} else {
+					e.put((a-7)&2 != 0, 165)
+					e.put((a-7)&1 != 0, 145)
+				}
+			default:
+				e.put(true, p[3])
+				e.put(true, p[6])
+				cat := 0
+				switch {
+				case a >= 67:
+					cat = 3
+				case a >= 35:
+					cat = 2
+				case a >= 19:
+					cat = 1
+				}
+
+				e.put(cat >= 2, p[8])
+				e.put(cat&1 == 1, p[9+cat/2])
+				extra := a - (3 + 8<<cat)
+				bits := catProbs[cat]
+				for i, prob := range bits {
+					e.put(extra>>(len(bits)-1-i)&1 == 1, prob)
+				}
+			}
+
+			p = &probs[bands[n]][2]
+		}
+
+		e.put(v < 0, 128)
+		if n == 16 {
+			return
+		}
+
+		e.put(last >= n, p[0])
+		if last < n {
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package proxyimages
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand/v2"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// psnr of the decoded luma against what it should be
+func lumaPSNR(t *testing.T, src *image.NRGBA, got image.Image) float64 {
+	var y []uint8
+	switch img := got.(type) {
+	case *image.YCbCr:
+		y = img.Y
+	case *image.NYCbCrA:
+		y = img.Y
+	default:
+		t.Fatalf("decoded to %T", got)
+	}
+
+	stride := got.(interface{ YOffset(x, y int) int }).YOffset(0, 1)
+	sum := 0.0
+	b := src.Bounds()
+	for py := range b.Dy() {
+		for px := range b.Dx() {
+			c := src.NRGBAAt(px, py)
+			d := float64(y[py*stride+px]) - float64(rgbToY(int32(c.R), int32(c.G), int32(c.B)))
+			sum += d * d
+		}
+	}
+
+	mse := sum / float64(b.Dx()*b.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+
+	return 10 * math.Log10(255*255/mse)
+}
+
+func TestWebp(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	images := map[string]*image.NRGBA{}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 37, 23))
+	for y := range 23 {
+		for x := range 37 {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 7), uint8(y * 11), uint8(x*y + rnd.IntN(16)), 255})
+		}
+	}
+	images["gradient"] = img
+
+	img = image.NewNRGBA(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rnd.IntN(256))
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 255
+	}
+	images["noise"] = img
+
+	img = image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []uint8{200, 30, 90, 255})
+	}
+	images["flat"] = img
+
+	img = image.NewNRGBA(image.Rect(0, 0, 30, 17))
+	for y := range 17 {
+		for x := range 30 {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 8), 100, 50, uint8(y * 15)})
+		}
+	}
+	images["transparent"] = img
+
+	for name, img := range images {
+		for _, quality := range []int{1, 80, 100} {
+			var b bytes.Buffer
+			err := encodeWebp(&b, img, quality)
+			if err != nil {
+				t.Fatalf("%s at %d: %v", name, quality, err)
+			}
+
+			got, err := webp.Decode(&b)
+			if err != nil {
+				t.Fatalf("%s at %d: failed to decode: %v", name, quality, err)
+			}
+
+			if got.Bounds() != img.Bounds() {
+				t.Fatalf("%s at %d: got bounds %v, want %v", name, quality, got.Bounds(), img.Bounds())
+			}
+
+			// noise is the worst case, anything else should look about the same
+			want := 30.0
+			if quality == 1 {
+				want = 10
+			} else if name == "noise" && quality != 100 {
+				want = 20
+			}
+			if psnr := lumaPSNR(t, img, got); psnr < want {
+				t.Errorf("%s at %d: luma psnr %.1f, want at least %.1f", name, quality, psnr, want)
+			}
+
+			a, ok := got.(*image.NYCbCrA)
+			if (name == "transparent") != ok {
+				t.Fatalf("%s at %d: decoded to %T", name, quality, got)
+			}
+			if ok && !bytes.Equal(a.A, alphaOf(img)) {
+				t.Errorf("%s at %d: alpha doesn't match", name, quality)
+			}
+		}
+	}
+}
+
+func alphaOf(img *image.NRGBA) []uint8 {
+	var a []uint8
+	for i := 3; i < len(img.Pix); i += 4 {
+		a = append(a, img.Pix[i])
+	}
+
+	return a
+}
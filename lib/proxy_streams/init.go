@@ -2,6 +2,7 @@ package proxystreams
 
 import (
 	"bytes"
+	"strconv"
 	"strings"
 	"time"
 
@@ -9,6 +10,8 @@ import (
 	"git.maid.zone/stuff/soundcloak/lib/misc"
 	"git.maid.zone/stuff/soundcloak/lib/preferences"
 	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/lib/segments"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
 	"github.com/gofiber/fiber/v3"
 	"github.com/valyala/fasthttp"
 )
@@ -50,6 +53,10 @@ func Load(app *fiber.App) {
 	// but still gives you an option to get redirected there (for example if you got ProxyStreams disabled)
 	app.Get("/_/api/hls/*", func(c fiber.Ctx) error {
 		s := c.Path()[len("/_/api/hls/"):]
+		if err := signing.Check(c, "/_/api/hls/"+s); err != nil {
+			return err
+		}
+
 		t, err := sc.GetTrack(s)
 		if err != nil {
 			return err
@@ -84,9 +91,18 @@ func Load(app *fiber.App) {
 			c.Response().Header.SetBytesV("Location", cl.Value.Playlist.FullURI())
 			return nil
 		}
+		// one signature for all the parts
 		var params []byte
+		if q := signing.Query("/_/proxy/hls/"+s[:len(s)-len("/hls")], cfg.SignedURLTTL); q != "" {
+			params = append(params, '?')
+			params = append(params, q...)
+		}
 		if !cfg.ProxyStreams || string(req.URI().QueryArgs().Peek("redirect_parts")) == "true" {
-			params = redirect_parts
+			if len(params) == 0 {
+				params = redirect_parts
+			} else {
+				params = append(params, "&redirect=true"...)
+			}
 		}
 		req.Reset()
 		req.SetURI(cl.Value.Playlist)
@@ -100,10 +116,25 @@ func Load(app *fiber.App) {
 			httpc = misc.HlsAacClient
 		}
 		err = sc.DoWithRetry(httpc, req, resp)
+		if err == nil && segments.Expired(resp.StatusCode()) {
+			// expired earlier than we thought
+			sc.ExpireStream(s)
+			cl, err = tr.GetStream(s, t)
+			if err != nil {
+				return err
+			}
+
+			req.SetURI(cl.Value.Playlist)
+			err = sc.DoWithRetry(httpc, req, resp)
+		}
 		if err != nil {
 			return err
 		}
 
+		if resp.StatusCode() != fiber.StatusOK {
+			return fiber.NewError(fiber.StatusBadGateway, "playlist request failed with status "+strconv.Itoa(resp.StatusCode()))
+		}
+
 		s2 := s[:len(s)-len("/hls")]
 		ln := 0
 		if cl.Value.Base != nil {
@@ -217,102 +248,144 @@ func Load(app *fiber.App) {
 		_s := c.Request().URI().Path()
 		fp := string(_s[len("/_/proxy/hls/")+len(s)-len("/hls")+1:])
 		//fmt.Println(s, string(_s), fp)
-		sc.StreamCacheMut.RLock()
-		cl, ok := sc.StreamCache[s]
-		sc.StreamCacheMut.RUnlock()
-		if !ok || cl.Expires.Before(time.Now()) {
-			t, err := sc.GetTrack(c.Params("author") + "/" + c.Params("track"))
-			if err != nil {
-				return err
-			}
-
-			q := c.Params("quality")
-			var transcoding *sc.Transcoding
-			for _, tr := range t.Media.Transcodings {
-				if tr.Format.Protocol == sc.ProtocolHLS && tr.Quality == q && tr.Preset == p {
-					transcoding = &tr
-					break
-				}
-			}
-			if transcoding == nil {
-				return fiber.ErrExpectationFailed
-			}
-			cl, err = transcoding.GetStream(s, t)
-			if err != nil {
-				return err
-			}
+		if err := signing.Check(c, "/_/proxy/hls/"+s[:len(s)-len("/hls")]); err != nil {
+			return err
 		}
 
-		var httpc *fasthttp.HostClient
-		if aac {
-			httpc = misc.HlsAacClient
-		} else {
-			httpc = misc.HlsClient
+		if sc.TrackBlocked(c.Params("author") + "/" + c.Params("track")) {
+			return sc.ErrBlocked
 		}
 
 		redir := !cfg.ProxyStreams || string(req.URI().QueryArgs().Peek("redirect")) == "true"
 		req.Reset()
 		req.Header.SetUserAgent(cfg.UserAgent)
 		resp := c.Response()
-		if cl.Value.FreshBase || cl.Value.Base == nil {
-			if cl.Value.Base == nil {
-				cl.Value.Base = fasthttp.AcquireURI()
+
+		// if the cdn doesn't like the stream url anymore (it can expire before we think it does, or while someone has the playlist paused), get a new one and try again
+		for renewed := false; ; renewed = true {
+			sc.StreamCacheMut.RLock()
+			cl, ok := sc.StreamCache[s]
+			sc.StreamCacheMut.RUnlock()
+			if !ok || cl.Expires.Before(time.Now()) {
+				t, err := sc.GetTrack(c.Params("author") + "/" + c.Params("track"))
+				if err != nil {
+					return err
+				}
+
+				q := c.Params("quality")
+				var transcoding *sc.Transcoding
+				for _, tr := range t.Media.Transcodings {
+					if tr.Format.Protocol == sc.ProtocolHLS && tr.Quality == q && tr.Preset == p {
+						transcoding = &tr
+						break
+					}
+				}
+				if transcoding == nil {
+					return fiber.ErrExpectationFailed
+				}
+				cl, err = transcoding.GetStream(s, t)
+				if err != nil {
+					return err
+				}
 			}
-			req.SetURI(cl.Value.Playlist)
-			err := sc.DoWithRetry(httpc, req, resp)
-			if err != nil {
-				return err
+
+			var httpc *fasthttp.HostClient
+			if aac {
+				httpc = misc.HlsAacClient
+			} else {
+				httpc = misc.HlsClient
 			}
-			for l := range bytes.SplitSeq(resp.Body(), newline) {
-				if len(l) == 0 || l[0] == '#' {
+
+			if cl.Value.FreshBase || cl.Value.Base == nil {
+				if cl.Value.Base == nil {
+					cl.Value.Base = fasthttp.AcquireURI()
+				}
+				req.SetURI(cl.Value.Playlist)
+				err := sc.DoWithRetry(httpc, req, resp)
+				if err != nil {
+					return err
+				}
+
+				if segments.Expired(resp.StatusCode()) && !renewed {
+					sc.ExpireStream(s)
 					continue
 				}
 
-				if cl.Value.Base.Parse(nil, l) == nil {
-					p := cl.Value.Base.Path()
-					if aac {
-						cl.Value.Base.SetPathBytes(p[:len(p)-len(cl.Value.Base.LastPathSegment())])
-					} else {
-						i := bytes.IndexByte(p[len("/media/"):], '/')
-						if i != -1 {
-							// only get first const
-							// /media/159660/
-							cl.Value.Base.SetPathBytes(p[:len("/media/")+i+1])
+				for l := range bytes.SplitSeq(resp.Body(), newline) {
+					if len(l) == 0 || l[0] == '#' {
+						continue
+					}
+
+					if cl.Value.Base.Parse(nil, l) == nil {
+						p := cl.Value.Base.Path()
+						if aac {
+							cl.Value.Base.SetPathBytes(p[:len(p)-len(cl.Value.Base.LastPathSegment())])
+						} else {
+							i := bytes.IndexByte(p[len("/media/"):], '/')
+							if i != -1 {
+								// only get first const
+								// /media/159660/
+								cl.Value.Base.SetPathBytes(p[:len("/media/")+i+1])
+							}
 						}
+						cl.Value.FreshBase = false
+						sc.StreamCacheMut.Lock()
+						sc.StreamCache[s] = cl
+						sc.StreamCacheMut.Unlock()
+						break
 					}
-					cl.Value.FreshBase = false
-					sc.StreamCacheMut.Lock()
-					sc.StreamCache[s] = cl
-					sc.StreamCacheMut.Unlock()
-					break
 				}
 			}
-		}
 
-		req.SetURI(cl.Value.Base)
-		if aac {
-			req.URI().SetPathBytes(append(req.URI().Path(), fp...))
-		} else {
-			p := cl.Value.Playlist.Path()
-			req.URI().SetPathBytes(append(append(req.URI().Path(), fp...), p[len("/playlist"):len(p)-len("/playlist.m3u8")]...))
-		}
+			req.SetURI(cl.Value.Base)
+			if aac {
+				req.URI().SetPathBytes(append(req.URI().Path(), fp...))
+			} else {
+				p := cl.Value.Playlist.Path()
+				req.URI().SetPathBytes(append(append(req.URI().Path(), fp...), p[len("/playlist"):len(p)-len("/playlist.m3u8")]...))
+			}
 
-		if redir {
-			resp.SetStatusCode(fiber.StatusFound)
-			resp.Header.SetBytesV("Location", req.URI().FullURI())
-			return nil
-		}
+			if redir {
+				resp.SetStatusCode(fiber.StatusFound)
+				resp.Header.SetBytesV("Location", req.URI().FullURI())
+				return nil
+			}
 
-		if aac {
-			httpc = hls_aac_streaming_httpc
-		} else {
-			httpc = misc.HlsStreamingOnlyClient
+			if segments.Enabled() {
+				data, ext, err := segments.Get(httpc, req.URI())
+				if err == segments.ErrExpired && !renewed {
+					sc.ExpireStream(s)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+
+				resp.Header.SetContentType(segments.ContentType(ext))
+				return c.Send(data)
+			}
+
+			if aac {
+				httpc = hls_aac_streaming_httpc
+			} else {
+				httpc = misc.HlsStreamingOnlyClient
+			}
+			err := sc.DoWithRetry(httpc, req, resp)
+			if err == nil && segments.Expired(resp.StatusCode()) && !renewed {
+				sc.ExpireStream(s)
+				continue
+			}
+
+			return err
 		}
-		return sc.DoWithRetry(httpc, req, resp)
 	})
 
 	app.Get("/_/api/progressive/*", func(c fiber.Ctx) error {
 		s := c.Path()[len("/_/api/progressive/"):]
+		if err := signing.Check(c, "/_/api/progressive/"+s); err != nil {
+			return err
+		}
+
 		t, err := sc.GetTrack(s)
 		if err != nil {
 			return err
@@ -6,6 +6,7 @@ import (
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
 	"git.maid.zone/stuff/soundcloak/lib/misc"
 	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
 	"github.com/gofiber/fiber/v3"
 	"github.com/valyala/fasthttp"
 )
@@ -14,6 +15,15 @@ const sndcdn = ".sndcdn.com"
 const soundcloudcloud = ".soundcloud.cloud"
 
 func legacy(r fiber.Router) {
+	// nothing links here anymore, so with SignProxyURLs only the parts from the playlists below work
+	r.Use(func(c fiber.Ctx) error {
+		if err := signing.Check(c, cfg.B2s(c.RequestCtx().QueryArgs().Peek("url"))); err != nil {
+			return err
+		}
+
+		return c.Next()
+	})
+
 	r.Get("/", func(c fiber.Ctx) error {
 		ur := c.RequestCtx().QueryArgs().Peek("url")
 		if len(ur) == 0 {
@@ -28,7 +38,7 @@ func legacy(r fiber.Router) {
 			return err
 		}
 
-		if h := parsed.Host(); len(h) > len(sndcdn) && string(h[len(h)-len(sndcdn):]) != sndcdn {
+		if !bytes.HasSuffix(parsed.Host(), []byte(sndcdn)) {
 			return fiber.ErrBadRequest
 		}
 
@@ -55,7 +65,7 @@ func legacy(r fiber.Router) {
 			return err
 		}
 
-		if h := parsed.Host(); len(h) > len(soundcloudcloud) && string(h[len(h)-len(soundcloudcloud):]) != soundcloudcloud {
+		if !bytes.HasSuffix(parsed.Host(), []byte(soundcloudcloud)) {
 			return fiber.ErrBadRequest
 		}
 
@@ -82,7 +92,7 @@ func legacy(r fiber.Router) {
 		}
 
 		const x = ".sndcdn.com"
-		if h := parsed.Host(); len(h) > len(x) && string(h[len(h)-len(x):]) != x {
+		if !bytes.HasSuffix(parsed.Host(), []byte(x)) {
 			return fiber.ErrBadRequest
 		}
 
@@ -107,8 +117,7 @@ func legacy(r fiber.Router) {
 				continue
 			}
 
-			c.Response().AppendBodyString("/_/proxy/streams?url=")
-			c.Response().AppendBody(fasthttp.AppendQuotedArg(nil, l))
+			c.Response().AppendBodyString(signing.URL("/_/proxy/streams?url="+cfg.B2s(fasthttp.AppendQuotedArg(nil, l)), string(l)))
 			c.Response().AppendBody(newline)
 		}
 
@@ -130,7 +139,7 @@ func legacy(r fiber.Router) {
 		}
 
 		const x = ".soundcloud.cloud"
-		if h := parsed.Host(); len(h) > len(x) && string(h[len(h)-len(x):]) != x {
+		if !bytes.HasSuffix(parsed.Host(), []byte(x)) {
 			return fiber.ErrBadRequest
 		}
 
@@ -159,8 +168,9 @@ func legacy(r fiber.Router) {
 				// #EXT-X-MAP:URI="..."
 				const x = `#EXT-X-MAP:URI="`
 				if len(l) > len(x) && string(l[:len(x)]) == x {
-					c.Response().AppendBodyString(`#EXT-X-MAP:URI="/_/proxy/streams/aac?url=`)
-					c.Response().AppendBody(fasthttp.AppendQuotedArg(nil, l[len(x):len(l)-1]))
+					u := l[len(x) : len(l)-1]
+					c.Response().AppendBodyString(`#EXT-X-MAP:URI="`)
+					c.Response().AppendBodyString(signing.URL("/_/proxy/streams/aac?url="+cfg.B2s(fasthttp.AppendQuotedArg(nil, u)), string(u)))
 					c.Response().AppendBodyString(`"`)
 				} else {
 					c.Response().AppendBody(l)
@@ -169,8 +179,7 @@ func legacy(r fiber.Router) {
 				continue
 			}
 
-			c.Response().AppendBodyString("/_/proxy/streams/aac?url=")
-			c.Response().AppendBody(fasthttp.AppendQuotedArg(nil, l))
+			c.Response().AppendBodyString(signing.URL("/_/proxy/streams/aac?url="+cfg.B2s(fasthttp.AppendQuotedArg(nil, l)), string(l)))
 			c.Response().AppendBody(newline)
 		}
 
@@ -0,0 +1,326 @@
+package ratelimit
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
+)
+
+// Per-client rate limiting, keyed by ip (ipv6 by RateLimitIPv6Prefix). Every client gets a token bucket per budget, which refills over a minute (so the per-minute budget is also the burst).
+// Audio is counted in bytes after the response is known, so a client can go over the budget with one big response, and then has to wait until it's paid back
+
+var logger = logging.Module("ratelimit")
+
+const mib = 1024 * 1024
+
+// admin logins per minute, always on with RateLimit so the token can't be guessed quickly
+const loginPerMinute = 10
+
+type budget struct {
+	name  string
+	rate  float64 // per second
+	burst float64
+
+	lock    sync.Mutex
+	clients map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// nil if the budget is turned off
+func newBudget(name string, perMinute int, unit float64) *budget {
+	if perMinute <= 0 {
+		return nil
+	}
+
+	burst := float64(perMinute) * unit
+	return &budget{name: name, rate: burst / 60, burst: burst, clients: map[string]*bucket{}}
+}
+
+func (b *budget) refill(ip string, now time.Time) *bucket {
+	c, ok := b.clients[ip]
+	if !ok {
+		c = &bucket{tokens: b.burst, last: now}
+		b.clients[ip] = c
+		return c
+	}
+
+	c.tokens = min(b.burst, c.tokens+now.Sub(c.last).Seconds()*b.rate)
+	c.last = now
+	return c
+}
+
+// Takes n from the bucket. If there isn't enough (or the bucket is in debt), nothing is taken and it returns how long to wait
+func (b *budget) take(ip string, n float64) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	c := b.refill(ip, time.Now())
+	need := max(n, 1)
+	if c.tokens < need {
+		return time.Duration((need - c.tokens) / b.rate * float64(time.Second))
+	}
+
+	c.tokens -= n
+	metrics.RateLimitCharged.Add(n, b.name)
+	return 0
+}
+
+// Takes n without checking, the bucket can go into debt
+func (b *budget) charge(ip string, n float64) {
+	if n <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	b.refill(ip, time.Now()).tokens -= n
+	b.lock.Unlock()
+
+	metrics.RateLimitCharged.Add(n, b.name)
+}
+
+// forgets clients with full buckets, those are the same as new ones anyway
+func (b *budget) cleanup() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	for ip := range b.clients {
+		if b.refill(ip, now).tokens >= b.burst {
+			delete(b.clients, ip)
+		}
+	}
+}
+
+func (b *budget) size() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.clients)
+}
+
+var pages, api, images, audio, login *budget
+
+func parsePrefixes(l []string, what string) []netip.Prefix {
+	res := make([]netip.Prefix, 0, len(l))
+	for _, s := range l {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			a, err := netip.ParseAddr(s)
+			if err != nil {
+				logger.Warn("ignoring bad address", "list", what, "value", s)
+				continue
+			}
+
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+
+		res = append(res, p)
+	}
+
+	return res
+}
+
+func contains(l []netip.Prefix, a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range l {
+		if p.Contains(a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var allowlist, trusted []netip.Prefix
+
+// The client's ip. If the request came through a trusted proxy, it's the rightmost address in X-Forwarded-For that isn't one of the proxies (anything to the left of it could be made up by the client)
+func clientIP(c fiber.Ctx) netip.Addr {
+	remote, _ := netip.AddrFromSlice(c.RequestCtx().RemoteIP())
+	remote = remote.Unmap()
+
+	// only local proxies can connect to the socket
+	_, unix := c.RequestCtx().RemoteAddr().(*net.UnixAddr)
+	if cfg.TrustedProxyCheck && !unix && !c.IsProxyTrusted() {
+		return remote
+	}
+
+	xff := c.Get(fiber.HeaderXForwardedFor)
+	last := remote
+	for xff != "" {
+		part := xff
+		if i := strings.LastIndexByte(xff, ','); i != -1 {
+			part, xff = xff[i+1:], xff[:i]
+		} else {
+			xff = ""
+		}
+
+		a, err := netip.ParseAddr(strings.TrimSpace(part))
+		if err != nil {
+			break
+		}
+
+		last = a.Unmap()
+		if !contains(trusted, last) {
+			return last
+		}
+	}
+
+	return last
+}
+
+func classify(p string) *budget {
+	switch {
+	case p == "/_/admin/login":
+		return login
+	case strings.HasPrefix(p, "/_/static/"), strings.HasPrefix(p, "/_/admin"),
+		p == "/_/health", p == "/_/ready", p == "/_/metrics":
+		return nil
+	case strings.HasPrefix(p, "/_/proxy/images"), strings.HasPrefix(p, "/rest/getCoverArt"):
+		return images
+	case strings.HasPrefix(p, "/_/proxy/hls/"), strings.HasPrefix(p, "/_/api/restream/"), strings.HasPrefix(p, "/_/api/progressive/"),
+		strings.HasPrefix(p, "/rest/stream"), strings.HasPrefix(p, "/rest/download"):
+		return audio
+	case strings.HasPrefix(p, "/_/api/"), strings.HasPrefix(p, "/rest/"), p == "/_/oembed":
+		return api
+	default:
+		return pages
+	}
+}
+
+// ipv6 clients usually get a whole /64 (or more), so they'd get a new budget for every address otherwise
+func bucketKey(a netip.Addr) string {
+	if a.Is6() && cfg.RateLimitIPv6Prefix > 0 {
+		if p, err := a.Prefix(cfg.RateLimitIPv6Prefix); err == nil {
+			return p.String()
+		}
+	}
+
+	return a.String()
+}
+
+func limited(c fiber.Ctx, b *budget, ip string, wait time.Duration) error {
+	metrics.RateLimited.Inc(b.name)
+	logger.Request(c).Debug("rate limited", "budget", b.name, logging.Private("ip", ip))
+
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return fiber.NewError(fiber.StatusTooManyRequests, "too many requests, slow down")
+}
+
+type key int
+
+const ipKey key = 0
+
+func Load(r *fiber.App) {
+	pages = newBudget("pages", cfg.RateLimitPages, 1)
+	api = newBudget("api", cfg.RateLimitAPI, 1)
+	images = newBudget("images", cfg.RateLimitImages, 1)
+	audio = newBudget("audio", cfg.RateLimitAudio, mib)
+	login = newBudget("login", loginPerMinute, 1)
+
+	allowlist = parsePrefixes(cfg.RateLimitAllowlist, "RateLimitAllowlist")
+	trusted = parsePrefixes(cfg.TrustedProxies, "TrustedProxies")
+
+	all := []*budget{}
+	for _, b := range []*budget{pages, api, images, audio, login} {
+		if b != nil {
+			all = append(all, b)
+		}
+	}
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			for _, b := range all {
+				b.cleanup()
+			}
+		}
+	}()
+
+	metrics.Gauge("soundcloak_ratelimit_clients", "Clients currently tracked by the rate limiter, per budget.", "budget", func() map[string]float64 {
+		m := make(map[string]float64, len(all))
+		for _, b := range all {
+			m[b.name] = float64(b.size())
+		}
+		return m
+	})
+
+	r.Use(func(c fiber.Ctx) error {
+		b := classify(c.Path())
+		if b == nil {
+			return c.Next()
+		}
+
+		a := clientIP(c)
+		if contains(allowlist, a) {
+			return c.Next()
+		}
+
+		ip := bucketKey(a)
+		c.Locals(ipKey, ip)
+		if b != audio {
+			if wait := b.take(ip, 1); wait != 0 {
+				return limited(c, b, ip, wait)
+			}
+
+			return c.Next()
+		}
+
+		// audio: only check that the client isn't in debt yet, and charge for the response after
+		if wait := b.take(ip, 0); wait != 0 {
+			return limited(c, b, ip, wait)
+		}
+
+		err := c.Next()
+		resp := c.Response()
+		if !resp.IsBodyStream() {
+			b.charge(ip, float64(len(resp.Body())))
+		} else if l := resp.Header.ContentLength(); l > 0 {
+			b.charge(ip, float64(l))
+		} // streams of unknown length are charged as they're read, see Reader
+
+		return err
+	})
+}
+
+type reader struct {
+	r  io.ReadCloser
+	ip string
+}
+
+func (r reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	audio.charge(r.ip, float64(n))
+	return n, err
+}
+
+func (r reader) Close() error {
+	return r.r.Close()
+}
+
+// Wraps audio streams that are sent without a length (like restream), so they're charged as they're sent
+func Reader(c fiber.Ctx, r io.ReadCloser) io.ReadCloser {
+	if audio == nil {
+		return r
+	}
+
+	ip, ok := c.Locals(ipKey).(string)
+	if !ok { // allowlisted, or not going through the limiter
+		return r
+	}
+
+	return reader{r, ip}
+}
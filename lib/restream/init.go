@@ -3,15 +3,19 @@ package restream
 import (
 	"bytes"
 	"image"
+	"io"
 	"strings"
 
 	_ "image/jpeg"
 	_ "image/png"
 
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
 	"git.maid.zone/stuff/soundcloak/lib/misc"
 	"git.maid.zone/stuff/soundcloak/lib/preferences"
+	"git.maid.zone/stuff/soundcloak/lib/ratelimit"
 	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
 	"github.com/bogem/id3v2/v2"
 	"github.com/gcottom/mp4meta"
 	"github.com/gofiber/fiber/v3"
@@ -42,6 +46,10 @@ func Load(r *fiber.App) {
 	})
 
 	r.Get("/_/api/restream/:author/:track", func(c fiber.Ctx) error {
+		if err := signing.Check(c, "/_/api/restream/"+c.Params("author")+"/"+c.Params("track")); err != nil {
+			return err
+		}
+
 		p, err := preferences.Get(c)
 		if err != nil {
 			return err
@@ -80,155 +88,193 @@ func Load(r *fiber.App) {
 			}
 		}
 
-		tr, audio := t.Media.SelectCompatibleRestream(quality)
-		if tr == nil {
-			return fiber.ErrExpectationFailed
-		}
+		return Stream(c, t, quality, isDownload)
+	})
+}
 
-		u, err := tr.GetStream("", t)
-		if err != nil {
-			return err
-		}
+// r is closed by fasthttp once the response is done, that's where the count goes back down
+func sendStream(c fiber.Ctx, r io.ReadCloser) error {
+	metrics.RestreamReaders.Add(1)
+	if r, ok := r.(*reader); ok {
+		r.trailer(c.Response())
+	}
 
-		//req := c.Request()
-		//rng := req.Header.Peek("Range")
-		resp := c.Response()
-		resp.Header.SetContentType(tr.Format.MimeType)
-		resp.Header.Set("Cache-Control", cfg.RestreamCacheControl)
-		resp.Header.Set("Content-Disposition", `attachment; filename="`+t.Permalink+"."+sc.ToExt(audio)+`"`)
+	return c.SendStream(ratelimit.Reader(c, r))
+}
 
-		if isDownload {
-			if t.Artwork != "" {
-				t.Artwork = strings.Replace(t.Artwork, "t500x500", "original", 1)
-			}
+// Serves the track as a single audio file, with metadata injected if download is set. Also used by the subsonic api
+func Stream(c fiber.Ctx, t sc.Track, quality string, isDownload bool) error {
+	tr, audio := t.Media.SelectCompatibleRestream(quality)
+	if tr == nil {
+		return fiber.ErrExpectationFailed
+	}
 
-			switch audio {
-			case cfg.AudioMP3:
-				req := fasthttp.AcquireRequest()
-				resp := fasthttp.AcquireResponse()
+	u, err := tr.GetStream("", t)
+	if err != nil {
+		return err
+	}
 
-				req.Header.SetUserAgent(cfg.UserAgent)
+	// for when the stream url expires before the track is done
+	renew := func() (*fasthttp.URI, error) {
+		sc.ExpireStream(tr.Slug(t))
+		u, err := tr.GetStream("", t)
+		if err != nil {
+			return nil, err
+		}
 
-				tag := id3v2.NewEmptyTag()
+		return u.Value.Playlist, nil
+	}
 
-				tag.SetArtist(t.Author.Username)
-				if t.Genre != "" {
-					tag.SetGenre(t.Genre)
-				}
+	//req := c.Request()
+	//rng := req.Header.Peek("Range")
+	resp := c.Response()
+	resp.Header.SetContentType(tr.Format.MimeType)
+	resp.Header.Set("Cache-Control", cfg.RestreamCacheControl)
+	resp.Header.Set("Content-Disposition", `attachment; filename="`+t.Permalink+"."+sc.ToExt(audio)+`"`)
 
-				tag.SetTitle(t.Title)
+	if isDownload {
+		if t.Artwork != "" {
+			t.Artwork = strings.Replace(t.Artwork, "t500x500", "original", 1)
+		}
 
-				if t.Artwork != "" {
-					req.SetRequestURI(t.Artwork)
+		switch audio {
+		case cfg.AudioMP3:
+			req := fasthttp.AcquireRequest()
+			resp := fasthttp.AcquireResponse()
 
-					err := sc.DoWithRetry(image_httpc, req, resp)
-					if err == nil && resp.StatusCode() == 200 {
-						//fmt.Println(string(resp.Header.ContentType()), string(resp.Header.Peek("Content-Encoding")), len(resp.Body()))
-						tag.AddAttachedPicture(id3v2.PictureFrame{MimeType: cfg.B2s(resp.Header.ContentType()), Picture: resp.Body(), PictureType: id3v2.PTFrontCover, Encoding: id3v2.EncodingUTF8})
-					}
-				}
+			req.Header.SetUserAgent(cfg.UserAgent)
 
-				if tr.Format.Protocol == sc.ProtocolProgressive {
-					r := acquireInjector()
-					tag.WriteTo(r) // write out tag first because the buffers will be overwritten if you reuse the req/resp
+			tag := id3v2.NewEmptyTag()
 
-					req.SetURI(u.Value.Playlist)
-					// enforce streaming here!!
-					err := sc.DoWithRetry(misc.HlsStreamingOnlyClient, req, resp)
-					if err != nil {
-						return err
-					}
+			tag.SetArtist(t.Author.Username)
+			if t.Genre != "" {
+				tag.SetGenre(t.Genre)
+			}
 
-					r.reader = resp.BodyStream()
-					r.resp = resp
-					return c.SendStream(r)
-				}
+			tag.SetTitle(t.Title)
 
-				r := acquireReader()
-				tag.WriteTo(r)
-				r.req = req
-				r.resp = resp
-				err := r.Setup(u.Value.Playlist, false, nil)
-				if err != nil {
-					return err
-				}
+			if t.Artwork != "" {
+				req.SetRequestURI(t.Artwork)
 
-				return c.SendStream(r)
-			case cfg.AudioAAC:
-				r := acquireReader()
-				err := r.Setup(u.Value.Playlist, true, nil)
-				if err != nil {
-					return err
+				err := sc.DoWithRetry(image_httpc, req, resp)
+				if err == nil && resp.StatusCode() == 200 {
+					//fmt.Println(string(resp.Header.ContentType()), string(resp.Header.Peek("Content-Encoding")), len(resp.Body()))
+					tag.AddAttachedPicture(id3v2.PictureFrame{MimeType: cfg.B2s(resp.Header.ContentType()), Picture: resp.Body(), PictureType: id3v2.PTFrontCover, Encoding: id3v2.EncodingUTF8})
 				}
+			}
 
-				r.req.SetRequestURIBytes(r.parts[0])
-				err = sc.DoWithRetry(r.client, r.req, r.resp)
-				if err != nil {
-					return err
-				}
+			if tr.Format.Protocol == sc.ProtocolProgressive {
+				r := acquireInjector()
+				tag.WriteTo(r) // write out tag first because the buffers will be overwritten if you reuse the req/resp
 
-				r.index++
-				tag, err := mp4meta.ReadMP4(bytes.NewReader(r.resp.Body()))
+				req.SetURI(u.Value.Playlist)
+				// enforce streaming here!!
+				err := sc.DoWithRetry(misc.HlsStreamingOnlyClient, req, resp)
+				fasthttp.ReleaseRequest(req) // not needed for reading the body
 				if err != nil {
+					fasthttp.ReleaseResponse(resp)
+					r.release()
 					return err
 				}
 
-				tag.SetArtist(t.Author.Username)
-				if t.Genre != "" {
-					tag.SetGenre(t.Genre)
-				}
+				r.reader = resp.BodyStream()
+				r.resp = resp
+				return sendStream(c, r)
+			}
 
-				tag.SetTitle(t.Title)
+			r := acquireReader()
+			tag.WriteTo(r)
+			// the pooled reader might have its own already
+			if r.req != nil {
+				fasthttp.ReleaseRequest(r.req)
+				fasthttp.ReleaseResponse(r.resp)
+			}
+			r.req = req
+			r.resp = resp
+			err := r.Setup(u.Value.Playlist, false, nil, renew)
+			if err != nil {
+				r.release()
+				return err
+			}
 
-				if t.Artwork != "" {
-					r.req.SetRequestURI(t.Artwork)
+			return sendStream(c, r)
+		case cfg.AudioAAC:
+			r := acquireReader()
+			err := r.Setup(u.Value.Playlist, true, nil, renew)
+			if err != nil {
+				r.release()
+				return err
+			}
 
-					err := sc.DoWithRetry(misc.ImageStreamingOnlyClient, r.req, r.resp)
-					if err == nil && r.resp.StatusCode() == 200 {
-						parsed, _, err := image.Decode(r.resp.BodyStream())
-						r.resp.CloseBodyStream()
-						if err == nil {
-							tag.SetCoverArt(&parsed)
-						}
-					}
-				}
+			first, err := r.next()
+			if err != nil {
+				r.release()
+				return err
+			}
 
-				tag.Save(r)
-				fixDuration(r.leftover, &t.Duration)
+			r.index++
+			tag, err := mp4meta.ReadMP4(bytes.NewReader(first))
+			if err != nil {
+				r.release()
+				return err
+			}
 
-				return c.SendStream(r)
+			tag.SetArtist(t.Author.Username)
+			if t.Genre != "" {
+				tag.SetGenre(t.Genre)
 			}
-		}
 
-		// just the audio file itself, means less processing overhead for us :)
-		if tr.Format.Protocol == sc.ProtocolProgressive {
-			misc.Log("use progressive")
-			req := fasthttp.AcquireRequest()
-			defer fasthttp.ReleaseRequest(req)
+			tag.SetTitle(t.Title)
 
-			// if len(rng) != 0 {
-			// 	req.Header.SetBytesV("Range", rng)
-			// }
-			req.SetURI(u.Value.Playlist)
-			req.Header.SetUserAgent(cfg.UserAgent)
+			if t.Artwork != "" {
+				r.req.SetRequestURI(t.Artwork)
+
+				err := sc.DoWithRetry(misc.ImageStreamingOnlyClient, r.req, r.resp)
+				if err == nil && r.resp.StatusCode() == 200 {
+					parsed, _, err := image.Decode(r.resp.BodyStream())
+					r.resp.CloseBodyStream()
+					if err == nil {
+						tag.SetCoverArt(&parsed)
+					}
+				}
+			}
 
-			err = sc.DoWithRetry(misc.HlsStreamingOnlyClient, req, resp)
-			resp.Header.Set("Content-Disposition", `attachment; filename="`+t.Permalink+`.mp3"`)
-			resp.Header.Del("Accept-Ranges")
-			return err
-		}
+			tag.Save(r)
+			fixDuration(r.leftover, &t.Duration)
 
-		r := acquireReader()
-		if audio == cfg.AudioAAC {
-			err = r.Setup(u.Value.Playlist, true, &t.Duration)
-		} else {
-			err = r.Setup(u.Value.Playlist, false, nil)
+			return sendStream(c, r)
 		}
+	}
 
-		if err != nil {
-			return err
-		}
+	// just the audio file itself, means less processing overhead for us :)
+	if tr.Format.Protocol == sc.ProtocolProgressive {
+		misc.Log("use progressive")
+		req := fasthttp.AcquireRequest()
+		defer fasthttp.ReleaseRequest(req)
+
+		// if len(rng) != 0 {
+		// 	req.Header.SetBytesV("Range", rng)
+		// }
+		req.SetURI(u.Value.Playlist)
+		req.Header.SetUserAgent(cfg.UserAgent)
+
+		err = sc.DoWithRetry(misc.HlsStreamingOnlyClient, req, resp)
+		resp.Header.Set("Content-Disposition", `attachment; filename="`+t.Permalink+`.mp3"`)
+		resp.Header.Del("Accept-Ranges")
+		return err
+	}
 
-		return c.SendStream(r)
-	})
+	r := acquireReader()
+	if audio == cfg.AudioAAC {
+		err = r.Setup(u.Value.Playlist, true, &t.Duration, renew)
+	} else {
+		err = r.Setup(u.Value.Playlist, false, nil, renew)
+	}
+
+	if err != nil {
+		r.release()
+		return err
+	}
+
+	return sendStream(c, r)
 }
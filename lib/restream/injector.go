@@ -5,6 +5,8 @@ import (
 	"sync"
 
 	"github.com/valyala/fasthttp"
+
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
 )
 
 // inject some bytes before the real reader
@@ -46,12 +48,18 @@ func (r *injector) Close() error {
 	r.resp.CloseBodyStream()
 	fasthttp.ReleaseResponse(r.resp)
 
+	r.release()
+	metrics.RestreamReaders.Add(-1)
+	return nil
+}
+
+// Puts r back in the pool, without touching resp. Close does this too
+func (r *injector) release() {
 	r.reader = nil
 	r.resp = nil
 	r.leftover = r.leftover[:0]
 
 	injectorpool.Put(r)
-	return nil
 }
 
 func (c *injector) Write(data []byte) (n int, err error) {
@@ -4,11 +4,15 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"strconv"
 	"sync"
 
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
 	"git.maid.zone/stuff/soundcloak/lib/misc"
 	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/lib/segments"
+	"github.com/gofiber/fiber/v3"
 	"github.com/valyala/fasthttp"
 )
 
@@ -20,9 +24,36 @@ type reader struct {
 	req      *fasthttp.Request
 	resp     *fasthttp.Response
 	client   *fasthttp.HostClient
+	aac      bool
+	renew    func() (*fasthttp.URI, error)
 	parts    [][]byte
 	leftover []byte
 	index    int
+
+	fetches []*fetch // parts that are being downloaded, by index
+	header  *fasthttp.ResponseHeader
+}
+
+// Sent after the body when every part made it. If a part can't be downloaded (even after retrying), the response is cut off without the final chunk instead, so clients see the download as failed
+const statusTrailer = "X-Restream-Status"
+
+func (r *reader) trailer(resp *fasthttp.Response) {
+	if resp.Header.SetTrailer(statusTrailer) == nil {
+		r.header = &resp.Header
+	}
+}
+
+// called when Read returns io.EOF
+func (r *reader) done() {
+	if r.header != nil {
+		r.header.Set(statusTrailer, "complete")
+	}
+}
+
+type fetch struct {
+	done chan struct{}
+	data []byte
+	err  error
 }
 
 var readerpool = sync.Pool{
@@ -56,7 +87,8 @@ func fixDuration(data []byte, duration *uint32) {
 	}
 }
 
-func (r *reader) Setup(url *fasthttp.URI, aac bool, duration *uint32) error {
+// renew gets a new playlist url, for when the cdn stops accepting the old one mid-stream. Can be nil
+func (r *reader) Setup(url *fasthttp.URI, aac bool, duration *uint32, renew func() (*fasthttp.URI, error)) error {
 	if r.req == nil {
 		r.req = fasthttp.AcquireRequest()
 	}
@@ -65,29 +97,56 @@ func (r *reader) Setup(url *fasthttp.URI, aac bool, duration *uint32) error {
 		r.resp = fasthttp.AcquireResponse()
 	}
 
-	r.req.SetURI(url)
-	r.req.Header.SetUserAgent(cfg.UserAgent)
-
+	r.aac = aac
+	r.duration = duration
+	r.renew = renew
 	if aac {
 		r.client = misc.HlsAacClient
-		r.duration = duration
 	} else {
 		r.client = misc.HlsClient
 	}
 
-	err := sc.DoWithRetry(r.client, r.req, r.resp)
-	if err != nil {
-		return err
-	}
-
 	if r.parts == nil {
 		misc.Log("make() r.parts")
 		r.parts = make([][]byte, 0, defaultPartsCapacity)
 	} else {
 		misc.Log(cap(r.parts), len(r.parts))
 	}
+
+	err := r.load(url)
+	if err == segments.ErrExpired && renew != nil {
+		url, err = renew()
+		if err != nil {
+			return err
+		}
+
+		err = r.load(url)
+	}
+
+	return err
+}
+
+// Gets the playlist and puts the parts in r.parts
+func (r *reader) load(url *fasthttp.URI) error {
+	r.req.SetURI(url)
+	r.req.Header.SetUserAgent(cfg.UserAgent)
+
+	err := sc.DoWithRetry(r.client, r.req, r.resp)
+	if err != nil {
+		return err
+	}
+
+	if segments.Expired(r.resp.StatusCode()) {
+		return segments.ErrExpired
+	}
+
+	if r.resp.StatusCode() != 200 {
+		return fiber.NewError(fiber.StatusBadGateway, "playlist request failed with status "+strconv.Itoa(r.resp.StatusCode()))
+	}
+
+	r.parts = r.parts[:0]
 	// clone needed to mitigate memory skill issues smh
-	if aac {
+	if r.aac {
 		for s := range bytes.SplitSeq(r.resp.Body(), newline) {
 			if len(s) == 0 {
 				continue
@@ -117,22 +176,79 @@ func (r *reader) Setup(url *fasthttp.URI, aac bool, duration *uint32) error {
 	return nil
 }
 
+// the part url without the signature
+func partPath(p []byte) []byte {
+	if i := bytes.IndexByte(p, '?'); i != -1 {
+		return p[:i]
+	}
+
+	return p
+}
+
+// Gets a new playlist, and finds the current part in it again. The parts that were being downloaded are dropped
+func (r *reader) renewParts() error {
+	misc.Log("renewing stream url")
+	url, err := r.renew()
+	if err != nil {
+		return err
+	}
+
+	current := partPath(r.parts[r.index]) // parts are cloned, so this survives load
+	count := len(r.parts)
+	err = r.load(url)
+	if err != nil {
+		return err
+	}
+
+	clear(r.fetches)
+	for i, p := range r.parts {
+		if bytes.Equal(partPath(p), current) {
+			r.index = i
+			return nil
+		}
+	}
+
+	// the paths changed, but it's the same track, so the parts should line up
+	if len(r.parts) != count {
+		return fiber.NewError(fiber.StatusBadGateway, "stream changed after renewing")
+	}
+
+	return nil
+}
+
 func (r *reader) Close() error {
 	misc.Log("closed :D")
+	r.release()
+	metrics.RestreamReaders.Add(-1)
+	return nil
+}
+
+// Puts r back in the pool. Close does this too, use it directly only if r never got to sendStream
+func (r *reader) release() {
 	r.req.Reset()
 	r.resp.Reset()
 
 	r.leftover = r.leftover[:0]
 	r.index = 0
+	r.renew = nil
+	r.header = nil
 	r.parts = r.parts[:0]
+	// the downloads that are still going finish on their own (and end up in the segment cache)
+	clear(r.fetches)
+	r.fetches = r.fetches[:0]
 
 	readerpool.Put(r)
-	return nil
 }
 
 // I have no idea what this truly even does anymore. Maybe a rewrite/refactor would be good?
 func (r *reader) Read(buf []byte) (n int, err error) {
 	misc.Log("we read")
+	defer func() {
+		if err == io.EOF {
+			r.done()
+		}
+	}()
+
 	if len(r.leftover) != 0 {
 		h := min(len(buf), len(r.leftover))
 
@@ -156,25 +272,19 @@ func (r *reader) Read(buf []byte) (n int, err error) {
 		return
 	}
 
-	r.req.SetRequestURIBytes(r.parts[r.index])
-
-	err = sc.DoWithRetry(r.client, r.req, r.resp)
+	data, err := r.next()
 	if err != nil {
 		return
 	}
 
-	data := r.resp.Body()
+	// copy, since the data is shared with the segment cache
+	r.leftover = append(r.leftover[:0], data...)
 	if r.index == 0 && r.duration != nil {
-		fixDuration(data, r.duration) // I'm guessing that mvhd will always be in first part
-	}
-
-	if len(data) > len(buf) {
-		n = copy(buf, data[:len(buf)])
-	} else {
-		n = copy(buf, data)
+		fixDuration(r.leftover, r.duration) // I'm guessing that mvhd will always be in first part
 	}
 
-	r.leftover = data[n:]
+	n = copy(buf, r.leftover)
+	r.leftover = r.leftover[n:]
 	r.index++
 
 	if n < len(buf) && r.index == len(r.parts) {
@@ -184,6 +294,62 @@ func (r *reader) Read(buf []byte) (n int, err error) {
 	return
 }
 
+// Returns the current part, renewing the stream url if it expired
+func (r *reader) next() ([]byte, error) {
+	data, err := r.current()
+	if err == segments.ErrExpired && r.renew != nil {
+		err = r.renewParts()
+		if err != nil {
+			return nil, err
+		}
+
+		// only once, so a track that's really gone doesn't loop forever
+		data, err = r.current()
+	}
+
+	return data, err
+}
+
+// Waits for the current part, and starts downloading the next RestreamPrefetch ones
+func (r *reader) current() ([]byte, error) {
+	if len(r.fetches) != len(r.parts) {
+		r.fetches = append(r.fetches[:0], make([]*fetch, len(r.parts))...)
+	}
+
+	for i := r.index; i < min(len(r.parts), r.index+1+max(cfg.RestreamPrefetch, 0)); i++ {
+		if r.fetches[i] == nil {
+			r.fetches[i] = r.start(i)
+		}
+	}
+
+	f := r.fetches[r.index]
+	r.fetches[r.index] = nil
+	<-f.done
+	return f.data, f.err
+}
+
+func (r *reader) start(i int) *fetch {
+	f := &fetch{done: make(chan struct{})}
+
+	u := fasthttp.AcquireURI()
+	err := u.Parse(nil, r.parts[i])
+	if err != nil {
+		fasthttp.ReleaseURI(u)
+		f.err = err
+		close(f.done)
+		return f
+	}
+
+	cl := r.client
+	go func() {
+		f.data, _, f.err = segments.Get(cl, u)
+		fasthttp.ReleaseURI(u)
+		close(f.done)
+	}()
+
+	return f
+}
+
 func (c *reader) Write(data []byte) (n int, err error) {
 	c.leftover = append(c.leftover, data...)
 	return len(data), nil
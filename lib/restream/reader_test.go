@@ -0,0 +1,174 @@
+package restream
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+
+	"git.maid.zone/stuff/soundcloak/lib/misc"
+)
+
+func segment(b byte) []byte {
+	return append([]byte{0xFF, 0xFB, 0x90, 0x64}, bytes.Repeat([]byte{b}, 1000)...)
+}
+
+func playlist(parts ...string) []byte {
+	p := "#EXTM3U\n#EXT-X-TARGETDURATION:10\n"
+	for _, part := range parts {
+		p += "#EXTINF:10.0,\nhttp://fake-cdn/" + part + "\n"
+	}
+
+	return []byte(p + "#EXT-X-ENDLIST\n")
+}
+
+// good playlist, and one with a segment the cdn only has an error page for
+func fakeCDN(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	s := &fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/good.m3u8":
+			ctx.SetContentType("application/vnd.apple.mpegurl")
+			ctx.SetBody(playlist("a.mp3", "b.mp3", "c.mp3"))
+		case "/bad.m3u8":
+			ctx.SetContentType("application/vnd.apple.mpegurl")
+			ctx.SetBody(playlist("a.mp3", "missing.mp3", "c.mp3"))
+		case "/a.mp3":
+			ctx.SetContentType("audio/mpeg")
+			ctx.SetBody(segment('a'))
+		case "/b.mp3":
+			ctx.SetContentType("audio/mpeg")
+			ctx.SetBody(segment('b'))
+		case "/c.mp3":
+			ctx.SetContentType("audio/mpeg")
+			ctx.SetBody(segment('c'))
+		default:
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetContentType("text/html")
+			ctx.SetBodyString("<html><body><h1>404 Not Found</h1>" + string(bytes.Repeat([]byte("<p>nope</p>"), 20)) + "</body></html>")
+		}
+	}}
+	go s.Serve(ln)
+
+	old := misc.HlsClient
+	misc.HlsClient = &fasthttp.HostClient{
+		Addr: "fake-cdn",
+		Dial: func(string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	t.Cleanup(func() {
+		misc.HlsClient = old
+		s.Shutdown()
+	})
+}
+
+func uri(t *testing.T, p string) *fasthttp.URI {
+	u := fasthttp.AcquireURI()
+	t.Cleanup(func() {
+		fasthttp.ReleaseURI(u)
+	})
+
+	err := u.Parse(nil, []byte("http://fake-cdn"+p))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+var complete = bytes.Join([][]byte{segment('a'), segment('b'), segment('c')}, nil)
+
+func TestRead(t *testing.T) {
+	fakeCDN(t)
+
+	r := acquireReader()
+	err := r.Setup(uri(t, "/good.m3u8"), false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(r)
+	r.release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, complete) {
+		t.Errorf("got %d bytes, want %d", len(data), len(complete))
+	}
+
+	r = acquireReader()
+	err = r.Setup(uri(t, "/bad.m3u8"), false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = io.ReadAll(r)
+	r.release()
+	if err == nil {
+		t.Fatal("read the whole thing with a missing segment")
+	}
+
+	// only what came before the bad segment, no error page
+	if !bytes.Equal(data, segment('a')) {
+		t.Errorf("got %d bytes before the error, want %d", len(data), len(segment('a')))
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	fakeCDN(t)
+
+	app := fiber.New()
+	app.Get("/:playlist", func(c fiber.Ctx) error {
+		r := acquireReader()
+		err := r.Setup(uri(t, "/"+c.Params("playlist")), false, nil, nil)
+		if err != nil {
+			r.release()
+			return err
+		}
+
+		return sendStream(c, r)
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/good.m3u8", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, complete) {
+		t.Errorf("got %d bytes, want %d", len(data), len(complete))
+	}
+
+	if s := resp.Trailer.Get(statusTrailer); s != "complete" {
+		t.Errorf("got %s %q, want complete", statusTrailer, s)
+	}
+
+	// cut off without the final chunk, so app.Test or reading the body fails
+	resp, err = app.Test(httptest.NewRequest("GET", "/bad.m3u8", nil))
+	if err == nil {
+		data, err = io.ReadAll(resp.Body)
+		if bytes.Contains(data, []byte("html")) {
+			t.Error("error page in the response")
+		}
+
+		if s := resp.Trailer.Get(statusTrailer); s != "" {
+			t.Errorf("got %s %q on a cut off response", statusTrailer, s)
+		}
+	}
+
+	if err == nil {
+		t.Error("response with a missing segment ended cleanly")
+	}
+}
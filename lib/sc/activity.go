@@ -0,0 +1,151 @@
+package sc
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
+)
+
+// Functions/structures related to the local "following" stream (uploads and reposts of a bunch of users merged together)
+
+var ActivityCache = map[string]cached[[]Activity]{}
+var activityCacheLock = &sync.RWMutex{}
+
+type Activity struct {
+	Track    *Track    `json:",omitempty"`
+	Playlist *Playlist `json:",omitempty"`
+	Reposter *User     `json:",omitempty"` // nil if it's an upload
+	Time     time.Time
+}
+
+// cached activity doesn't have proxied images, Postfix is done on the way out
+var rawPrefs = cfg.Preferences{ProxyImages: &cfg.False}
+
+// Latest uploads and reposts of the user
+func (u User) GetActivity() ([]Activity, error) {
+	activityCacheLock.RLock()
+	if cell, ok := ActivityCache[u.Permalink]; ok && cell.Expires.After(time.Now()) {
+		activityCacheLock.RUnlock()
+		metrics.Cache("activity", true)
+		return cell.Value, nil
+	}
+	activityCacheLock.RUnlock()
+	metrics.Cache("activity", false)
+
+	tracks, err := u.GetTracks(rawPrefs, "limit=20")
+	if err != nil {
+		return nil, err
+	}
+
+	reposts, err := u.GetReposts(rawPrefs, "limit=20")
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Activity, 0, len(tracks.Collection)+len(reposts.Collection))
+	for _, track := range tracks.Collection {
+		res = append(res, Activity{Track: track, Time: t(track.CreatedAt)})
+	}
+
+	for _, r := range reposts.Collection {
+		a := Activity{Reposter: &u, Time: t(r.CreatedAt)}
+		if r.Type == TrackRepost && r.Track != nil {
+			a.Track = r.Track
+		} else if r.Type == PlaylistRepost && r.Playlist != nil {
+			a.Playlist = r.Playlist
+		} else {
+			continue
+		}
+
+		res = append(res, a)
+	}
+
+	activityCacheLock.Lock()
+	ActivityCache[u.Permalink] = cached[[]Activity]{Value: res, Expires: time.Now().Add(cfg.UserTTL)}
+	activityCacheLock.Unlock()
+
+	return res, nil
+}
+
+// Copies the track/playlist, since cached ones are shared
+func (a *Activity) Postfix(prefs cfg.Preferences) {
+	if a.Track != nil {
+		t := *a.Track
+		t.Postfix(prefs, false)
+		a.Track = &t
+	}
+
+	if a.Playlist != nil {
+		p := *a.Playlist
+		p.Postfix(prefs, false, false)
+		a.Playlist = &p
+	}
+}
+
+// Merged activity of all the users, newest first. Users are fetched concurrently, failed ones are skipped
+func GetFollowingActivity(permalinks []string) []Activity {
+	res := []Activity{}
+	lock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	sem := make(chan struct{}, 8) // don't hammer soundcloud too hard
+
+	for _, permalink := range permalinks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			u, err := GetUser(permalink)
+			if err != nil {
+				logger.Warn("error getting user (following)", logging.Private("user", permalink), logging.Err(err))
+				return
+			}
+
+			a, err := u.GetActivity()
+			if err != nil {
+				logger.Warn("error getting user activity (following)", logging.Private("user", permalink), logging.Err(err))
+				return
+			}
+
+			lock.Lock()
+			res = append(res, filterBlocked(a)...)
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	slices.SortStableFunc(res, func(a, b Activity) int {
+		return b.Time.Compare(a.Time)
+	})
+
+	return res
+}
+
+func GenerateFollowingFeed(ctx context.Context, prefs cfg.Preferences, base string, permalinks []string, audio string) (*Feed, error) {
+	activity := GetFollowingActivity(permalinks)
+	f := Feed{
+		Title:       "soundcloak feed",
+		Description: "Uploads and reposts from " + strconv.Itoa(len(permalinks)) + " users",
+		Link:        base + "/feed",
+		Category:    "Music",
+	}
+
+	for _, a := range activity[:min(len(activity), 50)] {
+		a.Postfix(prefs)
+		if a.Track != nil {
+			f.addTrack(ctx, prefs, base, a.Track, audio)
+		} else {
+			f.addPlaylist(ctx, prefs, base, a.Playlist)
+		}
+	}
+	f.updated("")
+
+	return &f, nil
+}
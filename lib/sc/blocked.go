@@ -0,0 +1,117 @@
+package sc
+
+import (
+	"errors"
+	"slices"
+
+	"git.maid.zone/stuff/soundcloak/lib/blocklist"
+)
+
+// Takedowns. Lookups return ErrBlocked for blocked stuff, and blocked items are dropped from collections, see lib/blocklist
+
+var ErrBlocked = errors.New("blocked on this instance")
+
+func init() {
+	// feeds are cached whole, so they could still have the blocked stuff in them
+	blocklist.OnReload(func() {
+		ClearCache("feeds")
+	})
+}
+
+type blockable interface {
+	Blocked() bool
+}
+
+func (t Track) Blocked() bool {
+	return blocklist.Track(string(t.ID)) ||
+		blocklist.User(string(t.Author.ID)) ||
+		(t.Author.Permalink != "" && blocklist.Permalink(t.Author.Permalink+"/"+t.Permalink))
+}
+
+func (u User) Blocked() bool {
+	return blocklist.User(string(u.ID)) || (u.Permalink != "" && blocklist.Permalink(u.Permalink))
+}
+
+func (p Playlist) Blocked() bool {
+	if p.Kind == "system-playlist" {
+		return blocklist.Playlist(string(p.ID))
+	}
+
+	return blocklist.Playlist(string(p.ID)) ||
+		blocklist.User(string(p.Author.ID)) ||
+		(p.Author.Permalink != "" && blocklist.Permalink(p.Author.Permalink+"/sets/"+p.Permalink))
+}
+
+func (p UserPlaylistTrack) Blocked() bool {
+	switch p.Kind {
+	case "user":
+		return blocklist.User(string(p.ID)) || blocklist.Permalink(p.Permalink)
+	case "track":
+		return blocklist.Track(string(p.ID)) || blocklist.Permalink(p.Href())
+	case "playlist":
+		return blocklist.Playlist(string(p.ID)) || blocklist.Permalink(p.Href())
+	default:
+		return blocklist.Playlist(string(p.ID))
+	}
+}
+
+func (r Repost) Blocked() bool {
+	return (r.Track != nil && r.Track.Blocked()) || (r.Playlist != nil && r.Playlist.Blocked())
+}
+
+func (l Like) Blocked() bool {
+	return (l.Track != nil && l.Track.Blocked()) || (l.Playlist != nil && l.Playlist.Blocked())
+}
+
+func (c Comment) Blocked() bool {
+	return c.Author.Blocked()
+}
+
+func (a Activity) Blocked() bool {
+	return (a.Track != nil && a.Track.Blocked()) || (a.Playlist != nil && a.Playlist.Blocked()) || (a.Reposter != nil && a.Reposter.Blocked())
+}
+
+// Returns a new slice if anything was removed, so cached slices aren't touched
+func filterBlocked[T any](l []T) []T {
+	if blocklist.Empty() {
+		return l
+	}
+
+	i := slices.IndexFunc(l, isBlocked[T])
+	if i == -1 {
+		return l
+	}
+
+	res := slices.Clone(l[:i])
+	for _, v := range l[i+1:] {
+		if !isBlocked(v) {
+			res = append(res, v)
+		}
+	}
+
+	return res
+}
+
+func isBlocked[T any](v T) bool {
+	if b, ok := any(v).(blockable); ok {
+		return b.Blocked()
+	}
+
+	return false
+}
+
+// For stuff that only goes through the stream cache (like hls segments). Also checks the cached track, if there is one
+func TrackBlocked(permalink string) bool {
+	if blocklist.Empty() {
+		return false
+	}
+
+	if blocklist.Permalink(permalink) {
+		return true
+	}
+
+	tracksCacheLock.RLock()
+	cell, ok := TracksCache[permalink]
+	tracksCacheLock.RUnlock()
+	return ok && cell.Value.Blocked()
+}
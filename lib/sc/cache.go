@@ -0,0 +1,137 @@
+package sc
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Looking into and purging caches, for metrics and the admin panel
+
+type CacheInfo struct {
+	Name    string
+	Entries int
+	Expired int // not cleaned up yet
+}
+
+type CacheEntry struct {
+	Key     string
+	Expires time.Time
+}
+
+type cacheRef interface {
+	info(name string) CacheInfo
+	entries() []CacheEntry
+	purge(key string) bool
+	clear() int
+}
+
+type cacheOf[T any] struct {
+	lock *sync.RWMutex
+	m    *map[string]cached[T]
+}
+
+func (c cacheOf[T]) info(name string) CacheInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	i := CacheInfo{Name: name, Entries: len(*c.m)}
+	now := time.Now()
+	for _, v := range *c.m {
+		if v.Expires.Before(now) {
+			i.Expired++
+		}
+	}
+
+	return i
+}
+
+func (c cacheOf[T]) entries() []CacheEntry {
+	c.lock.RLock()
+	e := make([]CacheEntry, 0, len(*c.m))
+	for k, v := range *c.m {
+		e = append(e, CacheEntry{k, v.Expires})
+	}
+	c.lock.RUnlock()
+
+	slices.SortFunc(e, func(a, b CacheEntry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return e
+}
+
+func (c cacheOf[T]) purge(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := (*c.m)[key]
+	delete(*c.m, key)
+	return ok
+}
+
+// stream urls in there might still be in use, so no releasing them back to the pool here
+func (c cacheOf[T]) clear() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	n := len(*c.m)
+	*c.m = map[string]cached[T]{}
+	return n
+}
+
+// keys: users and activity are user permalinks, tracks are user/track, playlists are user/sets/playlist
+var caches = map[string]cacheRef{
+	"users":     cacheOf[User]{usersCacheLock, &UsersCache},
+	"activity":  cacheOf[[]Activity]{activityCacheLock, &ActivityCache},
+	"tracks":    cacheOf[Track]{tracksCacheLock, &TracksCache},
+	"streams":   cacheOf[CachedStream]{&StreamCacheMut, &StreamCache},
+	"playlists": cacheOf[Playlist]{playlistsCacheLock, &PlaylistsCache},
+	"feeds":     cacheOf[SerializedFeed]{feedsCacheLock, &FeedsCache},
+}
+
+func Caches() []CacheInfo {
+	l := make([]CacheInfo, 0, len(caches))
+	for name, c := range caches {
+		l = append(l, c.info(name))
+	}
+
+	slices.SortFunc(l, func(a, b CacheInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return l
+}
+
+func CacheEntries(name string) ([]CacheEntry, bool) {
+	c, ok := caches[name]
+	if !ok {
+		return nil, false
+	}
+
+	return c.entries(), true
+}
+
+// Removes one entry. Purging a user also drops their activity
+func Purge(name string, key string) bool {
+	c, ok := caches[name]
+	if !ok {
+		return false
+	}
+
+	ok = c.purge(key)
+	if name == "users" {
+		ok = caches["activity"].purge(key) || ok
+	}
+
+	return ok
+}
+
+// Removes everything from the cache, returns how many entries there were
+func ClearCache(name string) (int, bool) {
+	c, ok := caches[name]
+	if !ok {
+		return 0, false
+	}
+
+	return c.clear(), true
+}
@@ -0,0 +1,123 @@
+package sc
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+)
+
+// Circuit breaker per upstream (see metrics.Upstream). Only failed requests count (can't connect, timeouts...), soundcloud answering with an error status is fine here.
+// After CircuitBreakerThreshold failures in a row it opens: requests fail right away for CircuitBreakerCooldown, instead of piling up and hanging until they time out.
+// Then one request is let through (half-open), if that works the circuit closes again, otherwise it stays open for another cooldown.
+// With Prefork, every process has its own circuits
+
+var ErrCircuitOpen = fiber.NewError(fiber.StatusServiceUnavailable, "soundcloud can't be reached right now, try again later")
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+type circuit struct {
+	failures int
+	opened   time.Time // zero if closed
+	probing  bool      // a request was let through after the cooldown
+}
+
+var circuitsLock sync.Mutex
+var circuits = map[string]*circuit{}
+
+// if a request to upstream can go ahead
+func allow(upstream string) bool {
+	if cfg.CircuitBreakerThreshold <= 0 {
+		return true
+	}
+
+	circuitsLock.Lock()
+	defer circuitsLock.Unlock()
+
+	c, ok := circuits[upstream]
+	if !ok || c.opened.IsZero() {
+		return true
+	}
+
+	if c.probing || time.Since(c.opened) < cfg.CircuitBreakerCooldown {
+		return false
+	}
+
+	c.probing = true
+	return true
+}
+
+// result of a request that allow let through
+func record(upstream string, err error) {
+	if cfg.CircuitBreakerThreshold <= 0 {
+		return
+	}
+
+	circuitsLock.Lock()
+	defer circuitsLock.Unlock()
+
+	c, ok := circuits[upstream]
+	if err == nil {
+		if ok && !c.opened.IsZero() {
+			logger.Info("upstream works again, closing circuit", "upstream", upstream)
+		}
+
+		delete(circuits, upstream)
+		return
+	}
+
+	if !ok {
+		c = &circuit{}
+		circuits[upstream] = c
+	}
+
+	c.failures++
+	if c.probing || (c.opened.IsZero() && c.failures >= cfg.CircuitBreakerThreshold) {
+		if !c.probing {
+			logger.Warn("upstream keeps failing, opening circuit", "upstream", upstream, "failures", c.failures, "cooldown", cfg.CircuitBreakerCooldown)
+		}
+
+		c.opened = time.Now()
+		c.probing = false
+	}
+}
+
+type CircuitInfo struct {
+	Upstream string
+	State    string
+	Failures int       // in a row
+	Opened   time.Time // zero if closed
+}
+
+// Upstreams that failed at least once since they last worked
+func Circuits() []CircuitInfo {
+	circuitsLock.Lock()
+	defer circuitsLock.Unlock()
+
+	l := make([]CircuitInfo, 0, len(circuits))
+	for name, c := range circuits {
+		i := CircuitInfo{Upstream: name, State: CircuitClosed, Failures: c.failures, Opened: c.opened}
+		if !c.opened.IsZero() {
+			i.State = CircuitOpen
+			if c.probing || time.Since(c.opened) >= cfg.CircuitBreakerCooldown {
+				i.State = CircuitHalfOpen
+			}
+		}
+
+		l = append(l, i)
+	}
+
+	slices.SortFunc(l, func(a, b CircuitInfo) int {
+		return strings.Compare(a.Upstream, b.Upstream)
+	})
+
+	return l
+}
@@ -0,0 +1,215 @@
+package sc
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+)
+
+// Playlist files for desktop players (mpv, VLC, foobar2000...). Entries point to the same stream urls as feed enclosures
+
+const (
+	ExportM3U8 = "m3u8"
+	ExportXSPF = "xspf"
+	ExportPLS  = "pls"
+)
+
+var ExportContentTypes = map[string]string{
+	ExportM3U8: "audio/x-mpegurl",
+	ExportXSPF: "application/xspf+xml",
+	ExportPLS:  "audio/x-scpls",
+}
+
+// how many tracks to put in exports of users and tags (one request)
+const exportLimit = "limit=200"
+
+type ExportEntry struct {
+	URL      string
+	Title    string
+	Artist   string
+	Link     string
+	Image    string
+	Duration uint32 // ms
+}
+
+type Export struct {
+	Title   string
+	Link    string
+	Entries []ExportEntry
+}
+
+// Same as FeedFormat, but for playlist files
+func ExportFormat(s string) (string, string) {
+	if i := strings.LastIndexByte(s, '.'); i != -1 {
+		switch s[i+1:] {
+		case ExportM3U8, "m3u":
+			return s[:i], ExportM3U8
+		case ExportXSPF:
+			return s[:i], ExportXSPF
+		case ExportPLS:
+			return s[:i], ExportPLS
+		}
+	}
+
+	return s, ""
+}
+
+// track should be Postfix'd already. Tracks which can't be streamed are skipped
+func (e *Export) addTrack(prefs cfg.Preferences, base string, t *Track, audio string) {
+	if t.Title == "" {
+		return
+	}
+
+	href := t.Href()
+	enc := enclosure(base, href, t, audio)
+	if enc == nil {
+		return
+	}
+
+	e.Entries = append(e.Entries, ExportEntry{
+		URL:      enc.URL,
+		Title:    t.Title,
+		Artist:   t.Author.Username,
+		Link:     base + href,
+		Image:    feedImage(prefs, base, t.Artwork),
+		Duration: t.Duration,
+	})
+}
+
+func (e *Export) Marshal(format string) ([]byte, error) {
+	switch format {
+	case ExportXSPF:
+		return e.XSPF()
+	case ExportPLS:
+		return e.PLS(), nil
+	}
+
+	return e.M3U8(), nil
+}
+
+// newlines would break line-based formats
+var oneLine = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+func (e *Export) M3U8() []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n#PLAYLIST:" + oneLine.Replace(e.Title) + "\n")
+	for _, en := range e.Entries {
+		b.WriteString("#EXTINF:" + strconv.FormatUint(uint64(en.Duration/1000), 10) + "," + oneLine.Replace(en.Artist+" - "+en.Title) + "\n")
+		b.WriteString(en.URL + "\n")
+	}
+
+	return b.Bytes()
+}
+
+func (e *Export) PLS() []byte {
+	var b bytes.Buffer
+	b.WriteString("[playlist]\n")
+	for i, en := range e.Entries {
+		n := strconv.Itoa(i + 1)
+		b.WriteString("File" + n + "=" + en.URL + "\n")
+		b.WriteString("Title" + n + "=" + oneLine.Replace(en.Artist+" - "+en.Title) + "\n")
+		b.WriteString("Length" + n + "=" + strconv.FormatUint(uint64(en.Duration/1000), 10) + "\n")
+	}
+	b.WriteString("NumberOfEntries=" + strconv.Itoa(len(e.Entries)) + "\nVersion=2\n")
+
+	return b.Bytes()
+}
+
+type XSPFPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Version string      `xml:"version,attr"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	Title   string      `xml:"title"`
+	Info    string      `xml:"info,omitempty"`
+	Tracks  []XSPFTrack `xml:"trackList>track"`
+}
+
+type XSPFTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title"`
+	Creator  string `xml:"creator"`
+	Duration uint32 `xml:"duration,omitempty"` // ms
+	Image    string `xml:"image,omitempty"`
+	Info     string `xml:"info,omitempty"`
+}
+
+func (e *Export) XSPF() ([]byte, error) {
+	x := XSPFPlaylist{Version: "1", XMLNS: "http://xspf.org/ns/0/", Title: e.Title, Info: e.Link, Tracks: make([]XSPFTrack, len(e.Entries))}
+	for i, en := range e.Entries {
+		x.Tracks[i] = XSPFTrack{Location: en.URL, Title: en.Title, Creator: en.Artist, Duration: en.Duration, Image: en.Image, Info: en.Link}
+	}
+
+	data, err := xml.Marshal(x)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), data...), nil
+}
+
+// Generators
+
+// Whole playlist, missing tracks are loaded here
+func (p Playlist) Export(prefs cfg.Preferences, base string, audio string) (*Export, error) {
+	err := p.GetAllMissingTracks()
+	if err != nil {
+		return nil, err
+	}
+
+	e := Export{Title: p.Title + " by " + p.Author.Username, Link: base + p.Href()}
+	for _, t := range p.Tracks {
+		t.Postfix(prefs, false)
+		e.addTrack(prefs, base, &t, audio)
+	}
+
+	return &e, nil
+}
+
+func (u User) ExportTracks(prefs cfg.Preferences, base string, audio string) (*Export, error) {
+	tracks, err := u.GetTracks(prefs, exportLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Export{Title: "Tracks from " + u.Username, Link: base + "/" + u.Permalink}
+	for _, t := range tracks.Collection {
+		e.addTrack(prefs, base, t, audio)
+	}
+
+	return &e, nil
+}
+
+// Only tracks, liked playlists are skipped
+func (u User) ExportLikes(prefs cfg.Preferences, base string, audio string) (*Export, error) {
+	likes, err := u.GetLikes(prefs, exportLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Export{Title: "Likes from " + u.Username, Link: base + "/" + u.Permalink + "/likes"}
+	for _, l := range likes.Collection {
+		if l.Track != nil {
+			e.addTrack(prefs, base, l.Track, audio)
+		}
+	}
+
+	return &e, nil
+}
+
+func ExportTag(prefs cfg.Preferences, base string, tag string, audio string) (*Export, error) {
+	tracks, err := RecentTracks(prefs, tag, exportLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	e := Export{Title: "Recent tracks tagged " + tag, Link: base + "/tags/" + url.PathEscape(tag)}
+	for _, t := range tracks.Collection {
+		e.addTrack(prefs, base, t, audio)
+	}
+
+	return &e, nil
+}
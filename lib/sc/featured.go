@@ -32,6 +32,7 @@ func GetSelections(prefs cfg.Preferences) (*Paginated[*Selection], error) {
 }
 
 func (s *Selection) Fix(prefs cfg.Preferences) {
+	s.Items.Collection = filterBlocked(s.Items.Collection)
 	for _, p := range s.Items.Collection {
 		p.Fix(prefs)
 	}
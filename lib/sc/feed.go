@@ -0,0 +1,487 @@
+package sc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
+	"github.com/goccy/go-json"
+)
+
+// Format-agnostic feed. Generators fill it once, then it gets serialized into whatever the client asked for
+
+const (
+	FeedRSS  = "rss"
+	FeedAtom = "atom"
+	FeedJSON = "json"
+)
+
+var FeedContentTypes = map[string]string{
+	FeedRSS:  "application/rss+xml",
+	FeedAtom: "application/atom+xml",
+	FeedJSON: "application/feed+json",
+}
+
+// Serialized feeds, so popular ones don't get regenerated on every poll
+var FeedsCache = map[string]cached[SerializedFeed]{}
+var feedsCacheLock = &sync.RWMutex{}
+
+type SerializedFeed struct {
+	Data      []byte
+	ETag      string    // hash of Data, changes whenever anything in the feed does
+	Updated   time.Time // newest item
+	Generated time.Time // when Data last changed, for Last-Modified
+	Expires   time.Time
+}
+
+type FeedAuthor struct {
+	Name   string
+	Handle string // permalink
+	URL    string
+	Avatar string
+}
+
+type FeedEnclosure struct {
+	URL    string
+	Type   string
+	Length int64
+}
+
+type FeedItem struct {
+	ID        string
+	Title     string
+	Link      string
+	Content   string // html
+	Category  string
+	Image     string
+	Published time.Time
+	Updated   time.Time
+	Duration  uint32 // ms, 0 if not audio
+	Author    FeedAuthor
+	Enclosure *FeedEnclosure
+}
+
+type Feed struct {
+	Title       string
+	Description string
+	Link        string // page this feed is for
+	Self        string // the feed itself, without extension (set by whoever serves it)
+	Query       string // query string of the feed url, if any
+	Category    string
+	Image       string
+	Updated     time.Time
+	TTL         time.Duration // how long readers can keep it for
+	Author      FeedAuthor
+	Items       []*FeedItem
+}
+
+// Get a serialized feed from cache, or generate it. Key should cover everything that changes the output (url, format, preferences)
+func GetFeed(key string, format string, generate func() (*Feed, error)) (SerializedFeed, error) {
+	feedsCacheLock.RLock()
+	if cell, ok := FeedsCache[key]; ok && cell.Expires.After(time.Now()) {
+		feedsCacheLock.RUnlock()
+		metrics.Cache("feeds", true)
+		return cell.Value, nil
+	}
+	feedsCacheLock.RUnlock()
+	metrics.Cache("feeds", false)
+
+	f, err := generate()
+	if err != nil {
+		return SerializedFeed{}, err
+	}
+
+	f.TTL = cfg.FeedTTL
+	data, err := f.Marshal(format)
+	if err != nil {
+		return SerializedFeed{}, err
+	}
+
+	sum := sha256.Sum256(data)
+	s := SerializedFeed{Data: data, ETag: hex.EncodeToString(sum[:12]), Updated: f.Updated, Generated: time.Now().Truncate(time.Second), Expires: time.Now().Add(cfg.FeedTTL)}
+	feedsCacheLock.Lock()
+	// same feed as last time, so readers that already have it can keep getting 304s
+	if cell, ok := FeedsCache[key]; ok && cell.Value.ETag == s.ETag {
+		s.Generated = cell.Value.Generated
+	}
+	FeedsCache[key] = cached[SerializedFeed]{Value: s, Expires: s.Expires}
+	feedsCacheLock.Unlock()
+
+	return s, nil
+}
+
+// Marshal the feed into one of the formats (FeedRSS, FeedAtom, FeedJSON)
+func (f *Feed) Marshal(format string) ([]byte, error) {
+	switch format {
+	case FeedAtom:
+		return f.Atom()
+	case FeedJSON:
+		return f.JSON()
+	default:
+		return f.RSS()
+	}
+}
+
+// podcast-friendly, with itunes tags
+func (f *Feed) RSS() ([]byte, error) {
+	r := RssFeed{
+		Title:       f.Title,
+		Link:        f.Link,
+		Description: f.Description,
+		Category:    f.Category,
+		Generator:   "soundcloak",
+		Ttl:         int(f.TTL / time.Minute), // in minutes
+
+		ItunesAuthor: f.Author.Name,
+	}
+
+	if f.Author.Name != "" {
+		r.ManagingEditor = f.Author.Name + " (@" + f.Author.Handle + ")"
+	}
+
+	if f.Category != "" {
+		r.ItunesCategory = &ItunesCategory{Text: f.Category}
+	}
+
+	if f.Image != "" {
+		r.Image = &RssImage{Url: f.Image, Title: f.Title, Link: f.Link}
+		r.ItunesImage = &ItunesImage{Href: f.Image}
+	}
+
+	if !f.Updated.IsZero() {
+		r.LastBuildDate = f.Updated.Format(time.RFC1123Z)
+		r.PubDate = r.LastBuildDate
+	}
+
+	for _, i := range f.Items {
+		item := RssItem{
+			Title:       i.Title,
+			Link:        i.Link,
+			Description: i.Content,
+			Category:    i.Category,
+			Guid:        &RssGuid{Id: i.ID, IsPermaLink: "false"},
+
+			ItunesAuthor: i.Author.Name,
+		}
+
+		if !i.Updated.IsZero() {
+			item.PubDate = i.Updated.Format(time.RFC1123Z)
+		}
+
+		if i.Image != "" {
+			item.ItunesImage = &ItunesImage{Href: i.Image}
+		}
+
+		if i.Duration != 0 {
+			s := i.Duration / 1000
+			item.ItunesDuration = fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+		}
+
+		if i.Enclosure != nil {
+			item.Enclosure = &RssEnclosure{Url: i.Enclosure.URL, Length: strconv.FormatInt(i.Enclosure.Length, 10), Type: i.Enclosure.Type}
+		}
+
+		r.Items = append(r.Items, &item)
+	}
+
+	return xml.Marshal(RssFeedXml{
+		Version:          "2.0",
+		Channel:          &r,
+		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+		ItunesNamespace:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+	})
+}
+
+func (f *Feed) Atom() ([]byte, error) {
+	a := AtomFeed{
+		Title:     f.Title,
+		Id:        f.Link,
+		Updated:   atomTime(f.Updated),
+		Subtitle:  f.Description,
+		Icon:      f.Image,
+		Logo:      f.Image,
+		Generator: "soundcloak",
+		Links: []AtomLink{
+			{Href: f.Link, Rel: "alternate", Type: "text/html"},
+			{Href: f.selfURL(FeedAtom), Rel: "self", Type: FeedContentTypes[FeedAtom]},
+		},
+	}
+
+	if f.Author.Name != "" {
+		a.Author = &AtomPerson{Name: f.Author.Name, Uri: f.Author.URL}
+	}
+
+	for _, i := range f.Items {
+		e := AtomEntry{
+			Title:   i.Title,
+			Id:      i.Link,
+			Updated: atomTime(i.Updated),
+			Links:   []AtomLink{{Href: i.Link, Rel: "alternate", Type: "text/html"}},
+			Content: &AtomContent{Content: i.Content, Type: "html"},
+		}
+
+		if !i.Published.IsZero() {
+			e.Published = atomTime(i.Published)
+		}
+
+		if i.Category != "" {
+			e.Category = &AtomCategory{Term: i.Category}
+		}
+
+		if i.Author.Name != "" {
+			e.Author = &AtomPerson{Name: i.Author.Name, Uri: i.Author.URL}
+		}
+
+		if i.Enclosure != nil {
+			e.Links = append(e.Links, AtomLink{Href: i.Enclosure.URL, Rel: "enclosure", Type: i.Enclosure.Type, Length: strconv.FormatInt(i.Enclosure.Length, 10)})
+		}
+
+		a.Entries = append(a.Entries, &e)
+	}
+
+	b, err := xml.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), b...), nil
+}
+
+func (f *Feed) JSON() ([]byte, error) {
+	j := JSONFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageUrl: f.Link,
+		FeedUrl:     f.selfURL(FeedJSON),
+		Description: f.Description,
+		Icon:        f.Image,
+		Items:       make([]*JSONItem, 0, len(f.Items)),
+	}
+
+	if f.Author.Name != "" {
+		j.Authors = []*JSONAuthor{{Name: f.Author.Name, Url: f.Author.URL, Avatar: f.Author.Avatar}}
+	}
+
+	for _, i := range f.Items {
+		item := JSONItem{
+			Id:          i.ID,
+			Url:         i.Link,
+			Title:       i.Title,
+			ContentHTML: i.Content,
+			Image:       i.Image,
+		}
+
+		if !i.Published.IsZero() {
+			item.DatePublished = i.Published.Format(time.RFC3339)
+		}
+
+		if !i.Updated.IsZero() {
+			item.DateModified = i.Updated.Format(time.RFC3339)
+		}
+
+		if i.Author.Name != "" {
+			item.Authors = []*JSONAuthor{{Name: i.Author.Name, Url: i.Author.URL, Avatar: i.Author.Avatar}}
+		}
+
+		if i.Category != "" {
+			item.Tags = []string{i.Category}
+		}
+
+		if i.Enclosure != nil {
+			item.Attachments = []*JSONAttachment{{Url: i.Enclosure.URL, MimeType: i.Enclosure.Type, SizeInBytes: i.Enclosure.Length, DurationInSeconds: int64(i.Duration / 1000)}}
+		}
+
+		j.Items = append(j.Items, &item)
+	}
+
+	return json.Marshal(j)
+}
+
+func (f *Feed) selfURL(format string) string {
+	u := f.Self + "." + format
+	if f.Query != "" {
+		u += "?" + f.Query
+	}
+
+	return u
+}
+
+// atom requires the timestamp to be there
+func atomTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+// Splits "name.ext" into name and feed format, format is empty if there's no known extension
+func FeedFormat(s string) (string, string) {
+	if i := strings.LastIndexByte(s, '.'); i != -1 {
+		switch s[i+1:] {
+		case "rss", "xml":
+			return s[:i], FeedRSS
+		case FeedAtom:
+			return s[:i], FeedAtom
+		case FeedJSON:
+			return s[:i], FeedJSON
+		}
+	}
+
+	return s, ""
+}
+
+// Filling the feed
+
+func t(s string) time.Time {
+	parsed, _ := time.Parse(time.RFC3339, s)
+	return parsed
+}
+
+var biggestImage = strings.NewReplacer("-large.", "-original.", "-t200x200.", "-original.", "-t500x500.", "-original.")
+
+// Makes images from Postfix absolute, and gets the biggest version
+func feedImage(prefs cfg.Preferences, base string, img string) string {
+	if img == "" {
+		return ""
+	}
+
+	if cfg.ProxyImages && *prefs.ProxyImages {
+		// the url is signed, so take the original one out and sign the bigger one again
+		if u, err := url.Parse(img); err == nil && u.Path == "/_/proxy/images" {
+			return base + signing.Image(biggestImage.Replace(u.Query().Get("url")))
+		}
+
+		img = base + img
+	}
+
+	return biggestImage.Replace(img)
+}
+
+// Authors don't get Postfix'd in most places, so proxying is done here
+func feedAuthor(prefs cfg.Preferences, base string, u *User) FeedAuthor {
+	a := FeedAuthor{Name: u.Username, Handle: u.Permalink, URL: base + "/" + u.Permalink}
+	if u.Avatar != "" {
+		a.Avatar = biggestImage.Replace(u.Avatar)
+		if cfg.ProxyImages && *prefs.ProxyImages {
+			a.Avatar = base + signing.Image(a.Avatar)
+		}
+	}
+
+	return a
+}
+
+// Rough file size for the enclosure, podcast apps want something there. Bitrates from docs/AUDIO_PRESETS.md
+func estimateSize(duration uint32, audio string) int64 {
+	var kbps int64 = 128
+	if audio == cfg.AudioAAC {
+		kbps = 160
+	}
+
+	return int64(duration) * kbps / 8
+}
+
+// Uses restream if it's enabled, progressive (only mp3) otherwise
+func enclosure(base string, href string, t *Track, audio string) *FeedEnclosure {
+	if cfg.Restream {
+		_, audio = t.Media.SelectCompatibleRestream(audio)
+		if audio == "" {
+			return nil
+		}
+
+		e := &FeedEnclosure{URL: base + signing.URLFor("/_/api/restream"+href+"?audio="+audio, "/_/api/restream"+href, cfg.SignedFeedURLTTL), Length: estimateSize(t.Duration, audio), Type: "audio/mpeg"}
+		if audio == cfg.AudioAAC {
+			e.Type = "audio/mp4"
+		}
+
+		return e
+	}
+
+	if t.Media.SelectCompatibleProgressive() == nil {
+		return nil
+	}
+
+	u := "/_/api/progressive" + href
+	if !cfg.ProxyStreams {
+		u += "?redirect=true"
+	}
+	u = base + signing.URLFor(u, "/_/api/progressive"+href, cfg.SignedFeedURLTTL)
+
+	return &FeedEnclosure{URL: u, Length: estimateSize(t.Duration, cfg.AudioMP3), Type: "audio/mpeg"}
+}
+
+// track should be Postfix'd already
+func (f *Feed) addTrack(ctx context.Context, prefs cfg.Preferences, base string, track *Track, audio string) {
+	href := track.Href()
+	track.Artwork = feedImage(prefs, base, track.Artwork)
+	item := FeedItem{
+		ID:        string(track.ID),
+		Title:     track.Title,
+		Link:      base + href,
+		Category:  track.Genre,
+		Image:     track.Artwork,
+		Published: t(track.CreatedAt),
+		Updated:   t(track.LastModified),
+		Duration:  track.Duration,
+		Author:    feedAuthor(prefs, base, &track.Author),
+		Enclosure: enclosure(base, href, track, audio),
+	}
+
+	buf := strings.Builder{}
+	err := TrackDescription(prefs, track, item.Link).Render(ctx, &buf)
+	if err != nil {
+		logger.Error("error generating feed item", logging.Private("feed", f.Link), logging.Private("track", track.Permalink), logging.Err(err))
+		return
+	}
+
+	item.Content = buf.String()
+	f.Items = append(f.Items, &item)
+}
+
+// playlist should be Postfix'd already
+func (f *Feed) addPlaylist(ctx context.Context, prefs cfg.Preferences, base string, p *Playlist) {
+	p.Artwork = feedImage(prefs, base, p.Artwork)
+	item := FeedItem{
+		ID:        "playlist-" + string(p.ID), // so they don't collide with tracks
+		Title:     p.Title,
+		Link:      base + p.Href(),
+		Image:     p.Artwork,
+		Published: t(p.CreatedAt),
+		Updated:   t(p.LastModified),
+		Author:    feedAuthor(prefs, base, &p.Author),
+	}
+
+	buf := strings.Builder{}
+	err := PlaylistDescription(prefs, p, item.Link).Render(ctx, &buf)
+	if err != nil {
+		logger.Error("error generating feed item", logging.Private("feed", f.Link), logging.Private("playlist", p.Permalink), logging.Err(err))
+		return
+	}
+
+	item.Content = buf.String()
+	f.Items = append(f.Items, &item)
+}
+
+// Feed is as fresh as its newest item, fallback is used when there are no items
+func (f *Feed) updated(fallback string) {
+	for _, i := range f.Items {
+		if i.Updated.After(f.Updated) {
+			f.Updated = i.Updated
+		}
+	}
+
+	if f.Updated.IsZero() {
+		f.Updated = t(fallback)
+	}
+}
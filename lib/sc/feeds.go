@@ -9,6 +9,7 @@ type RssFeedXml struct {
 	XMLName          xml.Name `xml:"rss"`
 	Version          string   `xml:"version,attr"`
 	ContentNamespace string   `xml:"xmlns:content,attr"`
+	ItunesNamespace  string   `xml:"xmlns:itunes,attr,omitempty"`
 	Channel          *RssFeed
 }
 
@@ -31,9 +32,14 @@ type RssFeed struct {
 	//Rating         string   `xml:"rating,omitempty"`
 	//SkipHours      string   `xml:"skipHours,omitempty"`
 	//SkipDays       string   `xml:"skipDays,omitempty"`
-	//Image          *RssImage
+	Image *RssImage
 	//TextInput      *RssTextInput
 	Items []*RssItem `xml:"item"`
+
+	// itunes podcast stuff
+	ItunesAuthor   string       `xml:"itunes:author,omitempty"`
+	ItunesImage    *ItunesImage `xml:"itunes:image,omitempty"`
+	ItunesCategory *ItunesCategory
 }
 
 type RssItem struct {
@@ -45,10 +51,42 @@ type RssItem struct {
 	//Author    string `xml:"author,omitempty"`
 	Category string `xml:"category,omitempty"`
 	//Comments  string `xml:"comments,omitempty"`
-	//Enclosure *RssEnclosure
-	Guid    *RssGuid // Id used
-	PubDate string   `xml:"pubDate,omitempty"` // created or updated
+	Enclosure *RssEnclosure
+	Guid      *RssGuid // Id used
+	PubDate   string   `xml:"pubDate,omitempty"` // created or updated
 	//Source  string   `xml:"source,omitempty"`
+
+	ItunesAuthor   string       `xml:"itunes:author,omitempty"`
+	ItunesDuration string       `xml:"itunes:duration,omitempty"`
+	ItunesImage    *ItunesImage `xml:"itunes:image,omitempty"`
+}
+
+type RssImage struct {
+	XMLName xml.Name `xml:"image"`
+	Url     string   `xml:"url"`
+	Title   string   `xml:"title"`
+	Link    string   `xml:"link"`
+	//Width   int      `xml:"width,omitempty"`
+	//Height  int      `xml:"height,omitempty"`
+}
+
+type RssEnclosure struct {
+	//RSS 2.0 <enclosure url="http://example.com/file.mp3" length="123456789" type="audio/mpeg" />
+	XMLName xml.Name `xml:"enclosure"`
+	Url     string   `xml:"url,attr"`
+	Length  string   `xml:"length,attr"`
+	Type    string   `xml:"type,attr"`
+}
+
+// not from gorilla/feeds
+
+type ItunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type ItunesCategory struct {
+	XMLName xml.Name `xml:"itunes:category"`
+	Text    string   `xml:"text,attr"`
 }
 
 type RssGuid struct {
@@ -57,3 +95,93 @@ type RssGuid struct {
 	Id          string   `xml:",chardata"`
 	IsPermaLink string   `xml:"isPermaLink,attr,omitempty"` // "true", "false", or an empty string
 }
+
+type AtomFeed struct {
+	XMLName   xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+	Title     string   `xml:"title"`   // required
+	Id        string   `xml:"id"`      // required
+	Updated   string   `xml:"updated"` // required
+	Subtitle  string   `xml:"subtitle,omitempty"`
+	Icon      string   `xml:"icon,omitempty"`
+	Logo      string   `xml:"logo,omitempty"`
+	Generator string   `xml:"generator,omitempty"`
+	Links     []AtomLink
+	Author    *AtomPerson `xml:"author,omitempty"`
+	Entries   []*AtomEntry
+}
+
+type AtomEntry struct {
+	XMLName   xml.Name `xml:"entry"`
+	Title     string   `xml:"title"`   // required
+	Id        string   `xml:"id"`      // required
+	Updated   string   `xml:"updated"` // required
+	Published string   `xml:"published,omitempty"`
+	Category  *AtomCategory
+	Content   *AtomContent
+	Links     []AtomLink
+	Author    *AtomPerson `xml:"author,omitempty"`
+}
+
+type AtomLink struct {
+	//Atom 1.0 <link rel="enclosure" type="audio/mpeg" title="MP3" href="http://www.example.org/myaudiofile.mp3" length="1234" />
+	XMLName xml.Name `xml:"link"`
+	Href    string   `xml:"href,attr"`
+	Rel     string   `xml:"rel,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Length  string   `xml:"length,attr,omitempty"`
+}
+
+type AtomPerson struct {
+	Name string `xml:"name,omitempty"`
+	Uri  string `xml:"uri,omitempty"`
+}
+
+type AtomCategory struct {
+	XMLName xml.Name `xml:"category"`
+	Term    string   `xml:"term,attr"`
+}
+
+type AtomContent struct {
+	XMLName xml.Name `xml:"content"`
+	Content string   `xml:",chardata"`
+	Type    string   `xml:"type,attr"`
+}
+
+// https://www.jsonfeed.org/version/1.1/
+
+type JSONFeed struct {
+	Version     string        `json:"version"` // required
+	Title       string        `json:"title"`   // required
+	HomePageUrl string        `json:"home_page_url,omitempty"`
+	FeedUrl     string        `json:"feed_url,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Icon        string        `json:"icon,omitempty"`
+	Authors     []*JSONAuthor `json:"authors,omitempty"`
+	Items       []*JSONItem   `json:"items"` // required
+}
+
+type JSONItem struct {
+	Id            string            `json:"id"` // required
+	Url           string            `json:"url,omitempty"`
+	Title         string            `json:"title,omitempty"`
+	ContentHTML   string            `json:"content_html,omitempty"`
+	Image         string            `json:"image,omitempty"`
+	DatePublished string            `json:"date_published,omitempty"`
+	DateModified  string            `json:"date_modified,omitempty"`
+	Authors       []*JSONAuthor     `json:"authors,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Attachments   []*JSONAttachment `json:"attachments,omitempty"`
+}
+
+type JSONAuthor struct {
+	Name   string `json:"name,omitempty"`
+	Url    string `json:"url,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+type JSONAttachment struct {
+	Url               string `json:"url"`       // required
+	MimeType          string `json:"mime_type"` // required
+	SizeInBytes       int64  `json:"size_in_bytes,omitempty"`
+	DurationInSeconds int64  `json:"duration_in_seconds,omitempty"`
+}
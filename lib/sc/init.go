@@ -3,18 +3,21 @@ package sc
 import (
 	"bytes"
 	"errors"
-	"fmt"
-	"log"
 	"net"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
 	"git.maid.zone/stuff/soundcloak/lib/misc"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
 	"github.com/dlclark/regexp2/v2"
 	"github.com/goccy/go-json"
 	utls "github.com/refraction-networking/utls"
@@ -24,6 +27,8 @@ import (
 	"golang.org/x/net/http/httpproxy"
 )
 
+var logger = logging.Module("sc")
+
 var ProxyErr = errors.New("could not connect to proxy")
 var parsedproxy string
 
@@ -50,6 +55,13 @@ func scrub(err error) error {
 var ClientID string
 var Version string
 
+// unix nanoseconds of the last time soundcloud accepted ClientID (extraction, or any successful api call with it)
+var clientIDValidated atomic.Int64
+
+func ClientIDValidated() time.Time {
+	return time.Unix(0, clientIDValidated.Load())
+}
+
 const api = "api-v2.soundcloud.com"
 
 const H = len("https://" + api)
@@ -86,6 +98,16 @@ var ErrScriptNotFound = errors.New("script not found")
 var ErrIDNotFound = errors.New("clientid not found")
 var ErrKindNotCorrect = errors.New("entity of incorrect kind")
 
+// soundcloud answered with something other than 200. Use errors.As to get it
+type StatusError struct {
+	Op     string
+	Status int
+}
+
+func (e *StatusError) Error() string {
+	return e.Op + ": got status code " + strconv.Itoa(e.Status)
+}
+
 type cached[T any] struct {
 	Value   T
 	Expires time.Time
@@ -256,29 +278,84 @@ func GetClientID() error {
 	} else {
 		ClientID = res
 		Version = ver
+		clientIDValidated.Store(time.Now().UnixNano())
 		misc.Log(ClientID, Version)
 	}
 
 	return err
 }
 
+// GetClientID, but counted in metrics. Use this one
+func RefreshClientID() error {
+	err := GetClientID()
+	metrics.ClientIDRefresh(err)
+	return err
+}
+
 // Just retry any kind of errors, why not
 func DoWithRetryAll(httpc *fasthttp.Client, req *fasthttp.Request, resp *fasthttp.Response) (err error) {
-	for range 10 {
+	upstream := metrics.Upstream(string(req.URI().Host()))
+	if !allow(upstream) {
+		return ErrCircuitOpen
+	}
+	defer observe(upstream, time.Now(), &err)
+
+	for i := range 10 {
+		if i != 0 {
+			metrics.UpstreamRetries.Inc(upstream)
+		}
+
 		err = httpc.Do(req, resp)
 		if err == nil {
 			return nil
 		}
 	}
 
-	err = scrub(err)
+	err = upstreamError{upstream, scrub(err)}
 
 	return
 }
 
+// Keeps track of which upstream failed, for logs. Unwraps to the actual error, so errors.Is still works
+type upstreamError struct {
+	upstream string
+	err      error
+}
+
+func (e upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e upstreamError) Unwrap() error {
+	return e.err
+}
+
+func (e upstreamError) Upstream() string {
+	return e.upstream
+}
+
+func observe(upstream string, start time.Time, err *error) {
+	record(upstream, *err)
+	metrics.UpstreamRequests.Inc(upstream)
+	metrics.UpstreamDuration.Since(start, upstream)
+	if *err != nil {
+		metrics.UpstreamErrors.Inc(upstream)
+	}
+}
+
 // Since the http client is setup to always keep connections idle (great for speed, no need to open a new one everytime), those connections may be closed by soundcloud after some time of inactivity, this ensures that we retry those requests that fail due to the connection closing/timing out
 func DoWithRetry(httpc *fasthttp.HostClient, req *fasthttp.Request, resp *fasthttp.Response) (err error) {
-	for range 10 {
+	upstream := metrics.Upstream(httpc.Addr)
+	if !allow(upstream) {
+		return ErrCircuitOpen
+	}
+	defer observe(upstream, time.Now(), &err)
+
+	for i := range 10 {
+		if i != 0 {
+			metrics.UpstreamRetries.Inc(upstream)
+		}
+
 		err = httpc.Do(req, resp)
 		if err == nil {
 			return nil
@@ -291,14 +368,14 @@ func DoWithRetry(httpc *fasthttp.HostClient, req *fasthttp.Request, resp *fastht
 			!os.IsTimeout(err) &&
 			!errors.Is(err, syscall.EPIPE) && // EPIPE is "broken pipe" error
 			err.Error() != "timeout" {
-			err = scrub(err)
+			err = upstreamError{upstream, scrub(err)}
 			return
 		}
 
 		misc.Log("we failed haha", err)
 	}
 
-	err = scrub(err)
+	err = upstreamError{upstream, scrub(err)}
 
 	return
 }
@@ -324,8 +401,9 @@ func Resolve(path string, out any) error {
 	}
 
 	if resp.StatusCode() != 200 {
-		return fmt.Errorf("resolve: got status code %d", resp.StatusCode())
+		return upstreamError{"api", &StatusError{"resolve", resp.StatusCode()}}
 	}
+	clientIDValidated.Store(time.Now().UnixNano())
 
 	data, err := resp.BodyUncompressed()
 	if err != nil {
@@ -366,8 +444,9 @@ func (p *Paginated[T]) Proceed(shouldUnfold bool) error {
 	}
 
 	if resp.StatusCode() != 200 {
-		return fmt.Errorf("paginated.proceed: got status code %d", resp.StatusCode())
+		return upstreamError{"api", &StatusError{"paginated.proceed", resp.StatusCode()}}
 	}
+	clientIDValidated.Store(time.Now().UnixNano())
 
 	data, err := resp.BodyUncompressed()
 	if err != nil {
@@ -383,6 +462,8 @@ func (p *Paginated[T]) Proceed(shouldUnfold bool) error {
 		p.NextHref = ""
 	}
 
+	p.Collection = filterBlocked(p.Collection)
+
 	// in soundcloud api, pagination may not immediately return you something!
 	// loading users who haven't released anything recently may require you to do a bunch of requests for nothing :/
 	// maybe there could be a way to cache the last useless layer of pagination so soundcloak can start loading from there? might be a bit complicated, but would be great
@@ -441,10 +522,22 @@ func GetSearchSuggestions(query string) ([]string, error) {
 	return l, nil
 }
 
+// Cheapest api call I could find, for checking if api-v2 works (through the proxy and spoofed tls, if those are set)
+func Ping() error {
+	uri := baseUri()
+	uri.SetPath("/search/queries")
+	uri.QueryArgs().Set("limit", "1")
+	uri.QueryArgs().Set("q", "a")
+
+	p := Paginated[SearchSuggestion]{Next: uri}
+	return p.Proceed(false)
+}
+
 // polyglot type struct lol
 type UserPlaylistTrack struct {
-	Kind      string `json:"kind"` // "playlist" or "system-playlist" or "user" or "track"
-	Permalink string `json:"permalink"`
+	Kind      string      `json:"kind"` // "playlist" or "system-playlist" or "user" or "track"
+	Permalink string      `json:"permalink"`
+	ID        json.Number `json:"id"`
 
 	// User
 	Avatar   string `json:"avatar_url"`
@@ -487,13 +580,13 @@ func (p *UserPlaylistTrack) Fix(prefs cfg.Preferences) {
 		}
 
 		if p.Avatar != "" && cfg.ProxyImages && *prefs.ProxyImages {
-			p.Avatar = "/_/proxy/images?url=" + url.QueryEscape(p.Avatar)
+			p.Avatar = signing.Image(p.Avatar)
 		}
 	default:
 		if p.Artwork != "" {
 			p.Artwork = strings.Replace(p.Artwork, "-large.", "-t200x200.", 1)
 			if cfg.ProxyImages && *prefs.ProxyImages {
-				p.Artwork = "/_/proxy/images?url=" + url.QueryEscape(p.Artwork)
+				p.Artwork = signing.Image(p.Artwork)
 			}
 		}
 	}
@@ -507,10 +600,10 @@ func (p UserPlaylistTrack) TracksCount() int64 {
 	return int64(len(p.Tracks))
 }
 
-func Search(prefs cfg.Preferences, args []byte) (*Paginated[*UserPlaylistTrack], error) {
+func Search(prefs cfg.Preferences, opts SearchOptions, pagination []byte) (*Paginated[*UserPlaylistTrack], error) {
 	uri := baseUri()
 	uri.SetPath("/search")
-	uri.SetQueryStringBytes(args)
+	uri.SetQueryStringBytes(opts.Args(pagination))
 	p := Paginated[*UserPlaylistTrack]{Next: uri}
 	err := p.Proceed(true)
 	if err != nil {
@@ -697,12 +790,38 @@ func utls_dial(addr string) (net.Conn, error) {
 	return uconn, nil
 }
 
+// Uses ClientID from the config, or extracts it from soundcloud (and keeps refreshing it). Exits if that fails.
+// Not in init, so tests and such don't need soundcloud
+func LoadClientID() {
+	if cfg.ClientID != "" {
+		ClientID = cfg.ClientID
+		return
+	}
+
+	err := RefreshClientID()
+	if err != nil {
+		logger.Error("failed to get ClientID, please report this as issue", logging.Err(err))
+		logger.Error("for temporary workaround, you can manually extract this token and set in your config: https://git.maid.zone/stuff/soundcloak/src/branch/main/docs/INSTANCE_GUIDE.md#script-version-clientid-not-found")
+		os.Exit(1)
+	}
+
+	go func() {
+		ticker := time.NewTicker(cfg.ClientIDTTL)
+		for range ticker.C {
+			err := RefreshClientID()
+			if err != nil {
+				logger.Error("error extracting ClientID, using previously extracted, please report as issue", logging.Err(err))
+			}
+		}
+	}()
+}
+
 func init() {
 	if cfg.SoundcloudApiProxy != "" {
 		d := fasthttpproxy.Dialer{Config: httpproxy.Config{HTTPProxy: cfg.SoundcloudApiProxy, HTTPSProxy: cfg.SoundcloudApiProxy}, DialDualStack: cfg.DialDualStack}
 		dialer, err := d.GetDialFunc(false)
 		if err != nil {
-			log.Println("[warning] failed to get dialer for proxy", err)
+			logger.Warn("failed to get dialer for proxy", logging.Err(scrub(err)))
 		}
 
 		genericClient.Dial = dialer
@@ -715,28 +834,13 @@ func init() {
 		genericClient.Dial = utls_dial
 	}
 
-	if cfg.ClientID != "" {
-		ClientID = cfg.ClientID
-	} else {
-		err := GetClientID()
-		if err != nil {
-			log.Println("Failed to get ClientID:", err)
-			log.Println("please report this as  issue")
-			log.Println("For temporary workaround, you can manually extract this token and set in your config: https://git.maid.zone/stuff/soundcloak/src/branch/main/docs/INSTANCE_GUIDE.md#script-version-clientid-not-found")
-			os.Exit(1)
-			return
+	metrics.Gauge("soundcloak_cache_entries", "Entries in caches (including expired ones that weren't cleaned up yet).", "cache", func() map[string]float64 {
+		m := map[string]float64{}
+		for _, c := range Caches() {
+			m[c.Name] = float64(c.Entries)
 		}
-
-		go func() {
-			ticker := time.NewTicker(cfg.ClientIDTTL)
-			for range ticker.C {
-				err := GetClientID()
-				if err != nil {
-					fmt.Println("Got error extracting ClientID, using previously extracted, please report as issue:", err)
-				}
-			}
-		}()
-	}
+		return m
+	})
 
 	// could probably make a generic function, whatever
 	go func() {
@@ -752,6 +856,18 @@ func init() {
 			}
 
 			usersCacheLock.Unlock()
+
+			// activity is fetched per user, so same delay
+			activityCacheLock.Lock()
+
+			now = time.Now()
+			for key, val := range ActivityCache {
+				if val.Expires.Before(now) {
+					delete(ActivityCache, key)
+				}
+			}
+
+			activityCacheLock.Unlock()
 		}
 	}()
 
@@ -804,6 +920,22 @@ func init() {
 			playlistsCacheLock.Unlock()
 		}
 	}()
+
+	go func() {
+		ticker := time.NewTicker(cfg.FeedCacheCleanDelay)
+		for range ticker.C {
+			feedsCacheLock.Lock()
+
+			now := time.Now()
+			for key, val := range FeedsCache {
+				if val.Expires.Before(now) {
+					delete(FeedsCache, key)
+				}
+			}
+
+			feedsCacheLock.Unlock()
+		}
+	}()
 }
 
 func baseUri() *fasthttp.URI {
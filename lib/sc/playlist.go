@@ -1,13 +1,19 @@
 package sc
 
 import (
+	"context"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"git.maid.zone/stuff/soundcloak/lib/blocklist"
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
+	"github.com/goccy/go-json"
 )
 
 var PlaylistsCache = map[string]cached[Playlist]{}
@@ -16,30 +22,37 @@ var playlistsCacheLock = &sync.RWMutex{}
 // Functions/structures related to playlists
 
 type Playlist struct {
-	Artwork       string  `json:"artwork_url"`
-	CreatedAt     string  `json:"created_at"`
-	Description   string  `json:"description"`
-	Kind          string  `json:"kind"` // should always be "playlist"! or "system-playlist"
-	LastModified  string  `json:"last_modified"`
-	Permalink     string  `json:"permalink"`
-	TagList       string  `json:"tag_list"`
-	Title         string  `json:"title"`
-	Type          string  `json:"set_type"`
-	MissingTracks string  `json:"-"`
-	Tracks        []Track `json:"tracks"`
-	Author        User    `json:"user"`
-	Likes         int64   `json:"likes_count"`
-	TrackCount    int64   `json:"track_count"`
-	Album         bool    `json:"is_album"`
+	Artwork       string      `json:"artwork_url"`
+	CreatedAt     string      `json:"created_at"`
+	Description   string      `json:"description"`
+	Kind          string      `json:"kind"` // should always be "playlist"! or "system-playlist"
+	LastModified  string      `json:"last_modified"`
+	Permalink     string      `json:"permalink"`
+	TagList       string      `json:"tag_list"`
+	Title         string      `json:"title"`
+	ID            json.Number `json:"id"`
+	Type          string      `json:"set_type"`
+	MissingTracks string      `json:"-"`
+	Tracks        []Track     `json:"tracks"`
+	Author        User        `json:"user"`
+	Likes         int64       `json:"likes_count"`
+	TrackCount    int64       `json:"track_count"`
+	Album         bool        `json:"is_album"`
 }
 
 func GetPlaylist(permalink string) (Playlist, error) {
+	if blocklist.Permalink(permalink) {
+		return Playlist{}, ErrBlocked
+	}
+
 	playlistsCacheLock.RLock()
 	if cell, ok := PlaylistsCache[permalink]; ok {
 		playlistsCacheLock.RUnlock()
-		return cell.Value, nil
+		metrics.Cache("playlists", true)
+		return cell.Value.unblocked()
 	}
 	playlistsCacheLock.RUnlock()
+	metrics.Cache("playlists", false)
 
 	var p Playlist
 	var err error
@@ -62,13 +75,49 @@ func GetPlaylist(permalink string) (Playlist, error) {
 	PlaylistsCache[permalink] = cached[Playlist]{Value: p, Expires: time.Now().Add(cfg.PlaylistTTL)}
 	playlistsCacheLock.Unlock()
 
+	return p.unblocked()
+}
+
+// blocked tracks are taken out here instead of before caching, so the list can change without purging the cache
+func (p Playlist) unblocked() (Playlist, error) {
+	if p.Blocked() {
+		return Playlist{}, ErrBlocked
+	}
+
+	p.Tracks = filterBlocked(p.Tracks)
 	return p, nil
 }
 
-func SearchPlaylists(prefs cfg.Preferences, args []byte) (*Paginated[*Playlist], error) {
+// Currently supports:
+// - soundcloud.com/<user>/sets/<playlist>
+// - plain permalink: <user>/sets/<playlist>
+func GetArbitraryPlaylist(data string) (Playlist, error) {
+	if len(data) > 8 && (data[:8] == "https://" || data[:7] == "http://") {
+		u, err := url.Parse(data)
+		if err != nil {
+			return Playlist{}, err
+		}
+
+		if u.Host != "soundcloud.com" {
+			return Playlist{}, ErrKindNotCorrect
+		}
+
+		data = u.Path
+	}
+
+	data = strings.Trim(data, "/")
+	parts := strings.Split(data, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] != "sets" || parts[2] == "" {
+		return Playlist{}, ErrKindNotCorrect
+	}
+
+	return GetPlaylist(data)
+}
+
+func SearchPlaylists(prefs cfg.Preferences, opts SearchOptions, pagination []byte) (*Paginated[*Playlist], error) {
 	uri := baseUri()
 	uri.SetPath("/search/playlists")
-	uri.SetQueryStringBytes(args)
+	uri.SetQueryStringBytes(opts.Args(pagination))
 	p := Paginated[*Playlist]{Next: uri}
 	err := p.Proceed(true)
 	if err != nil {
@@ -109,7 +158,7 @@ func (p *Playlist) Fix(cached bool, fixAuthor bool) error {
 
 func (p *Playlist) Postfix(prefs cfg.Preferences, fixTracks bool, fixAuthor bool) []Track {
 	if cfg.ProxyImages && *prefs.ProxyImages && p.Artwork != "" {
-		p.Artwork = "/_/proxy/images?url=" + url.QueryEscape(p.Artwork)
+		p.Artwork = signing.Image(p.Artwork)
 	}
 
 	if fixAuthor {
@@ -211,11 +260,84 @@ func (p *Playlist) GetMissingTracks() error {
 	return nil
 }
 
+// Keeps loading missing tracks until the playlist is whole. Don't use it on pages, it can take a bunch of requests for big playlists
+func (p *Playlist) GetAllMissingTracks() error {
+	if p.MissingTracks == "" {
+		return nil
+	}
+
+	// the tracks slice is shared with the cached playlist
+	p.Tracks = slices.Clone(p.Tracks)
+	for p.MissingTracks != "" {
+		res, next, err := GetNextMissingTracks(p.MissingTracks)
+		if err != nil {
+			return err
+		}
+
+		for i, t := range p.Tracks {
+			if t.Title != "" {
+				continue
+			}
+
+			for _, nt := range res {
+				if string(nt.ID) == string(t.ID) {
+					p.Tracks[i] = nt
+					break
+				}
+			}
+		}
+
+		p.MissingTracks = strings.Join(next, ",")
+	}
+
+	return nil
+}
+
+// Loads the batch of missing tracks starting from the track at index i (if it's missing). For stuff that jumps around the playlist, like the embed
+func (p *Playlist) GetMissingTracksAt(i int) error {
+	if p.Tracks[i].Title != "" || p.MissingTracks == "" {
+		return nil
+	}
+
+	missing := strings.Split(p.MissingTracks, ",")
+	start := slices.Index(missing, string(p.Tracks[i].ID))
+	if start == -1 {
+		return nil
+	}
+
+	res, _, err := GetNextMissingTracks(strings.Join(missing[start:], ","))
+	if err != nil {
+		return err
+	}
+
+	// the tracks slice is shared with the cached playlist
+	p.Tracks = slices.Clone(p.Tracks)
+	for j, t := range p.Tracks {
+		if t.Title != "" {
+			continue
+		}
+
+		for _, nt := range res {
+			if string(nt.ID) == string(t.ID) {
+				p.Tracks[j] = nt
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
 func (p Playlist) Href() string {
 	if p.Kind == "system-playlist" {
 		return "/discover/sets/" + p.Permalink
 	}
 
+	// from the local library, see lib/library
+	if p.Kind == "local-playlist" {
+		return "/_/library/" + p.Permalink
+	}
+
 	return "/" + p.Author.Permalink + "/sets/" + p.Permalink
 }
 
@@ -226,3 +348,55 @@ func (p Playlist) TracksCount() int64 {
 
 	return int64(len(p.Tracks))
 }
+
+// Newest tracks are at the end, so the last 20 tracks (newest first)
+func (p Playlist) GenerateFeed(ctx context.Context, prefs cfg.Preferences, base string, audio string) (*Feed, error) {
+	tracks := slices.Clone(p.Tracks[max(0, len(p.Tracks)-20):])
+	slices.Reverse(tracks)
+
+	missing := []string{}
+	for _, track := range tracks {
+		if track.Title == "" {
+			missing = append(missing, string(track.ID))
+		}
+	}
+
+	if len(missing) != 0 {
+		res, err := GetTracks(strings.Join(missing, ","))
+		if err != nil {
+			return nil, err
+		}
+
+		for i, track := range tracks {
+			for _, nt := range res {
+				if string(nt.ID) == string(track.ID) {
+					tracks[i] = nt
+					break
+				}
+			}
+		}
+	}
+
+	p.Postfix(prefs, false, false)
+	author := feedAuthor(prefs, base, &p.Author)
+	f := Feed{
+		Title:       p.Title + " by " + p.Author.Username,
+		Description: "Recently added tracks in " + p.Title,
+		Link:        base + p.Href(),
+		Category:    "Music",
+		Image:       feedImage(prefs, base, p.Artwork),
+		Author:      author,
+	}
+
+	for _, track := range tracks {
+		if track.Title == "" {
+			continue
+		}
+
+		track.Postfix(prefs, false)
+		f.addTrack(ctx, prefs, base, &track, audio)
+	}
+	f.updated(p.LastModified)
+
+	return &f, nil
+}
@@ -0,0 +1,181 @@
+package sc
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"github.com/valyala/fasthttp"
+)
+
+// Functions/structures related to searching
+
+// api-v2 search filters, same ones the soundcloud website uses
+// anything not in these lists is dropped, so nobody can splice random stuff into the upstream query
+var SearchSorts = []string{"popular"}
+var SearchDurations = []string{"short", "medium", "long", "epic"}                                       // <2min, 2-10min, 10-30min, >30min
+var SearchLicenses = []string{"to_listen", "to_share", "to_use_commercially", "to_modify_commercially"} // to_listen is basically "any"
+var SearchCreatedAt = []string{"last_hour", "last_day", "last_week", "last_month", "last_year"}
+
+type SearchOptions struct {
+	Query     string
+	Sort      string // empty means relevance
+	Duration  string
+	License   string
+	CreatedAt string
+	Genre     string // genre or tag
+}
+
+func oneOf(s string, allowed []string) string {
+	for _, a := range allowed {
+		if s == a {
+			return s
+		}
+	}
+
+	return ""
+}
+
+// Parse search options from the query args of a request (the names are the same ones used in the search form)
+func ParseSearchOptions(args *fasthttp.Args) SearchOptions {
+	return SearchOptions{
+		Query:     string(args.Peek("q")),
+		Sort:      oneOf(string(args.Peek("sort")), SearchSorts),
+		Duration:  oneOf(string(args.Peek("duration")), SearchDurations),
+		License:   oneOf(string(args.Peek("license")), SearchLicenses),
+		CreatedAt: oneOf(string(args.Peek("created_at")), SearchCreatedAt),
+		Genre:     string(args.Peek("genre")),
+	}
+}
+
+// Any filters set (other than the query itself)?
+func (o SearchOptions) Filtered() bool {
+	return o.Sort != "" || o.Duration != "" || o.License != "" || o.CreatedAt != "" || o.Genre != ""
+}
+
+// What the pagination can carry over to api-v2, everything else in it is dropped. The filters come from the options
+var searchPagination = []string{"offset", "limit", "linked_partitioning", "query_urn"}
+
+func number(v []byte, lo, hi int) bool {
+	n, err := strconv.Atoi(cfg.B2s(v))
+	return err == nil && n >= lo && n <= hi
+}
+
+// Query args to pass to api-v2. Pagination is the raw query from next_href (can be nil),
+// the options are always applied on top of it, so they persist across pages
+func (o SearchOptions) Args(pagination []byte) []byte {
+	in := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(in)
+	in.ParseBytes(pagination)
+
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+
+	for _, k := range searchPagination {
+		v := in.Peek(k)
+		if v == nil {
+			continue
+		}
+
+		switch k {
+		case "offset":
+			if !number(v, 0, math.MaxInt32) {
+				continue
+			}
+		case "limit":
+			if !number(v, 1, 200) {
+				continue
+			}
+		case "linked_partitioning":
+			v = []byte("1")
+		}
+
+		args.SetBytesV(k, v)
+	}
+
+	args.Set("q", o.Query)
+
+	setOrDel(args, "sort", oneOf(o.Sort, SearchSorts))
+	setOrDel(args, "filter.duration", oneOf(o.Duration, SearchDurations))
+	setOrDel(args, "filter.license", oneOf(o.License, SearchLicenses))
+	setOrDel(args, "filter.created_at", oneOf(o.CreatedAt, SearchCreatedAt))
+	setOrDel(args, "filter.genre_or_tag", o.Genre)
+
+	return args.AppendBytes(nil)
+}
+
+// Query string for links on our side (same names as ParseSearchOptions)
+func (o SearchOptions) Encode() string {
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+
+	args.Set("q", o.Query)
+	setOrDel(args, "sort", o.Sort)
+	setOrDel(args, "duration", o.Duration)
+	setOrDel(args, "license", o.License)
+	setOrDel(args, "created_at", o.CreatedAt)
+	setOrDel(args, "genre", o.Genre)
+
+	return cfg.B2s(args.AppendBytes(nil))
+}
+
+func setOrDel(args *fasthttp.Args, key, value string) {
+	if value == "" {
+		args.Del(key)
+	} else {
+		args.Set(key, value)
+	}
+}
+
+// Fills in whatever wasn't passed separately from the pagination (old links, or links which only carry the pagination)
+func (o *SearchOptions) FromPagination(pagination []byte) {
+	if len(pagination) == 0 {
+		return
+	}
+
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+
+	args.ParseBytes(pagination)
+	if o.Query == "" {
+		o.Query = string(args.Peek("q"))
+	}
+	if o.Sort == "" {
+		o.Sort = oneOf(string(args.Peek("sort")), SearchSorts)
+	}
+	if o.Duration == "" {
+		o.Duration = oneOf(string(args.Peek("filter.duration")), SearchDurations)
+	}
+	if o.License == "" {
+		o.License = oneOf(string(args.Peek("filter.license")), SearchLicenses)
+	}
+	if o.CreatedAt == "" {
+		o.CreatedAt = oneOf(string(args.Peek("filter.created_at")), SearchCreatedAt)
+	}
+	if o.Genre == "" {
+		o.Genre = string(args.Peek("filter.genre_or_tag"))
+	}
+}
+
+// Saved searches. Only tracks, since those are the only things that have audio
+func GenerateSearchFeed(ctx context.Context, prefs cfg.Preferences, base string, opts SearchOptions, audio string) (*Feed, error) {
+	tracks, err := SearchTracks(prefs, opts, []byte("limit=20"))
+	if err != nil {
+		return nil, err
+	}
+
+	f := Feed{
+		Title:       "Search: " + opts.Query,
+		Description: "Tracks found by searching for " + opts.Query,
+		Link:        base + "/search?type=tracks&" + opts.Encode(),
+		Category:    "Music",
+	}
+
+	for _, track := range tracks.Collection {
+		f.addTrack(ctx, prefs, base, track, audio)
+	}
+	f.updated("")
+
+	return &f, nil
+}
@@ -3,7 +3,6 @@ package sc
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
 	"net/url"
 	"strconv"
@@ -11,8 +10,11 @@ import (
 	"sync"
 	"time"
 
+	"git.maid.zone/stuff/soundcloak/lib/blocklist"
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
 	"git.maid.zone/stuff/soundcloak/lib/misc"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
 	"github.com/a-h/templ"
 	templruntime "github.com/a-h/templ/runtime"
 	"github.com/goccy/go-json"
@@ -219,12 +221,21 @@ func (m Media) SelectCompatibleProgressive() *Transcoding {
 }
 
 func GetTrack(permalink string) (Track, error) {
+	if blocklist.Permalink(permalink) {
+		return Track{}, ErrBlocked
+	}
+
 	tracksCacheLock.RLock()
 	if cell, ok := TracksCache[permalink]; ok {
 		tracksCacheLock.RUnlock()
+		metrics.Cache("tracks", true)
+		if cell.Value.Blocked() {
+			return Track{}, ErrBlocked
+		}
 		return cell.Value, nil
 	}
 	tracksCacheLock.RUnlock()
+	metrics.Cache("tracks", false)
 
 	var t Track
 	err := Resolve(permalink, &t)
@@ -242,6 +253,10 @@ func GetTrack(permalink string) (Track, error) {
 	TracksCache[permalink] = cached[Track]{Value: t, Expires: time.Now().Add(cfg.TrackTTL)}
 	tracksCacheLock.Unlock()
 
+	if t.Blocked() {
+		return Track{}, ErrBlocked
+	}
+
 	return t, nil
 }
 
@@ -332,10 +347,10 @@ func GetArbitraryTrack(data string) (Track, error) {
 	return Track{}, ErrKindNotCorrect
 }
 
-func SearchTracks(prefs cfg.Preferences, args []byte) (*Paginated[*Track], error) {
+func SearchTracks(prefs cfg.Preferences, opts SearchOptions, pagination []byte) (*Paginated[*Track], error) {
 	uri := baseUri()
 	uri.SetPath("/search/tracks")
-	uri.SetQueryStringBytes(args)
+	uri.SetQueryStringBytes(opts.Args(pagination))
 	p := Paginated[*Track]{Next: uri}
 	err := p.Proceed(true)
 	if err != nil {
@@ -381,7 +396,7 @@ func GetTracks(ids string) ([]Track, error) {
 		t.Fix(false, false)
 		res[i] = t
 	}
-	return res, err
+	return filterBlocked(res), err
 }
 
 type CachedStream struct {
@@ -393,6 +408,17 @@ type CachedStream struct {
 var StreamCache = map[string]cached[CachedStream]{}
 var StreamCacheMut = sync.RWMutex{}
 
+// Makes the next GetStream get a new url, for when the cdn stops accepting the old one before it should expire.
+// The uris are kept, since someone might still be using them
+func ExpireStream(slug string) {
+	StreamCacheMut.Lock()
+	if s, ok := StreamCache[slug]; ok {
+		s.Expires = time.Time{}
+		StreamCache[slug] = s
+	}
+	StreamCacheMut.Unlock()
+}
+
 func (tr Transcoding) GetStream(slug string, t Track) (cached[CachedStream], error) {
 	if slug == "" {
 		slug = tr.Slug(t)
@@ -403,8 +429,10 @@ func (tr Transcoding) GetStream(slug string, t Track) (cached[CachedStream], err
 	StreamCacheMut.RUnlock()
 	if ok && s.Expires.After(time.Now()) {
 		misc.Log("cache hit", s)
+		metrics.Cache("streams", true)
 		return s, nil
 	}
+	metrics.Cache("streams", false)
 
 	req := fasthttp.AcquireRequest()
 	defer fasthttp.ReleaseRequest(req)
@@ -424,7 +452,7 @@ func (tr Transcoding) GetStream(slug string, t Track) (cached[CachedStream], err
 	}
 
 	if resp.StatusCode() != 200 {
-		return s, fmt.Errorf("getstream: got status code %d", resp.StatusCode())
+		return s, upstreamError{"api", &StatusError{"getstream", resp.StatusCode()}}
 	}
 
 	data, err := resp.BodyUncompressed()
@@ -472,7 +500,7 @@ func (t *Track) Fix(large bool, fixAuthor bool) {
 
 func (t *Track) Postfix(prefs cfg.Preferences, fixAuthor bool) {
 	if cfg.ProxyImages && *prefs.ProxyImages && t.Artwork != "" {
-		t.Artwork = "/_/proxy/images?url=" + url.QueryEscape(t.Artwork)
+		t.Artwork = signing.Image(t.Artwork)
 	}
 
 	if fixAuthor {
@@ -500,10 +528,17 @@ func (t Track) FormatDescription() string {
 }
 
 func GetTrackByID(id string) (Track, error) {
+	if blocklist.Track(id) {
+		return Track{}, ErrBlocked
+	}
+
 	tracksCacheLock.RLock()
 	for _, cell := range TracksCache {
 		if string(cell.Value.ID) == string(id) {
 			tracksCacheLock.RUnlock()
+			if cell.Value.Blocked() {
+				return Track{}, ErrBlocked
+			}
 			return cell.Value, nil
 		}
 	}
@@ -547,6 +582,10 @@ func GetTrackByID(id string) (Track, error) {
 	TracksCache[t.Author.Permalink+"/"+t.Permalink] = cached[Track]{Value: t, Expires: time.Now().Add(cfg.TrackTTL)}
 	tracksCacheLock.Unlock()
 
+	if t.Blocked() {
+		return Track{}, ErrBlocked
+	}
+
 	return t, nil
 }
 
@@ -572,6 +611,27 @@ func RecentTracks(prefs cfg.Preferences, tag, args string) (*Paginated[*Track],
 	return &p, nil
 }
 
+func GenerateTagFeed(ctx context.Context, prefs cfg.Preferences, base string, tag string, audio string) (*Feed, error) {
+	tracks, err := RecentTracks(prefs, tag, "limit=20")
+	if err != nil {
+		return nil, err
+	}
+
+	f := Feed{
+		Title:       "Recent tracks tagged " + tag,
+		Description: "Recently released tracks tagged " + tag,
+		Link:        base + "/tags/" + url.PathEscape(tag),
+		Category:    "Music",
+	}
+
+	for _, track := range tracks.Collection {
+		f.addTrack(ctx, prefs, base, track, audio)
+	}
+	f.updated("")
+
+	return &f, nil
+}
+
 func (t Track) baseUri(subpath, args string) *fasthttp.URI {
 	uri := baseUri()
 	uri.SetPath("/tracks/" + string(t.ID) + "/" + subpath)
@@ -2,16 +2,16 @@ package sc
 
 import (
 	"context"
-	"encoding/xml"
-	"fmt"
-	"log"
 	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"git.maid.zone/stuff/soundcloak/lib/blocklist"
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
 	"git.maid.zone/stuff/soundcloak/lib/textparsing"
 	"github.com/goccy/go-json"
 	"github.com/valyala/fasthttp"
@@ -56,9 +56,10 @@ const (
 
 // not worthy of its own file
 type Repost struct {
-	Track    *Track    // type == track-report
-	Playlist *Playlist // type == playlist-repost
-	Type     RepostType
+	Track     *Track    // type == track-report
+	Playlist  *Playlist // type == playlist-repost
+	Type      RepostType
+	CreatedAt string `json:"created_at"` // when it was reposted
 }
 
 func (r Repost) Fix(prefs cfg.Preferences) {
@@ -94,13 +95,22 @@ func (l Like) Fix(prefs cfg.Preferences) {
 	}
 }
 func GetUser(permalink string) (User, error) {
+	if blocklist.Permalink(permalink) {
+		return User{}, ErrBlocked
+	}
+
 	usersCacheLock.RLock()
 	if cell, ok := UsersCache[permalink]; ok {
 		usersCacheLock.RUnlock()
+		metrics.Cache("users", true)
+		if cell.Value.Blocked() {
+			return User{}, ErrBlocked
+		}
 		return cell.Value, nil
 	}
 
 	usersCacheLock.RUnlock()
+	metrics.Cache("users", false)
 
 	var u User
 	err := Resolve(permalink, &u)
@@ -125,13 +135,17 @@ func GetUser(permalink string) (User, error) {
 	UsersCache[permalink] = cached[User]{Value: u, Expires: time.Now().Add(cfg.UserTTL)}
 	usersCacheLock.Unlock()
 
+	if u.Blocked() {
+		return User{}, ErrBlocked
+	}
+
 	return u, err
 }
 
-func SearchUsers(prefs cfg.Preferences, args []byte) (*Paginated[*User], error) {
+func SearchUsers(prefs cfg.Preferences, opts SearchOptions, pagination []byte) (*Paginated[*User], error) {
 	uri := baseUri()
 	uri.SetPath("/search/users")
-	uri.SetQueryStringBytes(args)
+	uri.SetQueryStringBytes(opts.Args(pagination))
 	p := Paginated[*User]{Next: uri}
 	err := p.Proceed(true)
 	if err != nil {
@@ -226,7 +240,7 @@ func (u *User) Fix(large bool) {
 
 func (u *User) Postfix(prefs cfg.Preferences) {
 	if cfg.ProxyImages && *prefs.ProxyImages && u.Avatar != "" {
-		u.Avatar = "/_/proxy/images?url=" + url.QueryEscape(u.Avatar)
+		u.Avatar = signing.Image(u.Avatar)
 	}
 }
 
@@ -314,7 +328,7 @@ func (u *User) GetWebProfiles() error {
 	}
 
 	if resp.StatusCode() != 200 {
-		return fmt.Errorf("getwebprofiles: got status code %d", resp.StatusCode())
+		return upstreamError{"api", &StatusError{"getwebprofiles", resp.StatusCode()}}
 	}
 
 	data, err := resp.BodyUncompressed()
@@ -397,69 +411,75 @@ func (u User) GetFollowing(prefs cfg.Preferences, args string) (*Paginated[*User
 	return &p, nil
 }
 
-func t(s string) string {
-	parsed, err := time.Parse(time.RFC3339, s)
-	if err == nil {
-		return parsed.Format(time.RFC1123Z)
-	}
-
-	return ""
-}
-
-// TODO: maybe add option for caching generated feeds? could benefit when many people follow same artists
-func (u *User) GenerateFeed(ctx context.Context, prefs cfg.Preferences, base string) ([]byte, error) {
+// audio is the preferred preset for enclosures (cfg.AudioMP3 or cfg.AudioAAC)
+func (u *User) GenerateFeed(ctx context.Context, prefs cfg.Preferences, base string, audio string) (*Feed, error) {
 	tracks, err := u.GetTracks(prefs, "limit=20")
 	if err != nil {
 		return nil, err
 	}
 
-	f := RssFeed{
-		Title:          "Tracks from " + u.Username,
-		Link:           base + "/" + u.Permalink,
-		ManagingEditor: u.Username + " (@" + u.Permalink + ")",
-
-		Category:  "Music",
-		Generator: "soundcloak",
-		Ttl:       int(cfg.UserTTL / time.Second),
+	f := u.feed(prefs, base, "Tracks from "+u.Username, "Recently released tracks by "+u.Username+" (@"+u.Permalink+")")
+	for _, track := range tracks.Collection {
+		f.addTrack(ctx, prefs, base, track, audio)
 	}
-	f.Description = "Recently released tracks by " + f.ManagingEditor
+	f.updated(u.LastModified)
 
-	if len(tracks.Collection) != 0 {
-		f.LastBuildDate = t(tracks.Collection[0].LastModified)
-		for _, track := range tracks.Collection {
-			item := RssItem{
-				Title: track.Title,
-				Link:  base + "/" + u.Permalink + "/" + track.Permalink,
+	return f, nil
+}
 
-				Category: track.Genre,
-				Guid:     &RssGuid{Id: string(track.ID), IsPermaLink: "false"},
-				PubDate:  t(track.LastModified),
-			}
+func (u *User) GenerateRepostsFeed(ctx context.Context, prefs cfg.Preferences, base string, audio string) (*Feed, error) {
+	reposts, err := u.GetReposts(prefs, "limit=20")
+	if err != nil {
+		return nil, err
+	}
 
-			if cfg.ProxyImages && *prefs.ProxyImages {
-				track.Artwork = base + track.Artwork
+	f := u.feed(prefs, base, "Reposts from "+u.Username, "Tracks and playlists recently reposted by "+u.Username+" (@"+u.Permalink+")")
+	f.Link += "/reposts"
+	for _, r := range reposts.Collection {
+		switch r.Type {
+		case TrackRepost:
+			if r.Track != nil {
+				f.addTrack(ctx, prefs, base, r.Track, audio)
+			}
+		case PlaylistRepost:
+			if r.Playlist != nil {
+				f.addPlaylist(ctx, prefs, base, r.Playlist)
 			}
+		}
+	}
+	f.updated(u.LastModified)
 
-			track.Artwork = strings.Replace(track.Artwork, "-t200x200.", "-original.", 1)
+	return f, nil
+}
 
-			buf := strings.Builder{}
-			err = TrackDescription(prefs, track, item.Link).Render(ctx, &buf)
-			if err != nil {
-				log.Printf("error generating %s (%s) feed: %s\n", u.Permalink, track.Permalink, err)
-				continue
-			}
+func (u *User) GenerateLikesFeed(ctx context.Context, prefs cfg.Preferences, base string, audio string) (*Feed, error) {
+	likes, err := u.GetLikes(prefs, "limit=20")
+	if err != nil {
+		return nil, err
+	}
 
-			item.Description = buf.String()
-			f.Items = append(f.Items, &item)
+	f := u.feed(prefs, base, "Likes from "+u.Username, "Tracks and playlists recently liked by "+u.Username+" (@"+u.Permalink+")")
+	f.Link += "/likes"
+	for _, l := range likes.Collection {
+		if l.Track != nil {
+			f.addTrack(ctx, prefs, base, l.Track, audio)
+		} else if l.Playlist != nil {
+			f.addPlaylist(ctx, prefs, base, l.Playlist)
 		}
-	} else {
-		f.LastBuildDate = t(u.LastModified)
 	}
-	f.PubDate = f.LastBuildDate
+	f.updated(u.LastModified)
 
-	return xml.Marshal(RssFeedXml{
-		Version:          "2.0",
-		Channel:          &f,
-		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
-	})
+	return f, nil
+}
+
+func (u *User) feed(prefs cfg.Preferences, base string, title string, description string) *Feed {
+	author := feedAuthor(prefs, base, u)
+	return &Feed{
+		Title:       title,
+		Description: description,
+		Link:        author.URL,
+		Category:    "Music",
+		Image:       author.Avatar,
+		Author:      author,
+	}
 }
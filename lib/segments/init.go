@@ -0,0 +1,184 @@
+package segments
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"git.maid.zone/stuff/soundcloak/lib/blobcache"
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
+	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+)
+
+// HLS segments, shared between the hls proxy and restream. They're keyed by their path on the cdn, which has the track and preset in it, and stays the same when the stream urls are renewed.
+// Concurrent requests for the same segment only download it once, even if the cache is off
+
+var logger = logging.Module("segments")
+
+// The cdn said 403/410, the stream url has to be renewed (see sc.ExpireStream)
+var ErrExpired = fiber.NewError(fiber.StatusBadGateway, "stream url expired")
+
+var cache blobcache.Cache
+
+var types = map[string]string{
+	".mp3": "audio/mpeg",
+	".m4s": "audio/mp4",
+	".mp4": "audio/mp4",
+}
+
+func init() {
+	if cfg.SegmentCacheSize <= 0 {
+		return
+	}
+
+	var err error
+	cache, err = blobcache.New("segments", cfg.SegmentCacheDir, int64(cfg.SegmentCacheSize)*1024*1024)
+	if err != nil {
+		logger.Error("failed to load segment cache, segments won't be cached", logging.Err(err))
+	}
+}
+
+func Enabled() bool {
+	return cache != nil
+}
+
+// For the extension Get returns
+func ContentType(ext string) string {
+	if t, ok := types[ext]; ok {
+		return t
+	}
+
+	return "application/octet-stream"
+}
+
+// If the cdn responding with this status means the url expired
+func Expired(status int) bool {
+	return status == fiber.StatusForbidden || status == fiber.StatusGone
+}
+
+type call struct {
+	done chan struct{}
+	data []byte
+	ext  string
+	err  error
+}
+
+var lock sync.Mutex
+var inflight = map[string]*call{}
+
+func key(u *fasthttp.URI) string {
+	h := sha256.New()
+	h.Write(u.Host())
+	h.Write(u.Path())
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Downloads the segment at u (or takes it from the cache), with its extension. The data is shared, don't modify it
+func Get(cl *fasthttp.HostClient, u *fasthttp.URI) ([]byte, string, error) {
+	k := key(u)
+	if cache != nil {
+		if data, ext, ok := cache.Get(k); ok {
+			return data, ext, nil
+		}
+	}
+
+	lock.Lock()
+	if c, ok := inflight[k]; ok {
+		lock.Unlock()
+		<-c.done
+		return c.data, c.ext, c.err
+	}
+
+	c := &call{done: make(chan struct{})}
+	inflight[k] = c
+	lock.Unlock()
+
+	c.data, c.ext, c.err = download(cl, u)
+	if c.err == nil && cache != nil {
+		cache.Put(k, c.ext, c.data)
+	}
+
+	lock.Lock()
+	delete(inflight, k)
+	lock.Unlock()
+	close(c.done)
+
+	return c.data, c.ext, c.err
+}
+
+// bad segments are tried this many times before giving up
+const attempts = 3
+
+// wait between attempts, times the attempt number
+var backoff = 250 * time.Millisecond
+
+func download(cl *fasthttp.HostClient, u *fasthttp.URI) ([]byte, string, error) {
+	var err error
+	for i := range attempts {
+		if i != 0 {
+			time.Sleep(time.Duration(i) * backoff)
+		}
+
+		var data []byte
+		var ext string
+		data, ext, err = downloadOnce(cl, u)
+		if err == nil {
+			return data, ext, nil
+		}
+
+		// network errors were already retried, and expired urls have to be renewed first
+		bad, ok := err.(badSegment)
+		if !ok {
+			return nil, "", err
+		}
+
+		metrics.SegmentErrors.Inc(bad.reason)
+		logger.Warn("bad segment from cdn", "reason", bad.reason, "detail", bad.detail, "attempt", i+1)
+	}
+
+	return nil, "", fiber.NewError(fiber.StatusBadGateway, err.Error())
+}
+
+func downloadOnce(cl *fasthttp.HostClient, u *fasthttp.URI) ([]byte, string, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetURI(u)
+	req.Header.SetUserAgent(cfg.UserAgent)
+
+	err := sc.DoWithRetry(cl, req, resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if Expired(resp.StatusCode()) {
+		return nil, "", ErrExpired
+	}
+
+	if resp.StatusCode() != fiber.StatusOK {
+		return nil, "", badSegment{"status", "status " + strconv.Itoa(resp.StatusCode())}
+	}
+
+	ext := path.Ext(string(u.Path()))
+	if _, ok := types[ext]; !ok {
+		ext = ""
+	}
+
+	data := resp.Body()
+	err = validate(data, string(resp.Header.ContentType()), ext)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return append([]byte(nil), data...), ext, nil
+}
@@ -0,0 +1,194 @@
+package segments
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+func box(kind string, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+	copy(b[4:], kind)
+	return append(b, payload...)
+}
+
+var (
+	mp3Segment = append([]byte{0xFF, 0xFB, 0x90, 0x64}, make([]byte, 1000)...)
+	mp4Segment = append(box("moof", make([]byte, 100)), box("mdat", make([]byte, 1000))...)
+	html       = []byte("<html><body><h1>Something went wrong</h1>" + strings.Repeat("<p>sorry</p>", 20) + "</body></html>")
+)
+
+type response struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+// fake cdn, every path has a list of responses it goes through (the last one repeats)
+type cdn struct {
+	lock      sync.Mutex
+	responses map[string][]response
+	requests  map[string]int
+}
+
+func (c *cdn) handle(ctx *fasthttp.RequestCtx) {
+	c.lock.Lock()
+	p := string(ctx.Path())
+	l := c.responses[p]
+	n := c.requests[p]
+	c.requests[p]++
+	c.lock.Unlock()
+
+	if len(l) == 0 {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+
+	r := l[min(n, len(l)-1)]
+	ctx.SetStatusCode(r.status)
+	ctx.SetContentType(r.contentType)
+	ctx.SetBody(r.body)
+}
+
+func (c *cdn) count(p string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.requests[p]
+}
+
+func fakeCDN(t *testing.T, responses map[string][]response) (*cdn, *fasthttp.HostClient) {
+	c := &cdn{responses: responses, requests: map[string]int{}}
+	ln := fasthttputil.NewInmemoryListener()
+	s := &fasthttp.Server{Handler: c.handle}
+	go s.Serve(ln)
+	t.Cleanup(func() {
+		s.Shutdown()
+	})
+
+	cl := &fasthttp.HostClient{
+		Addr: "fake-cdn",
+		Dial: func(string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	return c, cl
+}
+
+func uri(t *testing.T, p string) *fasthttp.URI {
+	u := fasthttp.AcquireURI()
+	t.Cleanup(func() {
+		fasthttp.ReleaseURI(u)
+	})
+
+	err := u.Parse(nil, []byte("http://fake-cdn"+p))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+func TestDownload(t *testing.T) {
+	old := backoff
+	backoff = time.Millisecond
+	t.Cleanup(func() {
+		backoff = old
+	})
+
+	ok := func(ct string, body []byte) response {
+		return response{200, ct, body}
+	}
+
+	c, cl := fakeCDN(t, map[string][]response{
+		"/ok.mp3":      {ok("audio/mpeg", mp3Segment)},
+		"/ok.m4s":      {ok("audio/mp4", mp4Segment)},
+		"/404.mp3":     {{404, "text/html", html}},
+		"/500.mp3":     {{500, "text/html", html}},
+		"/html.mp3":    {ok("text/html; charset=utf-8", html)},
+		"/json.m4s":    {ok("application/json", []byte(`{"error":"nope"}`))},
+		"/short.mp3":   {ok("audio/mpeg", mp3Segment[:10])},
+		"/empty.m4s":   {ok("audio/mp4", nil)},
+		"/nosync.mp3":  {ok("audio/mpeg", make([]byte, 1000))},
+		"/boxes.m4s":   {ok("audio/mp4", mp4Segment[:len(mp4Segment)-1])},
+		"/nomdat.m4s":  {ok("audio/mp4", box("moof", make([]byte, 100)))},
+		"/flaky.mp3":   {{503, "text/html", html}, ok("text/html", html), ok("audio/mpeg", mp3Segment)},
+		"/expired.mp3": {{403, "application/xml", []byte("<Error><Code>AccessDenied</Code></Error>")}},
+	})
+
+	good := []struct {
+		path     string
+		data     []byte
+		ext      string
+		requests int
+	}{
+		{"/ok.mp3", mp3Segment, ".mp3", 1},
+		{"/ok.m4s", mp4Segment, ".m4s", 1},
+		{"/flaky.mp3", mp3Segment, ".mp3", 3},
+	}
+
+	for _, tc := range good {
+		t.Run(tc.path, func(t *testing.T) {
+			t.Parallel()
+
+			data, ext, err := download(cl, uri(t, tc.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(data, tc.data) || ext != tc.ext {
+				t.Errorf("got %d bytes with ext %q, want %d bytes with %q", len(data), ext, len(tc.data), tc.ext)
+			}
+
+			if n := c.count(tc.path); n != tc.requests {
+				t.Errorf("%d requests, want %d", n, tc.requests)
+			}
+		})
+	}
+
+	bad := []string{"/404.mp3", "/500.mp3", "/html.mp3", "/json.m4s", "/short.mp3", "/empty.m4s", "/nosync.mp3", "/boxes.m4s", "/nomdat.m4s"}
+	for _, p := range bad {
+		t.Run(p, func(t *testing.T) {
+			t.Parallel()
+
+			data, _, err := download(cl, uri(t, p))
+			var fe *fiber.Error
+			if !errors.As(err, &fe) || fe.Code != fiber.StatusBadGateway {
+				t.Fatalf("got %v, want a 502", err)
+			}
+
+			if data != nil {
+				t.Errorf("got %d bytes with the error", len(data))
+			}
+
+			if n := c.count(p); n != attempts {
+				t.Errorf("%d requests, want %d", n, attempts)
+			}
+		})
+	}
+
+	t.Run("/expired.mp3", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := download(cl, uri(t, "/expired.mp3"))
+		if err != ErrExpired {
+			t.Fatalf("got %v, want ErrExpired", err)
+		}
+
+		// has to be renewed, retrying is no use
+		if n := c.count("/expired.mp3"); n != 1 {
+			t.Errorf("%d requests, want 1", n)
+		}
+	})
+}
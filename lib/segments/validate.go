@@ -0,0 +1,92 @@
+package segments
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// Checks that what the cdn sent is actually audio, so error pages don't end up in the middle of someone's download
+
+// smaller than any real segment (an mp3 frame alone is bigger), but catches empty responses
+const minSize = 64
+
+type badSegment struct {
+	reason string // for metrics: status, content_type, size, format
+	detail string
+}
+
+func (e badSegment) Error() string {
+	return "bad segment from cdn: " + e.detail
+}
+
+func validate(data []byte, contentType string, ext string) error {
+	ct := strings.ToLower(contentType)
+	if strings.HasPrefix(ct, "text/") || strings.Contains(ct, "html") || strings.Contains(ct, "xml") || strings.Contains(ct, "json") {
+		return badSegment{"content_type", "content type " + contentType}
+	}
+
+	if len(data) < minSize {
+		return badSegment{"size", "only got " + strconv.Itoa(len(data)) + " bytes"}
+	}
+
+	switch ext {
+	case ".mp3":
+		if !validMP3(data) {
+			return badSegment{"format", "no mpeg frame sync"}
+		}
+	case ".m4s", ".mp4":
+		if !validMP4(data) {
+			return badSegment{"format", "broken mp4 boxes"}
+		}
+	}
+
+	return nil
+}
+
+// id3 tag or mpeg frame sync (11 set bits) at the start
+func validMP3(b []byte) bool {
+	if string(b[:3]) == "ID3" {
+		return true
+	}
+
+	return b[0] == 0xFF && b[1]&0xE0 == 0xE0
+}
+
+// The top-level boxes have to add up to the whole thing. Init segments have a moov, media segments have moof and mdat
+func validMP4(b []byte) bool {
+	var moov, moof, mdat bool
+	for len(b) != 0 {
+		if len(b) < 8 {
+			return false
+		}
+
+		size := uint64(binary.BigEndian.Uint32(b))
+		switch size {
+		case 0: // until the end
+			size = uint64(len(b))
+		case 1: // 64-bit size after the type
+			if len(b) < 16 {
+				return false
+			}
+			size = binary.BigEndian.Uint64(b[8:])
+		}
+
+		if size < 8 || size > uint64(len(b)) {
+			return false
+		}
+
+		switch string(b[4:8]) {
+		case "moov":
+			moov = true
+		case "moof":
+			moof = true
+		case "mdat":
+			mdat = true
+		}
+
+		b = b[size:]
+	}
+
+	return moov || (moof && mdat)
+}
@@ -0,0 +1,73 @@
+package segments
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	// a 64-bit size box (size 1, real size after the type)
+	large := make([]byte, 16+1000)
+	binary.BigEndian.PutUint32(large, 1)
+	copy(large[4:], "mdat")
+	binary.BigEndian.PutUint64(large[8:], uint64(len(large)))
+
+	id3 := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x00"), mp3Segment...)
+	mp2 := append([]byte{0xFF, 0xF5}, make([]byte, 100)...) // sync bits with a different layer are still mpeg audio
+	initSegment := append(box("ftyp", []byte("iso6")), box("moov", make([]byte, 500))...)
+	untilEnd := append(box("moof", make([]byte, 100)), 0, 0, 0, 0, 'm', 'd', 'a', 't')
+	untilEnd = append(untilEnd, make([]byte, 500)...)
+
+	tests := []struct {
+		name        string
+		data        []byte
+		contentType string
+		ext         string
+		reason      string // empty if it's fine
+	}{
+		{"mp3", mp3Segment, "audio/mpeg", ".mp3", ""},
+		{"mp3 with id3", id3, "audio/mpeg", ".mp3", ""},
+		{"mpeg sync", mp2, "audio/mpeg", ".mp3", ""},
+		{"mp4", mp4Segment, "audio/mp4", ".m4s", ""},
+		{"init segment", initSegment, "audio/mp4", ".mp4", ""},
+		{"64-bit box", append(box("moof", make([]byte, 100)), large...), "audio/mp4", ".m4s", ""},
+		{"box until the end", untilEnd, "audio/mp4", ".m4s", ""},
+		{"no content type", mp3Segment, "", ".mp3", ""},
+		{"unknown ext", make([]byte, 100), "application/octet-stream", "", ""},
+
+		{"html", html, "text/html; charset=utf-8", ".mp3", "content_type"},
+		{"xml error", html, "application/xml", ".m4s", "content_type"},
+		{"json error", html, "application/json", ".mp3", "content_type"},
+		{"uppercase html", html, "Text/HTML", "", "content_type"},
+		{"empty", nil, "audio/mpeg", ".mp3", "size"},
+		{"short", mp3Segment[:minSize-1], "audio/mpeg", ".mp3", "size"},
+		{"no sync", make([]byte, 1000), "audio/mpeg", ".mp3", "format"},
+		{"html as audio", html, "audio/mpeg", ".mp3", "format"},
+		{"truncated box", mp4Segment[:len(mp4Segment)-1], "audio/mp4", ".m4s", "format"},
+		{"extra bytes", slices.Concat(mp4Segment, []byte{1, 2, 3}), "audio/mp4", ".m4s", "format"},
+		{"moof without mdat", box("moof", make([]byte, 100)), "audio/mp4", ".m4s", "format"},
+		{"mdat without moof", box("mdat", make([]byte, 100)), "audio/mp4", ".m4s", "format"},
+		{"box too small", append([]byte{0, 0, 0, 4, 'm', 'o', 'o', 'f'}, mp4Segment...), "audio/mp4", ".m4s", "format"},
+		{"short 64-bit box", slices.Concat(mp4Segment, []byte{0, 0, 0, 1, 'm', 'd', 'a', 't'}), "audio/mp4", ".m4s", "format"},
+		{"mp3 as mp4", mp3Segment, "audio/mp4", ".m4s", "format"},
+	}
+
+	for _, tc := range tests {
+		err := validate(tc.data, tc.contentType, tc.ext)
+		if tc.reason == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+
+			continue
+		}
+
+		bad, ok := err.(badSegment)
+		if !ok {
+			t.Errorf("%s: got %v, want a bad segment", tc.name, err)
+		} else if bad.reason != tc.reason {
+			t.Errorf("%s: got reason %q, want %q", tc.name, bad.reason, tc.reason)
+		}
+	}
+}
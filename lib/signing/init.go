@@ -0,0 +1,107 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+)
+
+// Signed urls for the proxies and streams. They get e (expiry, unix seconds) and s (signature) query args.
+// The signature covers the resource (the path for streams, the proxied url for images) and the expiry, so a link only works for that one thing, and only until it expires
+
+var ErrBadSignature = errors.New("bad or missing signature")
+var ErrExpired = errors.New("link expired")
+
+var key []byte
+
+func init() {
+	// don't use the same key as the cookies
+	h := hmac.New(sha256.New, []byte(cfg.CookieSecret))
+	h.Write([]byte("soundcloak signed urls"))
+	key = h.Sum(nil)
+}
+
+func sum(resource string, expires string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(resource))
+	h.Write([]byte{0})
+	h.Write([]byte(expires))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+// rounded up, so the url stays the same for a while and browsers can cache it
+func expiry(ttl time.Duration) int64 {
+	step := max(int64(ttl/4/time.Second), 1)
+	return (time.Now().Add(ttl).Unix()/step + 1) * step
+}
+
+// "e=...&s=...", or nothing if SignProxyURLs is off
+func Query(resource string, ttl time.Duration) string {
+	if !cfg.SignProxyURLs {
+		return ""
+	}
+
+	e := strconv.FormatInt(expiry(ttl), 10)
+	return "e=" + e + "&s=" + sum(resource, e)
+}
+
+// Signs u, which points to resource
+func URL(u string, resource string) string {
+	return URLFor(u, resource, cfg.SignedURLTTL)
+}
+
+func URLFor(u string, resource string, ttl time.Duration) string {
+	q := Query(resource, ttl)
+	if q == "" {
+		return u
+	}
+
+	if strings.IndexByte(u, '?') == -1 {
+		return u + "?" + q
+	}
+
+	return u + "&" + q
+}
+
+// Signed image proxy path for u
+func Image(u string) string {
+	return URL("/_/proxy/images?url="+url.QueryEscape(u), u)
+}
+
+func Verify(resource string, args *fasthttp.Args) error {
+	if !cfg.SignProxyURLs {
+		return nil
+	}
+
+	e, s := args.Peek("e"), args.Peek("s")
+	if len(e) == 0 || len(s) == 0 || !hmac.Equal([]byte(sum(resource, string(e))), s) {
+		return ErrBadSignature
+	}
+
+	n, err := strconv.ParseInt(string(e), 10, 64)
+	if err != nil || time.Now().Unix() > n {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// Verify for handlers
+func Check(c fiber.Ctx, resource string) error {
+	err := Verify(resource, c.RequestCtx().QueryArgs())
+	if err != nil {
+		return fiber.NewError(fiber.StatusForbidden, err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,580 @@
+package subsonic
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+
+	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	proxyimages "git.maid.zone/stuff/soundcloak/lib/proxy_images"
+	"git.maid.zone/stuff/soundcloak/lib/restream"
+	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
+)
+
+// Subset of the Subsonic API (https://opensubsonic.netlify.app/docs/), so Subsonic clients can browse and play stuff.
+// Users are artists, their albums and playlists are albums (plus one album with all of their tracks), playlists are playlists.
+// IDs are permalinks with a prefix, so we can use the same lookups (and caches) as the rest of soundcloak:
+//   ar-<user>                  artist
+//   al-<user>                  latest tracks of user
+//   al-<user>/sets/<playlist>  album
+//   pl-<user>/sets/<playlist>  playlist
+//   tr-<user>/<track>          track
+// Cover art uses the id of whatever it's for
+
+const (
+	prefixArtist   = "ar-"
+	prefixAlbum    = "al-"
+	prefixPlaylist = "pl-"
+	prefixTrack    = "tr-"
+)
+
+// how many tracks to put in the "all tracks" album of a user
+const userTracksLimit = "limit=200"
+
+// images aren't Postfix'd, getCoverArt proxies them itself
+var prefs = cfg.Preferences{ProxyImages: &cfg.False}
+
+var errMissing = errors.New("required parameter is missing")
+
+type subsonicError struct {
+	code int
+	err  error
+}
+
+func (e subsonicError) Error() string {
+	return e.err.Error()
+}
+
+func fail(code int, err error) error {
+	return subsonicError{code, err}
+}
+
+// query args or form body, clients use both
+func arg(c fiber.Ctx, key string) string {
+	if v := c.Query(key); v != "" {
+		return v
+	}
+
+	return c.FormValue(key)
+}
+
+func id(c fiber.Ctx, prefix string) (string, error) {
+	v := arg(c, "id")
+	if v == "" {
+		return "", fail(errMissingParam, errMissing)
+	}
+
+	v, ok := strings.CutPrefix(v, prefix)
+	if !ok || v == "" {
+		return "", fail(errNotFound, errors.New("unknown id"))
+	}
+
+	return v, nil
+}
+
+func authorized(c fiber.Ctx) bool {
+	if arg(c, "u") != cfg.SubsonicUser {
+		return false
+	}
+
+	// token auth: t = md5(password + s)
+	if t := arg(c, "t"); t != "" {
+		sum := md5.Sum([]byte(cfg.SubsonicPassword + arg(c, "s")))
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(t)), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+
+	p := arg(c, "p")
+	if enc, ok := strings.CutPrefix(p, "enc:"); ok {
+		b, err := hex.DecodeString(enc)
+		if err != nil {
+			return false
+		}
+		p = string(b)
+	}
+
+	return p != "" && subtle.ConstantTimeCompare([]byte(p), []byte(cfg.SubsonicPassword)) == 1
+}
+
+func send(c fiber.Ctx, r *Response) error {
+	r.XMLNS = "http://subsonic.org/restapi"
+	r.Version = apiVersion
+	r.Type = "soundcloak"
+	r.ServerVersion = cfg.Commit
+	r.OpenSubsonic = true
+	if r.Status == "" {
+		r.Status = "ok"
+	}
+
+	if arg(c, "f") == "json" {
+		return c.JSON(fiber.Map{"subsonic-response": r})
+	}
+
+	data, err := xml.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header.SetContentType("text/xml; charset=utf-8")
+	return c.Send(append([]byte(xml.Header), data...))
+}
+
+// Subsonic clients want errors in the response body, with 200 status
+func sendError(c fiber.Ctx, err error) error {
+	var se subsonicError
+	if !errors.As(err, &se) {
+		se = subsonicError{errGeneric, err}
+		if errors.Is(err, sc.ErrKindNotCorrect) || errors.Is(err, sc.ErrBlocked) {
+			se.code = errNotFound
+		}
+	}
+
+	return send(c, &Response{Status: "failed", Error: &Error{Code: se.code, Message: se.Error()}})
+}
+
+// Converting
+
+func year(t string) int {
+	parsed, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return 0
+	}
+
+	return parsed.Year()
+}
+
+func song(t *sc.Track, album *Album) Song {
+	s := Song{
+		ID:          prefixTrack + t.Href()[1:],
+		Title:       t.Title,
+		Artist:      t.Author.Username,
+		ArtistID:    prefixArtist + t.Author.Permalink,
+		Genre:       t.Genre,
+		Year:        year(t.CreatedAt),
+		Duration:    t.Duration / 1000,
+		ContentType: "audio/mpeg",
+		Suffix:      "mp3",
+		Type:        "music",
+		Created:     t.CreatedAt,
+	}
+
+	if t.Artwork != "" || t.Author.Avatar != "" {
+		s.CoverArt = s.ID
+	}
+
+	if album != nil {
+		s.Parent = album.ID
+		s.Album = album.Name
+		s.AlbumID = album.ID
+	}
+
+	return s
+}
+
+func album(p *sc.Playlist) Album {
+	a := Album{
+		ID:        prefixAlbum + p.Href()[1:],
+		Name:      p.Title,
+		Artist:    p.Author.Username,
+		ArtistID:  prefixArtist + p.Author.Permalink,
+		SongCount: p.TracksCount(),
+		Year:      year(p.CreatedAt),
+		Created:   p.CreatedAt,
+	}
+
+	if p.Artwork != "" {
+		a.CoverArt = a.ID
+	}
+
+	for _, t := range p.Tracks {
+		a.Duration += t.Duration / 1000
+	}
+
+	return a
+}
+
+// pseudo album with latest tracks
+func userAlbum(u *sc.User) Album {
+	a := Album{
+		ID:        prefixAlbum + u.Permalink,
+		Name:      "Tracks by " + u.Username,
+		Artist:    u.Username,
+		ArtistID:  prefixArtist + u.Permalink,
+		SongCount: min(u.Tracks, 200),
+		Created:   u.CreatedAt,
+	}
+
+	if u.Avatar != "" {
+		a.CoverArt = a.ID
+	}
+
+	return a
+}
+
+func artist(u *sc.User) Artist {
+	a := Artist{
+		ID:         prefixArtist + u.Permalink,
+		Name:       u.Username,
+		AlbumCount: 1,
+	}
+
+	if u.Avatar != "" {
+		a.CoverArt = a.ID
+	}
+
+	return a
+}
+
+// whole playlist, with all missing tracks loaded
+func getPlaylist(permalink string) (sc.Playlist, error) {
+	p, err := sc.GetPlaylist(permalink)
+	if err != nil {
+		return p, err
+	}
+
+	err = p.GetAllMissingTracks()
+	return p, err
+}
+
+// Methods
+
+func ping(c fiber.Ctx) (*Response, error) {
+	return &Response{}, nil
+}
+
+func getLicense(c fiber.Ctx) (*Response, error) {
+	return &Response{License: &License{Valid: true}}, nil
+}
+
+func getOpenSubsonicExtensions(c fiber.Ctx) (*Response, error) {
+	return &Response{OpenSubsonicExtensions: &[]Extension{}}, nil
+}
+
+func count(c fiber.Ctx, key string) (string, bool) {
+	n, err := strconv.Atoi(arg(c, key+"Count"))
+	if err != nil {
+		n = 20
+	}
+	n = min(n, 100)
+
+	offset, _ := strconv.Atoi(arg(c, key+"Offset"))
+	return "limit=" + strconv.Itoa(n) + "&offset=" + strconv.Itoa(max(offset, 0)), n > 0
+}
+
+func search3(c fiber.Ctx) (*Response, error) {
+	// some clients search for "" (or "\"\"") to sync the whole library, we don't have one
+	q := strings.Trim(arg(c, "query"), `"`)
+	res := &SearchResult3{}
+	if q == "" {
+		return &Response{SearchResult3: res}, nil
+	}
+
+	opts := sc.SearchOptions{Query: q}
+	if args, ok := count(c, "artist"); ok {
+		p, err := sc.SearchUsers(prefs, opts, []byte(args))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range p.Collection {
+			res.Artists = append(res.Artists, artist(u))
+		}
+	}
+
+	if args, ok := count(c, "album"); ok {
+		p, err := sc.SearchPlaylists(prefs, opts, []byte(args))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pl := range p.Collection {
+			res.Albums = append(res.Albums, album(pl))
+		}
+	}
+
+	if args, ok := count(c, "song"); ok {
+		p, err := sc.SearchTracks(prefs, opts, []byte(args))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range p.Collection {
+			res.Songs = append(res.Songs, song(t, nil))
+		}
+	}
+
+	return &Response{SearchResult3: res}, nil
+}
+
+func getArtist(c fiber.Ctx) (*Response, error) {
+	permalink, err := id(c, prefixArtist)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := sc.GetUser(permalink)
+	if err != nil {
+		return nil, err
+	}
+
+	a := artist(&u)
+	a.Albums = []Album{userAlbum(&u)}
+
+	albums, err := u.GetAlbums(prefs, "limit=50")
+	if err != nil {
+		return nil, err
+	}
+
+	playlists, err := u.GetPlaylists(prefs, "limit=50")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range append(albums.Collection, playlists.Collection...) {
+		a.Albums = append(a.Albums, album(p))
+	}
+	a.AlbumCount = len(a.Albums)
+
+	return &Response{Artist: &a}, nil
+}
+
+func getAlbum(c fiber.Ctx) (*Response, error) {
+	permalink, err := id(c, prefixAlbum)
+	if err != nil {
+		return nil, err
+	}
+
+	var a Album
+	if !strings.Contains(permalink, "/") {
+		u, err := sc.GetUser(permalink)
+		if err != nil {
+			return nil, err
+		}
+
+		tracks, err := u.GetTracks(prefs, userTracksLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		a = userAlbum(&u)
+		a.SongCount = int64(len(tracks.Collection))
+		for _, t := range tracks.Collection {
+			a.Songs = append(a.Songs, song(t, &a))
+			a.Duration += t.Duration / 1000
+		}
+
+		return &Response{Album: &a}, nil
+	}
+
+	p, err := getPlaylist(permalink)
+	if err != nil {
+		return nil, err
+	}
+
+	a = album(&p)
+	for _, t := range p.Tracks {
+		if t.Title != "" {
+			a.Songs = append(a.Songs, song(&t, &a))
+		}
+	}
+
+	return &Response{Album: &a}, nil
+}
+
+// no accounts, so nobody has their own playlists
+func getPlaylists(c fiber.Ctx) (*Response, error) {
+	return &Response{Playlists: &Playlists{Playlists: []Playlist{}}}, nil
+}
+
+func getPlaylistMethod(c fiber.Ctx) (*Response, error) {
+	permalink, err := id(c, prefixPlaylist)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := getPlaylist(permalink)
+	if err != nil {
+		return nil, err
+	}
+
+	pl := Playlist{
+		ID:        prefixPlaylist + permalink,
+		Name:      p.Title,
+		Comment:   p.Description,
+		Owner:     p.Author.Username,
+		Public:    true,
+		SongCount: p.TracksCount(),
+		Created:   p.CreatedAt,
+		Changed:   p.LastModified,
+	}
+	if p.Artwork != "" {
+		pl.CoverArt = pl.ID
+	}
+
+	for _, t := range p.Tracks {
+		if t.Title != "" {
+			pl.Entries = append(pl.Entries, song(&t, nil))
+			pl.Duration += t.Duration / 1000
+		}
+	}
+
+	return &Response{Playlist: &pl}, nil
+}
+
+// soundcloud doesn't have lyrics
+func getLyrics(c fiber.Ctx) (*Response, error) {
+	return &Response{Lyrics: &Lyrics{Artist: arg(c, "artist"), Title: arg(c, "title")}}, nil
+}
+
+// Binary methods, they only send a subsonic response on errors
+
+func stream(c fiber.Ctx) error {
+	permalink, err := id(c, prefixTrack)
+	if err != nil {
+		return err
+	}
+
+	t, err := sc.GetTrack(permalink)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.Restream {
+		return c.Redirect().To(signing.URL("/_/api/progressive/"+permalink, "/_/api/progressive/"+permalink))
+	}
+
+	quality := cfg.AudioMP3
+	if f := arg(c, "format"); f == "aac" || f == "m4a" {
+		quality = cfg.AudioAAC
+	}
+
+	return restream.Stream(c, t, quality, false)
+}
+
+var sizes = strings.NewReplacer("-t500x500.", "-original.", "-t200x200.", "-original.", "-large.", "-original.")
+
+func getCoverArt(c fiber.Ctx) error {
+	v := arg(c, "id")
+	if v == "" {
+		return fail(errMissingParam, errMissing)
+	}
+
+	prefix, permalink := v[:min(len(v), len(prefixTrack))], v[min(len(v), len(prefixTrack)):]
+	var img string
+	switch prefix {
+	case prefixTrack:
+		t, err := sc.GetTrack(permalink)
+		if err != nil {
+			return err
+		}
+
+		img = t.Artwork
+		if img == "" {
+			img = t.Author.Avatar
+		}
+	case prefixAlbum, prefixPlaylist:
+		if !strings.Contains(permalink, "/") {
+			u, err := sc.GetUser(permalink)
+			if err != nil {
+				return err
+			}
+
+			img = u.Avatar
+			break
+		}
+
+		p, err := sc.GetPlaylist(permalink)
+		if err != nil {
+			return err
+		}
+
+		img = p.Artwork
+	case prefixArtist:
+		u, err := sc.GetUser(permalink)
+		if err != nil {
+			return err
+		}
+
+		img = u.Avatar
+	}
+
+	if img == "" {
+		return fail(errNotFound, errors.New("no cover art"))
+	}
+
+	var opts proxyimages.Options
+	if size, _ := strconv.Atoi(arg(c, "size")); size > 500 {
+		img = sizes.Replace(img)
+	} else if size > 0 {
+		opts.Size = size
+	}
+
+	if cfg.ProxyImages {
+		return proxyimages.Serve(c, []byte(img), opts)
+	}
+
+	return c.Redirect().To(img)
+}
+
+func Load(r *fiber.App) {
+	if cfg.SubsonicPassword == "" {
+		logging.Module("subsonic").Warn("EnableSubsonic is enabled, but SubsonicPassword is not set. Subsonic API will not be available")
+		return
+	}
+
+	methods := map[string]func(c fiber.Ctx) (*Response, error){
+		"ping":                      ping,
+		"getLicense":                getLicense,
+		"getOpenSubsonicExtensions": getOpenSubsonicExtensions,
+		"search3":                   search3,
+		"getArtist":                 getArtist,
+		"getAlbum":                  getAlbum,
+		"getPlaylists":              getPlaylists,
+		"getPlaylist":               getPlaylistMethod,
+		"getLyrics":                 getLyrics,
+	}
+
+	binary := map[string]func(c fiber.Ctx) error{
+		"stream":      stream,
+		"download":    stream,
+		"getCoverArt": getCoverArt,
+	}
+
+	r.All("/rest/:method", func(c fiber.Ctx) error {
+		name := strings.TrimSuffix(c.Params("method"), ".view")
+		if !authorized(c) {
+			return sendError(c, fail(errWrongAuth, errors.New("wrong username or password")))
+		}
+
+		if m, ok := methods[name]; ok {
+			res, err := m(c)
+			if err != nil {
+				return sendError(c, err)
+			}
+
+			return send(c, res)
+		}
+
+		if m, ok := binary[name]; ok {
+			err := m(c)
+			if err != nil {
+				// the response could have been partially filled already
+				c.Response().ResetBody()
+				c.Status(fiber.StatusOK)
+				return sendError(c, err)
+			}
+
+			return nil
+		}
+
+		return sendError(c, fail(errNotFound, errors.New("method not implemented")))
+	})
+}
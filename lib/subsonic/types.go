@@ -0,0 +1,122 @@
+package subsonic
+
+import "encoding/xml"
+
+// Subsonic response types. Same structure for XML and JSON, attributes in XML are plain fields in JSON.
+// Only the fields we can actually fill in are here, clients are fine with the rest missing
+
+const apiVersion = "1.16.1"
+
+type Response struct {
+	XMLName       xml.Name `xml:"subsonic-response" json:"-"`
+	XMLNS         string   `xml:"xmlns,attr" json:"-"`
+	Status        string   `xml:"status,attr" json:"status"`
+	Version       string   `xml:"version,attr" json:"version"`
+	Type          string   `xml:"type,attr" json:"type"`
+	ServerVersion string   `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool     `xml:"openSubsonic,attr" json:"openSubsonic"`
+
+	Error                  *Error         `xml:"error,omitempty" json:"error,omitempty"`
+	License                *License       `xml:"license,omitempty" json:"license,omitempty"`
+	OpenSubsonicExtensions *[]Extension   `xml:"openSubsonicExtensions,omitempty" json:"openSubsonicExtensions,omitempty"`
+	SearchResult3          *SearchResult3 `xml:"searchResult3,omitempty" json:"searchResult3,omitempty"`
+	Artist                 *Artist        `xml:"artist,omitempty" json:"artist,omitempty"`
+	Album                  *Album         `xml:"album,omitempty" json:"album,omitempty"`
+	Playlists              *Playlists     `xml:"playlists,omitempty" json:"playlists,omitempty"`
+	Playlist               *Playlist      `xml:"playlist,omitempty" json:"playlist,omitempty"`
+	Lyrics                 *Lyrics        `xml:"lyrics,omitempty" json:"lyrics,omitempty"`
+}
+
+type Error struct {
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
+}
+
+// error codes from the spec
+const (
+	errGeneric      = 0
+	errMissingParam = 10
+	errWrongAuth    = 40
+	errNotFound     = 70
+)
+
+type License struct {
+	Valid bool `xml:"valid,attr" json:"valid"`
+}
+
+type Extension struct {
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions" json:"versions"`
+}
+
+type Song struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Parent      string `xml:"parent,attr,omitempty" json:"parent,omitempty"`
+	IsDir       bool   `xml:"isDir,attr" json:"isDir"`
+	Title       string `xml:"title,attr" json:"title"`
+	Album       string `xml:"album,attr,omitempty" json:"album,omitempty"`
+	AlbumID     string `xml:"albumId,attr,omitempty" json:"albumId,omitempty"`
+	Artist      string `xml:"artist,attr" json:"artist"`
+	ArtistID    string `xml:"artistId,attr" json:"artistId"`
+	CoverArt    string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Genre       string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Year        int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Duration    uint32 `xml:"duration,attr" json:"duration"` // seconds
+	ContentType string `xml:"contentType,attr" json:"contentType"`
+	Suffix      string `xml:"suffix,attr" json:"suffix"`
+	Type        string `xml:"type,attr" json:"type"`
+	Created     string `xml:"created,attr,omitempty" json:"created,omitempty"`
+}
+
+type Album struct {
+	ID        string `xml:"id,attr" json:"id"`
+	Name      string `xml:"name,attr" json:"name"`
+	Artist    string `xml:"artist,attr" json:"artist"`
+	ArtistID  string `xml:"artistId,attr" json:"artistId"`
+	CoverArt  string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	SongCount int64  `xml:"songCount,attr" json:"songCount"`
+	Duration  uint32 `xml:"duration,attr" json:"duration"` // seconds
+	Genre     string `xml:"genre,attr,omitempty" json:"genre,omitempty"`
+	Year      int    `xml:"year,attr,omitempty" json:"year,omitempty"`
+	Created   string `xml:"created,attr,omitempty" json:"created,omitempty"`
+	Songs     []Song `xml:"song,omitempty" json:"song,omitempty"`
+}
+
+type Artist struct {
+	ID             string  `xml:"id,attr" json:"id"`
+	Name           string  `xml:"name,attr" json:"name"`
+	CoverArt       string  `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	ArtistImageURL string  `xml:"artistImageUrl,attr,omitempty" json:"artistImageUrl,omitempty"`
+	AlbumCount     int     `xml:"albumCount,attr" json:"albumCount"`
+	Albums         []Album `xml:"album,omitempty" json:"album,omitempty"`
+}
+
+type Playlists struct {
+	Playlists []Playlist `xml:"playlist" json:"playlist"`
+}
+
+type Playlist struct {
+	ID        string `xml:"id,attr" json:"id"`
+	Name      string `xml:"name,attr" json:"name"`
+	Comment   string `xml:"comment,attr,omitempty" json:"comment,omitempty"`
+	Owner     string `xml:"owner,attr" json:"owner"`
+	Public    bool   `xml:"public,attr" json:"public"`
+	SongCount int64  `xml:"songCount,attr" json:"songCount"`
+	Duration  uint32 `xml:"duration,attr" json:"duration"` // seconds
+	CoverArt  string `xml:"coverArt,attr,omitempty" json:"coverArt,omitempty"`
+	Created   string `xml:"created,attr" json:"created"`
+	Changed   string `xml:"changed,attr" json:"changed"`
+	Entries   []Song `xml:"entry,omitempty" json:"entry,omitempty"`
+}
+
+type SearchResult3 struct {
+	Artists []Artist `xml:"artist" json:"artist"`
+	Albums  []Album  `xml:"album" json:"album"`
+	Songs   []Song   `xml:"song" json:"song"`
+}
+
+type Lyrics struct {
+	Artist string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Title  string `xml:"title,attr,omitempty" json:"title,omitempty"`
+	Value  string `xml:",chardata" json:"value"`
+}
@@ -3,16 +3,20 @@ package main
 import (
 	"bytes"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"html"
 	"io"
 	"io/fs"
-	"log"
 	"math/rand"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"git.maid.zone/stuff/soundcloak/lib/admin"
 	"git.maid.zone/stuff/soundcloak/lib/api"
 	"git.maid.zone/stuff/soundcloak/lib/misc"
 	"github.com/a-h/templ"
@@ -24,11 +28,19 @@ import (
 	"github.com/valyala/fasthttp"
 
 	"git.maid.zone/stuff/soundcloak/lib/cfg"
+	"git.maid.zone/stuff/soundcloak/lib/following"
+	"git.maid.zone/stuff/soundcloak/lib/health"
+	"git.maid.zone/stuff/soundcloak/lib/library"
+	"git.maid.zone/stuff/soundcloak/lib/logging"
+	"git.maid.zone/stuff/soundcloak/lib/metrics"
 	"git.maid.zone/stuff/soundcloak/lib/preferences"
 	proxyimages "git.maid.zone/stuff/soundcloak/lib/proxy_images"
 	proxystreams "git.maid.zone/stuff/soundcloak/lib/proxy_streams"
+	"git.maid.zone/stuff/soundcloak/lib/ratelimit"
 	"git.maid.zone/stuff/soundcloak/lib/restream"
 	"git.maid.zone/stuff/soundcloak/lib/sc"
+	"git.maid.zone/stuff/soundcloak/lib/signing"
+	"git.maid.zone/stuff/soundcloak/lib/subsonic"
 	"git.maid.zone/stuff/soundcloak/templates"
 
 	static_files "git.maid.zone/stuff/soundcloak/static"
@@ -260,16 +272,175 @@ func ServeFS(r *fiber.App, filesystem fs.FS) {
 	}
 }
 
-func render(c fiber.Ctx, t templ.Component) error {
-	c.Response().Header.SetContentType("text/html")
-	return t.Render(c.RequestCtx(), c.Response().BodyWriter())
+// Accept: application/json or ?format=json
+func wantsJSON(c fiber.Ctx) bool {
+	c.Vary("Accept")
+	return string(c.RequestCtx().QueryArgs().Peek("format")) == "json" ||
+		c.Accepts("text/html", "application/json") == "application/json"
 }
 
-func r(c fiber.Ctx, title string, content, head templ.Component) error {
-	return render(c, templates.Base(title, content, head))
+// data is what gets sent instead of the page if the client wants json, nil if the page has no json variant
+func r(c fiber.Ctx, data any, title string, content, head templ.Component) error {
+	if data != nil && wantsJSON(c) {
+		return c.JSON(data)
+	}
+
+	return misc.Render(c, templates.Base(title, content, head))
 }
 
+// Feed format from the extension (/_/rss/user.atom) or the Accept header (RSS by default). Returns the param without the extension
+func feedFormat(c fiber.Ctx, param string) (string, string) {
+	name, format := sc.FeedFormat(param)
+	if format != "" {
+		return name, format
+	}
+
+	c.Vary("Accept")
+	switch c.Accepts(sc.FeedContentTypes[sc.FeedRSS], sc.FeedContentTypes[sc.FeedAtom], sc.FeedContentTypes[sc.FeedJSON], "application/json") {
+	case sc.FeedContentTypes[sc.FeedAtom]:
+		return name, sc.FeedAtom
+	case sc.FeedContentTypes[sc.FeedJSON], "application/json":
+		return name, sc.FeedJSON
+	}
+
+	return name, sc.FeedRSS
+}
+
+// Preferences and enclosure audio preset for feeds, both can be overriden with query args
+func feedOptions(c fiber.Ctx) (cfg.Preferences, string, error) {
+	prefs, err := preferences.Get(c)
+	if err != nil {
+		return prefs, "", err
+	}
+
+	if cfg.ProxyImages {
+		b := c.RequestCtx().QueryArgs().Peek("proxy_images")
+		if b != nil {
+			prefs.ProxyImages = boolean2(b)
+		}
+	}
+
+	// mp3 by default, it's what podcast apps handle best
+	audio := cfg.AudioMP3
+	if c.Query("audio") == cfg.AudioAAC {
+		audio = cfg.AudioAAC
+	}
+
+	return prefs, audio, nil
+}
+
+// Weak comparison, the etag is weak since the body might get compressed
+func etagMatches(header string, etag string) bool {
+	if header == "*" {
+		return true
+	}
+
+	for _, e := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(e), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The query args feeds understand, normalized. Used for the cache key and the self link, so made up args don't make new cache entries (and upstream requests)
+func feedQuery(c fiber.Ctx, self string, audio string) string {
+	in := c.RequestCtx().QueryArgs()
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+
+	switch self {
+	case "/_/rss/_/search":
+		args.Parse(sc.ParseSearchOptions(in).Encode())
+	case "/_/rss/_/following":
+		args.SetBytesV("list", in.Peek("list"))
+	}
+
+	if cfg.ProxyImages {
+		if b := in.Peek("proxy_images"); b != nil {
+			args.Set("proxy_images", strconv.FormatBool(*boolean2(b)))
+		}
+	}
+
+	if audio != cfg.AudioMP3 {
+		args.Set("audio", audio)
+	}
+
+	return string(args.QueryString())
+}
+
+// Generated feeds are cached per url, format and preferences. Conditional requests (If-None-Match) get a 304
+func serveFeed(c fiber.Ctx, format string, generate func(prefs cfg.Preferences, audio string) (*sc.Feed, error)) error {
+	prefs, audio, err := feedOptions(c)
+	if err != nil {
+		return err
+	}
+
+	base := c.BaseURL()
+	self, _ := sc.FeedFormat(c.Path())
+	query := feedQuery(c, self, audio)
+	key := format + " " + strconv.FormatBool(*prefs.ProxyImages) + strconv.FormatBool(*prefs.ParseDescriptions) + " " + base + self + "?" + query
+
+	f, err := sc.GetFeed(key, format, func() (*sc.Feed, error) {
+		f, err := generate(prefs, audio)
+		if err != nil {
+			return nil, err
+		}
+
+		f.Self = base + self
+		f.Query = query
+		return f, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	etag := `W/"` + format + "-" + f.ETag + `"`
+	c.Set("ETag", etag)
+	// not Updated, that's the newest item's date, and reposting/liking/adding an old track doesn't change it
+	c.Response().Header.SetLastModified(f.Generated)
+	c.Set("Cache-Control", "private, max-age="+strconv.Itoa(int(time.Until(f.Expires)/time.Second)))
+
+	if inm := c.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, etag) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+	} else if ims, err := fasthttp.ParseHTTPDate([]byte(c.Get("If-Modified-Since"))); err == nil && !f.Generated.After(ims) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	c.RequestCtx().SetContentType(sc.FeedContentTypes[format])
+	return c.Send(f.Data)
+}
+
+// Playlist files (m3u8/xspf/pls). Takes the same query args as feeds
+func serveExport(c fiber.Ctx, name string, format string, generate func(prefs cfg.Preferences, audio string) (*sc.Export, error)) error {
+	prefs, audio, err := feedOptions(c)
+	if err != nil {
+		return err
+	}
+
+	e, err := generate(prefs, audio)
+	if err != nil {
+		return err
+	}
+
+	data, err := e.Marshal(format)
+	if err != nil {
+		return err
+	}
+
+	c.RequestCtx().SetContentType(sc.ExportContentTypes[format])
+	c.Set("Content-Disposition", `inline; filename="`+strings.ReplaceAll(name, `"`, "")+"."+format+`"`)
+	return c.Send(data)
+}
+
+var logger = logging.Module("main")
+
 func main() {
+	sc.LoadClientID()
+
 	app := fiber.New(fiber.Config{
 		JSONEncoder: json.Marshal,
 		JSONDecoder: json.Unmarshal,
@@ -277,11 +448,24 @@ func main() {
 		TrustProxy:       cfg.TrustedProxyCheck,
 		TrustProxyConfig: fiber.TrustProxyConfig{Proxies: cfg.TrustedProxies},
 		ReadBufferSize:   4096 * 2,
+
+		ErrorHandler: func(c fiber.Ctx, err error) error {
+			if errors.Is(err, sc.ErrBlocked) {
+				c.Status(fiber.StatusUnavailableForLegalReasons)
+				// api, proxies and such just get the message
+				if strings.HasPrefix(c.Path(), "/_/") {
+					return c.SendString(cfg.BlockedMessage)
+				}
+
+				return misc.Render(c, templates.Base("unavailable", templates.Blocked(), nil))
+			}
+
+			return fiber.DefaultErrorHandler(c, err)
+		},
 	})
 
-	if cfg.Debug {
-		app.Server().Logger = fasthttp.Logger(log.New(os.Stdout, "", log.LstdFlags))
-	}
+	// first, so everything after has request ids
+	logging.Load(app)
 
 	if !cfg.Debug { // you wanna catch any possible panics as soon as possible
 		app.Use(recover.New())
@@ -294,12 +478,32 @@ func main() {
 			const x = "/_/api"
 			const y = "/_/proxy"
 			const z = "/_/static"
+			// binary subsonic methods
+			const w = "/rest/"
+			if len(p) > len(w) && string(p[:len(w)]) == w {
+				m := string(p[len(w):])
+				return strings.HasPrefix(m, "stream") || strings.HasPrefix(m, "download") || strings.HasPrefix(m, "getCoverArt")
+			}
 			return len(p) > len(z) && (string(p[:len(x)]) == x || string(p[:len(y)]) == y || string(p[:len(z)]) == z)
 			//return strings.HasPrefix(c.Path(), "/_/static")
 		},
 		Level: compress.LevelBestSpeed,
 	}))
 
+	if cfg.EnableMetrics {
+		metrics.Load(app)
+	}
+
+	health.Load(app)
+
+	if cfg.RateLimit {
+		ratelimit.Load(app)
+	}
+
+	if cfg.AdminToken != "" {
+		admin.Load(app)
+	}
+
 	// Just for easy inspection of cache in development. Since debug is constant, the compiler will just remove the code below if it's set to false, so this has no runtime overhead.
 	if cfg.Debug {
 		app.Get("/_/cachedump/tracks", func(c fiber.Ctx) error {
@@ -329,7 +533,7 @@ func main() {
 				return err
 			}
 
-			return r(c, "", templates.MainPage(prefs), templates.MainPageHead(prefs))
+			return r(c, nil, "", templates.MainPage(prefs), templates.MainPageHead(prefs))
 		}
 
 		app.Get("/", mainPageHandler)
@@ -370,57 +574,46 @@ Disallow: /`)
 			return err
 		}
 
-		q := c.RequestCtx().QueryArgs().Peek("q")
+		opts := sc.ParseSearchOptions(c.RequestCtx().QueryArgs())
 		t := cfg.B2s(c.RequestCtx().QueryArgs().Peek("type"))
 		args := c.RequestCtx().QueryArgs().Peek("pagination")
-		if len(args) == 0 {
-			args = fasthttp.AppendQuotedArg([]byte("q="), q)
-		} else if len(q) == 0 {
-			i := bytes.LastIndexByte(args, '&')
-			if i != -1 {
-				q = fasthttp.AppendUnquotedArg(q, args[i+len("&q="):])
-			}
-		}
+		opts.FromPagination(args)
 
 		switch t {
 		case "any":
-			q := cfg.B2s(q)
-			p, err := sc.Search(prefs, args)
+			p, err := sc.Search(prefs, opts, args)
 			if err != nil {
-				log.Printf("error getting any for %s: %s\n", q, err)
+				logger.Request(c).Warn("error searching", logging.Private("query", opts.Query), logging.Err(err))
 				return err
 			}
 
-			return r(c, q, templates.Search(p, prefs, q), templates.MainPageHead(prefs))
+			return r(c, fiber.Map{"search": opts, "results": p}, opts.Query, templates.Search(p, prefs, opts), templates.MainPageHead(prefs))
 		case "tracks":
-			q := cfg.B2s(q)
-			p, err := sc.SearchTracks(prefs, args)
+			p, err := sc.SearchTracks(prefs, opts, args)
 			if err != nil {
-				log.Printf("error getting tracks for %s: %s\n", q, err)
+				logger.Request(c).Warn("error searching tracks", logging.Private("query", opts.Query), logging.Err(err))
 				return err
 			}
 
-			return r(c, "tracks: "+q, templates.SearchTracks(p, prefs, q), templates.MainPageHead(prefs))
+			return r(c, fiber.Map{"search": opts, "results": p}, "tracks: "+opts.Query, templates.SearchTracks(p, prefs, opts), templates.MainPageHead(prefs))
 
 		case "users":
-			q := cfg.B2s(q)
-			p, err := sc.SearchUsers(prefs, args)
+			p, err := sc.SearchUsers(prefs, opts, args)
 			if err != nil {
-				log.Printf("error getting users for %s: %s\n", q, err)
+				logger.Request(c).Warn("error searching users", logging.Private("query", opts.Query), logging.Err(err))
 				return err
 			}
 
-			return r(c, "users: "+q, templates.SearchUsers(p, prefs, q), templates.MainPageHead(prefs))
+			return r(c, fiber.Map{"search": opts, "results": p}, "users: "+opts.Query, templates.SearchUsers(p, prefs, opts), templates.MainPageHead(prefs))
 
 		case "playlists":
-			q := cfg.B2s(q)
-			p, err := sc.SearchPlaylists(prefs, args)
+			p, err := sc.SearchPlaylists(prefs, opts, args)
 			if err != nil {
-				log.Printf("error getting playlists for %s: %s\n", q, err)
+				logger.Request(c).Warn("error searching playlists", logging.Private("query", opts.Query), logging.Err(err))
 				return err
 			}
 
-			return r(c, "playlists: "+q, templates.SearchPlaylists(p, prefs, q), templates.MainPageHead(prefs))
+			return r(c, fiber.Map{"search": opts, "results": p}, "playlists: "+opts.Query, templates.SearchPlaylists(p, prefs, opts), templates.MainPageHead(prefs))
 		}
 
 		return c.SendStatus(404)
@@ -432,9 +625,8 @@ Disallow: /`)
 		return c.Redirect().To("/")
 	})
 
-	app.Get("/feed", func(c fiber.Ctx) error {
-		return c.Redirect().To("/")
-	})
+	// /feed is ours now, see lib/following
+	following.Load(app)
 
 	app.Get("/on/:id", func(c fiber.Ctx) error {
 		id := c.Params("id")
@@ -481,9 +673,67 @@ Disallow: /`)
 			return err
 		}
 
+		if strings.Contains(u, "/sets/") {
+			p, err := sc.GetArbitraryPlaylist(u)
+			if err != nil {
+				logger.Request(c).Warn("error getting embed", logging.Private("url", u), logging.Err(err))
+				return err
+			}
+
+			if len(p.Tracks) == 0 {
+				return fiber.ErrNotFound
+			}
+
+			current, _ := strconv.Atoi(c.Query("track"))
+			if current < 0 || current >= len(p.Tracks) {
+				current = 0
+			}
+
+			err = p.GetMissingTracksAt(current)
+			if err != nil {
+				logger.Request(c).Warn("error getting embed playlist tracks", logging.Private("url", u), logging.Err(err))
+				return err
+			}
+			p.Tracks = p.Postfix(prefs, true, true)
+
+			track := p.Tracks[current]
+			displayErr := ""
+			stream := ""
+
+			// no hls here, so it works without js
+			if cfg.Restream && *prefs.Player == cfg.RestreamPlayer {
+				if _, audio := track.Media.SelectCompatibleRestream(*prefs.RestreamAudio); audio == "" {
+					err = sc.ErrIncompatibleStream
+				} else {
+					stream = signing.URL("/_/api/restream"+track.Href(), "/_/api/restream"+track.Href())
+				}
+			} else if track.Media.SelectCompatibleProgressive() == nil {
+				err = sc.ErrIncompatibleStream
+			} else {
+				stream = "/_/api/progressive" + track.Href()
+				if !cfg.ProxyStreams {
+					stream += "?redirect=true"
+				}
+				stream = signing.URL(stream, "/_/api/progressive"+track.Href())
+			}
+
+			if err != nil {
+				displayErr = "Failed to get track stream: " + err.Error()
+				if track.Policy == sc.PolicyBlock {
+					displayErr += "\nThis track may be blocked in the country where this instance is hosted."
+				}
+			}
+
+			if wantsJSON(c) {
+				return c.JSON(fiber.Map{"playlist": p, "current": current, "stream": stream, "error": displayErr})
+			}
+
+			return misc.Render(c, templates.PlaylistEmbed(p, current, stream, displayErr, string(c.RequestCtx().QueryArgs().Peek("autoplay")) == "true", c.Query("volume")))
+		}
+
 		track, err := sc.GetArbitraryTrack(u)
 		if err != nil {
-			log.Printf("error getting %s: %s\n", u, err)
+			logger.Request(c).Warn("error getting embed", logging.Private("url", u), logging.Err(err))
 			return err
 		}
 		track.Postfix(prefs, true)
@@ -501,6 +751,7 @@ Disallow: /`)
 			if !cfg.ProxyStreams {
 				stream += "?redirect=true"
 			}
+			stream = signing.URL(stream, "/_/api/progressive"+track.Href())
 		}
 
 		if err != nil {
@@ -510,7 +761,28 @@ Disallow: /`)
 			}
 		}
 
-		return render(c, templates.TrackEmbed(prefs, track, stream, displayErr))
+		if wantsJSON(c) {
+			return c.JSON(fiber.Map{"track": track, "stream": stream, "error": displayErr})
+		}
+
+		return misc.Render(c, templates.TrackEmbed(prefs, track, stream, displayErr))
+	})
+
+	// playlist file, see serveExport
+	app.Get("/tags/:tag.:format", func(c fiber.Ctx) error {
+		_, format := sc.ExportFormat("." + c.Params("format"))
+		if format == "" {
+			return c.Next()
+		}
+
+		return serveExport(c, c.Params("tag"), format, func(prefs cfg.Preferences, audio string) (*sc.Export, error) {
+			e, err := sc.ExportTag(prefs, c.BaseURL(), c.Params("tag"), audio)
+			if err != nil {
+				logger.Request(c).Warn("error getting tagged recent-tracks (export)", "tag", c.Params("tag"), logging.Err(err))
+			}
+
+			return e, err
+		})
 	})
 
 	app.Get("/tags/:tag", func(c fiber.Ctx) error {
@@ -522,11 +794,11 @@ Disallow: /`)
 		tag := c.Params("tag")
 		p, err := sc.RecentTracks(prefs, tag, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s tagged recent-tracks: %s\n", tag, err)
+			logger.Request(c).Warn("error getting tagged recent-tracks", "tag", tag, logging.Err(err))
 			return err
 		}
 
-		return r(c, "Recent tracks tagged "+tag, templates.RecentTracks(tag, p), nil)
+		return r(c, fiber.Map{"tag": tag, "tracks": p}, "Recent tracks tagged "+tag, templates.RecentTracks(tag, p), nil)
 	})
 
 	app.Get("/tags/:tag/popular-tracks", func(c fiber.Ctx) error {
@@ -537,17 +809,13 @@ Disallow: /`)
 
 		tag := c.Params("tag")
 		args := c.RequestCtx().QueryArgs().Peek("pagination")
-		if len(args) == 0 {
-			args = []byte("q=*&filter.genre_or_tag=" + tag + "&sort=popular")
-		}
-
-		p, err := sc.SearchTracks(prefs, args)
+		p, err := sc.SearchTracks(prefs, sc.SearchOptions{Query: "*", Genre: tag, Sort: "popular"}, args)
 		if err != nil {
-			log.Printf("error getting %s tagged popular-tracks: %s\n", tag, err)
+			logger.Request(c).Warn("error getting tagged popular-tracks", "tag", tag, logging.Err(err))
 			return err
 		}
 
-		return r(c, "Popular tracks tagged "+tag, templates.PopularTracks(tag, p), nil)
+		return r(c, fiber.Map{"tag": tag, "tracks": p}, "Popular tracks tagged "+tag, templates.PopularTracks(tag, p), nil)
 	})
 
 	app.Get("/tags/:tag/playlists", func(c fiber.Ctx) error {
@@ -559,17 +827,13 @@ Disallow: /`)
 		tag := c.Params("tag")
 		// Using a different method, since /playlists/discovery endpoint seems to be broken :P
 		args := c.RequestCtx().QueryArgs().Peek("pagination")
-		if len(args) == 0 {
-			args = []byte("q=*&filter.genre_or_tag=" + tag)
-		}
-
-		p, err := sc.SearchPlaylists(prefs, args)
+		p, err := sc.SearchPlaylists(prefs, sc.SearchOptions{Query: "*", Genre: tag}, args)
 		if err != nil {
-			log.Printf("error getting %s tagged playlists: %s\n", tag, err)
+			logger.Request(c).Warn("error getting tagged playlists", "tag", tag, logging.Err(err))
 			return err
 		}
 
-		return r(c, "Playlists tagged "+tag, templates.TaggedPlaylists(tag, p), nil)
+		return r(c, fiber.Map{"tag": tag, "playlists": p}, "Playlists tagged "+tag, templates.TaggedPlaylists(tag, p), nil)
 	})
 
 	app.Get("/discover", func(c fiber.Ctx) error {
@@ -580,11 +844,11 @@ Disallow: /`)
 
 		selections, err := sc.GetSelections(prefs) // There is no pagination
 		if err != nil {
-			log.Printf("error getting selections: %s\n", err)
+			logger.Request(c).Warn("error getting selections", logging.Err(err))
 			return err
 		}
 
-		return r(c, "Discover", templates.Discover(selections), nil)
+		return r(c, selections, "Discover", templates.Discover(selections), nil)
 	})
 
 	if cfg.ProxyImages {
@@ -599,6 +863,10 @@ Disallow: /`)
 		api.Load(app)
 	}
 
+	if cfg.EnableSubsonic {
+		subsonic.Load(app)
+	}
+
 	if cfg.InstanceInfo {
 		type info struct {
 			DefaultPreferences cfg.Preferences
@@ -622,7 +890,8 @@ Disallow: /`)
 			EnableAPI:          cfg.EnableAPI,
 		})
 		if err != nil {
-			log.Fatalln("failed to marshal info: ", err)
+			logger.Error("failed to marshal info", logging.Err(err))
+			os.Exit(1)
 		}
 
 		app.Get("/_/info", func(c fiber.Ctx) error {
@@ -670,15 +939,17 @@ Disallow: /`)
 				p.DownloadAudio = &cfg.MP3
 			}
 
-			return r(c, "Download "+t.Title+" by "+t.Author.Username, templates.DownloadTrack(p, t, disabled_formats), nil)
+			return r(c, fiber.Map{"track": t, "disabled_formats": disabled_formats}, "Download "+t.Title+" by "+t.Author.Username, templates.DownloadTrack(p, t, disabled_formats), nil)
 		})
 
 		app.Post("/_/download/:author/:track", func(c fiber.Ctx) error {
-			return c.Redirect().To("/_/api/restream/" + c.Params("author") + "/" + c.Params("track") + "?metadata=true&" + strings.ReplaceAll(cfg.B2s(c.Body()), "+", "%20"))
+			p := "/_/api/restream/" + c.Params("author") + "/" + c.Params("track")
+			return c.Redirect().To(signing.URL(p+"?metadata=true&"+strings.ReplaceAll(cfg.B2s(c.Body()), "+", "%20"), p))
 		})
 	}
 
 	preferences.Load(app)
+	library.Load(app)
 
 	app.Get("/_/searchSuggestions", func(c fiber.Ctx) error {
 		q := c.Query("q")
@@ -749,6 +1020,165 @@ Disallow: /`)
 		})
 	}
 
+	{
+		type OEmbed struct {
+			XMLName      xml.Name `xml:"oembed" json:"-"`
+			Type         string   `xml:"type" json:"type"`
+			Version      string   `xml:"version" json:"version"`
+			Title        string   `xml:"title" json:"title"`
+			AuthorName   string   `xml:"author_name" json:"author_name"`
+			AuthorURL    string   `xml:"author_url" json:"author_url"`
+			ProviderName string   `xml:"provider_name" json:"provider_name"`
+			ProviderURL  string   `xml:"provider_url" json:"provider_url"`
+			ThumbnailURL string   `xml:"thumbnail_url,omitempty" json:"thumbnail_url,omitempty"`
+			HTML         string   `xml:"html" json:"html"`
+			Width        int      `xml:"width" json:"width"`
+			Height       int      `xml:"height" json:"height"`
+		}
+
+		// https://oembed.com
+		// url can be a link to this instance, a soundcloud.com link or just the path
+		app.Get("/_/oembed", func(c fiber.Ctx) error {
+			format := c.Query("format", "json")
+			if format != "json" && format != "xml" {
+				return fiber.NewError(fiber.StatusNotImplemented, "unsupported format")
+			}
+
+			u, err := url.Parse(c.Query("url"))
+			if err != nil {
+				return fiber.ErrNotFound
+			}
+
+			path := strings.Trim(u.Path, "/")
+			base := c.BaseURL()
+			o := OEmbed{
+				Type:         "rich",
+				Version:      "1.0",
+				ProviderName: "soundcloak",
+				ProviderURL:  base,
+				Width:        400,
+				Height:       600,
+			}
+
+			switch strings.Count(path, "/") {
+			case 1:
+				t, err := sc.GetTrack(path)
+				if err != nil {
+					return err
+				}
+
+				o.Title = t.Title
+				o.AuthorName = t.Author.Username
+				o.AuthorURL = base + "/" + t.Author.Permalink
+				o.ThumbnailURL = t.Artwork
+				o.Height = templates.TrackEmbedHeight(t)
+			case 2:
+				if !strings.Contains(path, "/sets/") {
+					return fiber.ErrNotFound
+				}
+
+				p, err := sc.GetPlaylist(path)
+				if err != nil {
+					return err
+				}
+
+				o.Title = p.Title
+				o.AuthorName = p.Author.Username
+				o.AuthorURL = base + "/" + p.Author.Permalink
+				o.ThumbnailURL = p.Artwork
+			default:
+				return fiber.ErrNotFound
+			}
+
+			if o.ThumbnailURL != "" && cfg.ProxyImages && *cfg.DefaultPreferences.ProxyImages {
+				o.ThumbnailURL = base + signing.Image(o.ThumbnailURL)
+			}
+
+			if w, err := strconv.Atoi(c.Query("maxwidth")); err == nil && w > 0 && w < o.Width {
+				o.Width = w
+			}
+			if h, err := strconv.Atoi(c.Query("maxheight")); err == nil && h > 0 && h < o.Height {
+				o.Height = h
+			}
+
+			o.HTML = fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0" allow="autoplay"></iframe>`,
+				html.EscapeString(base+"/w/player?url="+url.QueryEscape(path)), o.Width, o.Height)
+
+			if format == "xml" {
+				return c.XML(o)
+			}
+
+			return c.JSON(o)
+		})
+	}
+
+	// Playlist files. Permalinks and tags don't have dots in them, so anything else falls through to the normal pages
+	app.Get("/:user/sets/:playlist.:format", func(c fiber.Ctx) error {
+		_, format := sc.ExportFormat("." + c.Params("format"))
+		if format == "" {
+			return c.Next()
+		}
+
+		return serveExport(c, c.Params("playlist"), format, func(prefs cfg.Preferences, audio string) (*sc.Export, error) {
+			p, err := sc.GetPlaylist(c.Params("user") + "/sets/" + c.Params("playlist"))
+			if err != nil {
+				logger.Request(c).Warn("error getting playlist from user (export)", "playlist", c.Params("playlist"), "user", c.Params("user"), logging.Err(err))
+				return nil, err
+			}
+
+			e, err := p.Export(prefs, c.BaseURL(), audio)
+			if err != nil {
+				logger.Request(c).Warn("error getting playlist tracks from user (export)", "playlist", c.Params("playlist"), "user", c.Params("user"), logging.Err(err))
+			}
+
+			return e, err
+		})
+	})
+
+	app.Get("/:user/likes.:format", func(c fiber.Ctx) error {
+		_, format := sc.ExportFormat("." + c.Params("format"))
+		if format == "" {
+			return c.Next()
+		}
+
+		return serveExport(c, c.Params("user")+"_likes", format, func(prefs cfg.Preferences, audio string) (*sc.Export, error) {
+			user, err := sc.GetUser(c.Params("user"))
+			if err != nil {
+				logger.Request(c).Warn("error getting user (likes export)", "user", c.Params("user"), logging.Err(err))
+				return nil, err
+			}
+
+			e, err := user.ExportLikes(prefs, c.BaseURL(), audio)
+			if err != nil {
+				logger.Request(c).Warn("error getting user likes (export)", "user", c.Params("user"), logging.Err(err))
+			}
+
+			return e, err
+		})
+	})
+
+	app.Get("/:user.:format", func(c fiber.Ctx) error {
+		_, format := sc.ExportFormat("." + c.Params("format"))
+		if format == "" {
+			return c.Next()
+		}
+
+		return serveExport(c, c.Params("user"), format, func(prefs cfg.Preferences, audio string) (*sc.Export, error) {
+			user, err := sc.GetUser(c.Params("user"))
+			if err != nil {
+				logger.Request(c).Warn("error getting user (export)", "user", c.Params("user"), logging.Err(err))
+				return nil, err
+			}
+
+			e, err := user.ExportTracks(prefs, c.BaseURL(), audio)
+			if err != nil {
+				logger.Request(c).Warn("error getting user tracks (export)", "user", c.Params("user"), logging.Err(err))
+			}
+
+			return e, err
+		})
+	})
+
 	// Currently, /:user is the tracks page
 	app.Get("/:user/tracks", func(c fiber.Ctx) error {
 		return c.Redirect().To("/" + c.Params("user"))
@@ -762,18 +1192,18 @@ Disallow: /`)
 
 		user, err := sc.GetUser(c.Params("user"))
 		if err != nil {
-			log.Printf("error getting %s (playlists): %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user (playlists)", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		user.Postfix(prefs)
 
 		pl, err := user.GetPlaylists(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s playlists: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user playlists", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, user.Username, templates.UserPlaylists(prefs, user, pl), templates.UserHeader(user))
+		return r(c, fiber.Map{"user": user, "playlists": pl}, user.Username, templates.UserPlaylists(prefs, user, pl), templates.UserHeader(user))
 	})
 
 	app.Get("/:user/albums", func(c fiber.Ctx) error {
@@ -784,18 +1214,18 @@ Disallow: /`)
 
 		user, err := sc.GetUser(c.Params("user"))
 		if err != nil {
-			log.Printf("error getting %s (albums): %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user (albums)", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		user.Postfix(prefs)
 
 		pl, err := user.GetAlbums(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s albums: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user albums", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, user.Username, templates.UserAlbums(prefs, user, pl), templates.UserHeader(user))
+		return r(c, fiber.Map{"user": user, "albums": pl}, user.Username, templates.UserAlbums(prefs, user, pl), templates.UserHeader(user))
 	})
 
 	app.Get("/:user/reposts", func(c fiber.Ctx) error {
@@ -806,18 +1236,18 @@ Disallow: /`)
 
 		user, err := sc.GetUser(c.Params("user"))
 		if err != nil {
-			log.Printf("error getting %s (reposts): %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user (reposts)", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		user.Postfix(prefs)
 
 		p, err := user.GetReposts(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s reposts: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user reposts", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, user.Username, templates.UserReposts(prefs, user, p), templates.UserHeader(user))
+		return r(c, fiber.Map{"user": user, "reposts": p}, user.Username, templates.UserReposts(prefs, user, p), templates.UserHeader(user))
 	})
 
 	app.Get("/:user/likes", func(c fiber.Ctx) error {
@@ -828,18 +1258,18 @@ Disallow: /`)
 
 		user, err := sc.GetUser(c.Params("user"))
 		if err != nil {
-			log.Printf("error getting %s (likes): %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user (likes)", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		user.Postfix(prefs)
 
 		p, err := user.GetLikes(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s likes: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user likes", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, user.Username, templates.UserLikes(prefs, user, p), templates.UserHeader(user))
+		return r(c, fiber.Map{"user": user, "likes": p}, user.Username, templates.UserLikes(prefs, user, p), templates.UserHeader(user))
 	})
 
 	app.Get("/:user/popular-tracks", func(c fiber.Ctx) error {
@@ -850,18 +1280,18 @@ Disallow: /`)
 
 		user, err := sc.GetUser(c.Params("user"))
 		if err != nil {
-			log.Printf("error getting %s (popular-tracks): %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user (popular-tracks)", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		user.Postfix(prefs)
 
 		p, err := user.GetTopTracks(prefs)
 		if err != nil {
-			log.Printf("error getting %s popular tracks: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user popular tracks", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, user.Username, templates.UserTopTracks(prefs, user, p), templates.UserHeader(user))
+		return r(c, fiber.Map{"user": user, "tracks": p}, user.Username, templates.UserTopTracks(prefs, user, p), templates.UserHeader(user))
 	})
 
 	app.Get("/:user/followers", func(c fiber.Ctx) error {
@@ -872,18 +1302,18 @@ Disallow: /`)
 
 		user, err := sc.GetUser(c.Params("user"))
 		if err != nil {
-			log.Printf("error getting %s (followers): %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user (followers)", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		user.Postfix(prefs)
 
 		p, err := user.GetFollowers(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s followers: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user followers", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, user.Username, templates.UserFollowers(prefs, user, p), templates.UserHeader(user))
+		return r(c, fiber.Map{"user": user, "followers": p}, user.Username, templates.UserFollowers(prefs, user, p), templates.UserHeader(user))
 	})
 
 	app.Get("/:user/following", func(c fiber.Ctx) error {
@@ -894,18 +1324,18 @@ Disallow: /`)
 
 		user, err := sc.GetUser(c.Params("user"))
 		if err != nil {
-			log.Printf("error getting %s (following): %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user (following)", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		user.Postfix(prefs)
 
 		p, err := user.GetFollowing(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s following: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user following", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, user.Username, templates.UserFollowing(prefs, user, p), templates.UserHeader(user))
+		return r(c, fiber.Map{"user": user, "following": p}, user.Username, templates.UserFollowing(prefs, user, p), templates.UserHeader(user))
 	})
 
 	app.Get("/:user/:track", func(c fiber.Ctx) error {
@@ -916,7 +1346,7 @@ Disallow: /`)
 
 		track, err := sc.GetTrack(c.Params("user") + "/" + c.Params("track"))
 		if err != nil {
-			log.Printf("error getting %s from %s: %s\n", c.Params("track"), c.Params("user"), err)
+			logger.Request(c).Warn("error getting track from user", "track", c.Params("track"), "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		track.Postfix(prefs, true)
@@ -936,9 +1366,10 @@ Disallow: /`)
 					if !*prefs.ProxyStreams {
 						stream += "?redirect_parts=true"
 					}
+					stream = signing.URL(stream, "/_/api/hls"+track.Href())
 				}
 			} else if *prefs.Player == cfg.RestreamPlayer {
-				stream = "/_/api/restream" + track.Href()
+				stream = signing.URL("/_/api/restream"+track.Href(), "/_/api/restream"+track.Href())
 				_, audio = track.Media.SelectCompatibleRestream(*prefs.RestreamAudio)
 				if audio == "" {
 					err = sc.ErrIncompatibleStream
@@ -953,6 +1384,7 @@ Disallow: /`)
 					if !*prefs.ProxyStreams {
 						stream += "?redirect=true"
 					}
+					stream = signing.URL(stream, "/_/api/progressive"+track.Href())
 				}
 			}
 
@@ -968,17 +1400,28 @@ Disallow: /`)
 		var nextTrack *sc.Track
 		mode := c.Query("mode", *prefs.DefaultAutoplayMode)
 		if pl := c.Query("playlist"); pl != "" {
-			p, err := sc.GetPlaylist(pl)
-			if err != nil {
-				log.Printf("error getting %s playlist (track): %s\n", pl, err)
-				return err
+			var p sc.Playlist
+			if id, ok := strings.CutPrefix(pl, "_/library/"); ok {
+				p, ok = library.Get(c).Playlist(id)
+				if !ok {
+					return fiber.ErrNotFound
+				}
+			} else {
+				p, err = sc.GetPlaylist(pl)
+				if err != nil {
+					logger.Request(c).Warn("error getting playlist (track)", logging.Private("playlist", pl), logging.Err(err))
+					return err
+				}
 			}
 
 			p.Tracks = p.Postfix(prefs, true, false)
 
 			nextIndex := -1
 			if mode == cfg.AutoplayRandom {
-				nextIndex = rand.Intn(len(p.Tracks))
+				// local playlists can be empty
+				if len(p.Tracks) != 0 {
+					nextIndex = rand.Intn(len(p.Tracks))
+				}
 			} else {
 				for i, t := range p.Tracks {
 					if t.ID == track.ID {
@@ -1023,12 +1466,12 @@ Disallow: /`)
 		if q := c.Query("pagination"); q != "" {
 			comments, err = track.GetComments(prefs, q)
 			if err != nil {
-				log.Printf("failed to get %s from %s comments: %s\n", c.Params("track"), c.Params("user"), err)
+				logger.Request(c).Warn("error getting track comments", "track", c.Params("track"), "user", c.Params("user"), logging.Err(err))
 				return err
 			}
 		}
 
-		return r(c, track.Title+" by "+track.Author.Username, templates.Track(prefs, track, stream, displayErr, string(c.RequestCtx().QueryArgs().Peek("autoplay")) == "true", playlist, nextTrack, c.Query("volume"), mode, audio, comments), templates.TrackHeader(prefs, track, true))
+		return r(c, fiber.Map{"track": track, "stream": stream, "audio": audio, "error": displayErr, "playlist": playlist, "next_track": nextTrack, "comments": comments}, track.Title+" by "+track.Author.Username, templates.Track(prefs, track, stream, displayErr, string(c.RequestCtx().QueryArgs().Peek("autoplay")) == "true", playlist, nextTrack, c.Query("volume"), mode, audio, comments), templates.TrackHeader(prefs, track, true))
 	})
 
 	app.Get("/_/partials/comments/:id", func(c fiber.Ctx) error {
@@ -1060,36 +1503,103 @@ Disallow: /`)
 			c.Set("next", "done")
 		}
 
-		return render(c, templates.Comments(comm))
+		return misc.Render(c, templates.Comments(comm))
 	})
 
 	app.Get("/_/rss/:user", func(c fiber.Ctx) error {
-		prefs, err := preferences.Get(c)
-		if err != nil {
-			return err
-		}
+		name, format := feedFormat(c, c.Params("user"))
+		return serveFeed(c, format, func(prefs cfg.Preferences, audio string) (*sc.Feed, error) {
+			usr, err := sc.GetUser(name)
+			if err != nil {
+				logger.Request(c).Warn("error getting user (rss)", "user", name, logging.Err(err))
+				return nil, err
+			}
+
+			return usr.GenerateFeed(c.RequestCtx(), prefs, c.BaseURL(), audio)
+		})
+	})
 
-		if cfg.ProxyImages {
-			q := c.RequestCtx().QueryArgs()
-			b := q.Peek("proxy_images")
-			if b != nil {
-				prefs.ProxyImages = boolean2(b)
+	app.Get("/_/rss/_/tags/:tag", func(c fiber.Ctx) error {
+		tag, format := feedFormat(c, c.Params("tag"))
+		return serveFeed(c, format, func(prefs cfg.Preferences, audio string) (*sc.Feed, error) {
+			f, err := sc.GenerateTagFeed(c.RequestCtx(), prefs, c.BaseURL(), tag, audio)
+			if err != nil {
+				logger.Request(c).Warn("error getting tagged recent-tracks (rss)", "tag", tag, logging.Err(err))
 			}
-		}
 
-		usr, err := sc.GetUser(c.Params("user"))
-		if err != nil {
-			log.Printf("error getting %s (rss): %s\n", c.Params("user"), err)
-			return err
+			return f, err
+		})
+	})
+
+	app.Get("/_/rss/:user/:kind", func(c fiber.Ctx) error {
+		kind, format := feedFormat(c, c.Params("kind"))
+		if c.Params("user") == "_" {
+			if kind == "following" {
+				list, err := following.Decode(c.Query("list"))
+				if err != nil {
+					return fiber.NewError(fiber.StatusBadRequest, "bad following list")
+				}
+
+				return serveFeed(c, format, func(prefs cfg.Preferences, audio string) (*sc.Feed, error) {
+					return sc.GenerateFollowingFeed(c.RequestCtx(), prefs, c.BaseURL(), list, audio)
+				})
+			}
+
+			if kind != "search" {
+				return fiber.ErrNotFound
+			}
+
+			opts := sc.ParseSearchOptions(c.RequestCtx().QueryArgs())
+			if opts.Query == "" {
+				return fiber.ErrBadRequest
+			}
+
+			return serveFeed(c, format, func(prefs cfg.Preferences, audio string) (*sc.Feed, error) {
+				f, err := sc.GenerateSearchFeed(c.RequestCtx(), prefs, c.BaseURL(), opts, audio)
+				if err != nil {
+					logger.Request(c).Warn("error searching (rss)", logging.Private("query", opts.Query), logging.Err(err))
+				}
+
+				return f, err
+			})
 		}
 
-		feed, err := usr.GenerateFeed(c.RequestCtx(), prefs, c.BaseURL())
-		if err != nil {
-			return err
+		if kind != "reposts" && kind != "likes" {
+			return fiber.ErrNotFound
 		}
 
-		c.RequestCtx().SetContentType("application/rss+xml")
-		return c.Send(feed)
+		return serveFeed(c, format, func(prefs cfg.Preferences, audio string) (*sc.Feed, error) {
+			usr, err := sc.GetUser(c.Params("user"))
+			if err != nil {
+				logger.Request(c).Warn("error getting user (rss)", "user", c.Params("user"), "kind", kind, logging.Err(err))
+				return nil, err
+			}
+
+			var f *sc.Feed
+			if kind == "reposts" {
+				f, err = usr.GenerateRepostsFeed(c.RequestCtx(), prefs, c.BaseURL(), audio)
+			} else {
+				f, err = usr.GenerateLikesFeed(c.RequestCtx(), prefs, c.BaseURL(), audio)
+			}
+			if err != nil {
+				logger.Request(c).Warn("error getting user feed (rss)", "user", c.Params("user"), "kind", kind, logging.Err(err))
+			}
+
+			return f, err
+		})
+	})
+
+	app.Get("/_/rss/:user/sets/:playlist", func(c fiber.Ctx) error {
+		name, format := feedFormat(c, c.Params("playlist"))
+		return serveFeed(c, format, func(prefs cfg.Preferences, audio string) (*sc.Feed, error) {
+			playlist, err := sc.GetPlaylist(c.Params("user") + "/sets/" + name)
+			if err != nil {
+				logger.Request(c).Warn("error getting playlist from user (rss)", "playlist", name, "user", c.Params("user"), logging.Err(err))
+				return nil, err
+			}
+
+			return playlist.GenerateFeed(c.RequestCtx(), prefs, c.BaseURL(), audio)
+		})
 	})
 
 	app.Get("/:user", func(c fiber.Ctx) error {
@@ -1100,18 +1610,18 @@ Disallow: /`)
 
 		usr, err := sc.GetUser(c.Params("user"))
 		if err != nil {
-			log.Printf("error getting %s: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		usr.Postfix(prefs)
 
 		p, err := usr.GetTracks(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s tracks: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user tracks", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, usr.Username, templates.User(prefs, usr, p), templates.UserHeader(usr))
+		return r(c, fiber.Map{"user": usr, "tracks": p}, usr.Username, templates.User(prefs, usr, p), templates.UserHeader(usr))
 	})
 
 	app.Get("/:user/sets/:playlist", func(c fiber.Ctx) error {
@@ -1122,7 +1632,7 @@ Disallow: /`)
 
 		playlist, err := sc.GetPlaylist(c.Params("user") + "/sets/" + c.Params("playlist"))
 		if err != nil {
-			log.Printf("error getting %s playlist from %s: %s\n", c.Params("playlist"), c.Params("user"), err)
+			logger.Request(c).Warn("error getting playlist from user", "playlist", c.Params("playlist"), "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		// Don't ask why
@@ -1132,7 +1642,7 @@ Disallow: /`)
 		if p != "" {
 			tracks, next, err := sc.GetNextMissingTracks(p)
 			if err != nil {
-				log.Printf("error getting %s playlist tracks from %s: %s\n", c.Params("playlist"), c.Params("user"), err)
+				logger.Request(c).Warn("error getting playlist tracks from user", "playlist", c.Params("playlist"), "user", c.Params("user"), logging.Err(err))
 				return err
 			}
 
@@ -1145,7 +1655,7 @@ Disallow: /`)
 			playlist.MissingTracks = strings.Join(next, ",")
 		}
 
-		return r(c, playlist.Title+" by "+playlist.Author.Username, templates.Playlist(prefs, playlist), templates.PlaylistHeader(playlist))
+		return r(c, playlist, playlist.Title+" by "+playlist.Author.Username, templates.Playlist(prefs, playlist), templates.PlaylistHeader(playlist))
 	})
 
 	app.Get("/:user/_/related", func(c fiber.Ctx) error {
@@ -1156,18 +1666,18 @@ Disallow: /`)
 
 		user, err := sc.GetUser(c.Params("user"))
 		if err != nil {
-			log.Printf("error getting %s (related): %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user (related)", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		user.Postfix(prefs)
 
 		rel, err := user.GetRelated(prefs)
 		if err != nil {
-			log.Printf("error getting %s related users: %s\n", c.Params("user"), err)
+			logger.Request(c).Warn("error getting user related users", "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, user.Username, templates.UserRelated(prefs, user, rel), templates.UserHeader(user))
+		return r(c, fiber.Map{"user": user, "related": rel}, user.Username, templates.UserRelated(prefs, user, rel), templates.UserHeader(user))
 	})
 
 	// I'd like to make this "related" but keeping it "recommended" to have the same url as soundcloud
@@ -1179,18 +1689,18 @@ Disallow: /`)
 
 		track, err := sc.GetTrack(c.Params("user") + "/" + c.Params("track"))
 		if err != nil {
-			log.Printf("error getting %s from %s (related): %s\n", c.Params("track"), c.Params("user"), err)
+			logger.Request(c).Warn("error getting track from user (related)", "track", c.Params("track"), "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		track.Postfix(prefs, true)
 
 		rel, err := track.GetRelated(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s from %s related tracks: %s\n", c.Params("track"), c.Params("user"), err)
+			logger.Request(c).Warn("error getting track from user related tracks", "track", c.Params("track"), "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, track.Title+" by "+track.Author.Username, templates.RelatedTracks(track, rel), templates.TrackHeader(prefs, track, false))
+		return r(c, fiber.Map{"track": track, "related": rel}, track.Title+" by "+track.Author.Username, templates.RelatedTracks(track, rel), templates.TrackHeader(prefs, track, false))
 	})
 
 	app.Get("/:user/:track/sets", func(c fiber.Ctx) error {
@@ -1201,18 +1711,18 @@ Disallow: /`)
 
 		track, err := sc.GetTrack(c.Params("user") + "/" + c.Params("track"))
 		if err != nil {
-			log.Printf("error getting %s from %s (sets): %s\n", c.Params("track"), c.Params("user"), err)
+			logger.Request(c).Warn("error getting track from user (sets)", "track", c.Params("track"), "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		track.Postfix(prefs, true)
 
 		p, err := track.GetPlaylists(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s from %s sets: %s\n", c.Params("track"), c.Params("user"), err)
+			logger.Request(c).Warn("error getting track from user sets", "track", c.Params("track"), "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, track.Title+" by "+track.Author.Username, templates.TrackInPlaylists(track, p), templates.TrackHeader(prefs, track, false))
+		return r(c, fiber.Map{"track": track, "playlists": p}, track.Title+" by "+track.Author.Username, templates.TrackInPlaylists(track, p), templates.TrackHeader(prefs, track, false))
 	})
 
 	app.Get("/:user/:track/albums", func(c fiber.Ctx) error {
@@ -1223,18 +1733,18 @@ Disallow: /`)
 
 		track, err := sc.GetTrack(c.Params("user") + "/" + c.Params("track"))
 		if err != nil {
-			log.Printf("error getting %s from %s (albums): %s\n", c.Params("track"), c.Params("user"), err)
+			logger.Request(c).Warn("error getting track from user (albums)", "track", c.Params("track"), "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 		track.Postfix(prefs, true)
 
 		p, err := track.GetAlbums(prefs, c.Query("pagination", "limit=20"))
 		if err != nil {
-			log.Printf("error getting %s from %s albums: %s\n", c.Params("track"), c.Params("user"), err)
+			logger.Request(c).Warn("error getting track from user albums", "track", c.Params("track"), "user", c.Params("user"), logging.Err(err))
 			return err
 		}
 
-		return r(c, track.Title+" by "+track.Author.Username, templates.TrackInAlbums(track, p), templates.TrackHeader(prefs, track, false))
+		return r(c, fiber.Map{"track": track, "albums": p}, track.Title+" by "+track.Author.Username, templates.TrackInAlbums(track, p), templates.TrackHeader(prefs, track, false))
 	})
 
 	// cute
@@ -1279,8 +1789,17 @@ Disallow: /`)
 
 	fmt.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
 	if cfg.CodegenConfig {
-		log.Println("Warning: you have CodegenConfig enabled, but the config was loaded dynamically.")
+		logger.Warn("you have CodegenConfig enabled, but the config was loaded dynamically")
+	}
+
+	if cfg.RandomCookieSecret {
+		logger.Warn("CookieSecret is not set, follow lists and other signed cookies will stop working after a restart")
+		if cfg.SignProxyURLs {
+			logger.Warn("SignProxyURLs is enabled without CookieSecret, signed links (like feed enclosures) will stop working after a restart, set CookieSecret to keep them")
+		}
 	}
 
-	log.Fatal(app.Listen(cfg.Addr, fiber.ListenConfig{EnablePrefork: cfg.Prefork, DisableStartupMessage: true, ListenerNetwork: cfg.Network, UnixSocketFileMode: cfg.UnixSocketPerms}))
+	err := app.Listen(cfg.Addr, fiber.ListenConfig{EnablePrefork: cfg.Prefork, DisableStartupMessage: true, ListenerNetwork: cfg.Network, UnixSocketFileMode: cfg.UnixSocketPerms})
+	logger.Error("failed to listen", logging.Err(err))
+	os.Exit(1)
 }